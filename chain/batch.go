@@ -0,0 +1,94 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//disperseABI is the batch transfer entry point of the Disperse contract (disperse.app)
+const disperseABI = `[{"name":"disperseToken","type":"function","stateMutability":"nonpayable","inputs":[` +
+	`{"name":"token","type":"address"},{"name":"recipients","type":"address[]"},{"name":"values","type":"uint256[]"}],"outputs":[]}]`
+
+//BatchItem is one recipient of a batched payout
+type BatchItem struct {
+	To     string
+	Amount *big.Int //token base units
+}
+
+//BatchTransferer sends several token transfers in a single transaction
+type BatchTransferer interface {
+	TransferBatch(ctx context.Context, items []BatchItem, record Record) (SentTx, error)
+	//ReplaceBatch sends the batch again under the nonce of previous with higher fees, so at most one of the two is mined
+	ReplaceBatch(ctx context.Context, previous SentTx, items []BatchItem, record Record) (SentTx, error)
+}
+
+//EnableBatching routes TransferBatch through the Disperse contract at contract, the master
+//wallet must have approved it to spend the reward token
+func (t *EthTransferer) EnableBatching(contract string) error {
+	if !common.IsHexAddress(contract) {
+		return fmt.Errorf("invalid batch contract address %q", contract)
+	}
+	parsed, err := abi.JSON(strings.NewReader(disperseABI))
+	if err != nil {
+		return err
+	}
+	t.batchContract = common.HexToAddress(contract)
+	t.batchABI = &parsed
+	return nil
+}
+
+//TransferBatch pays every item with one disperseToken call
+func (t *EthTransferer) TransferBatch(ctx context.Context, items []BatchItem, record Record) (SentTx, error) {
+	data, gasLimit, err := t.batchCall(ctx, items)
+	if err != nil {
+		return SentTx{}, err
+	}
+	return t.sendDynamic(ctx, t.batchContract, data, gasLimit, len(items), record)
+}
+
+//ReplaceBatch sends the disperseToken call again under the nonce of previous, paying more than previous did
+func (t *EthTransferer) ReplaceBatch(ctx context.Context, previous SentTx, items []BatchItem, record Record) (SentTx, error) {
+	data, gasLimit, err := t.batchCall(ctx, items)
+	if err != nil {
+		return SentTx{}, err
+	}
+	return t.replaceDynamic(ctx, previous, t.batchContract, data, gasLimit, len(items), record)
+}
+
+//batchCall encodes the disperseToken call paying items and estimates its gas
+func (t *EthTransferer) batchCall(ctx context.Context, items []BatchItem) ([]byte, uint64, error) {
+	if t.batchABI == nil {
+		return nil, 0, fmt.Errorf("batching is not enabled")
+	}
+	recipients := make([]common.Address, len(items))
+	values := make([]*big.Int, len(items))
+	for i, item := range items {
+		if !common.IsHexAddress(item.To) {
+			return nil, 0, fmt.Errorf("invalid recipient address %q", item.To)
+		}
+		if item.Amount == nil || item.Amount.Sign() <= 0 {
+			return nil, 0, fmt.Errorf("invalid token amount %v", item.Amount)
+		}
+		recipients[i] = common.HexToAddress(item.To)
+		values[i] = item.Amount
+	}
+	data, err := t.batchABI.Pack("disperseToken", t.token, recipients, values)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to encode batch: %v", err)
+	}
+	gasLimit, err := t.backend.EstimateGas(ctx, ethereum.CallMsg{
+		From: t.from,
+		To:   &t.batchContract,
+		Data: data,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to estimate gas: %v", err)
+	}
+	return data, gasLimit, nil
+}
@@ -0,0 +1,170 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+//Transfer is a transfer recorded by FakeTransferer
+type Transfer struct {
+	To     string
+	Amount *big.Int
+	TxHash string
+}
+
+//FakeTransferer records transfers in memory without touching a chain
+type FakeTransferer struct {
+	mu        sync.Mutex
+	transfers []Transfer
+	receipts  map[string]Receipt
+	nonces    map[string]uint64 //nonce of every hash sent
+	nonce     uint64
+	token     *big.Int
+	native    *big.Int
+	//Err when set is returned by every Transfer call
+	Err error
+}
+
+//NewFakeTransferer creates an empty in-memory transferer with a well funded master wallet
+func NewFakeTransferer() *FakeTransferer {
+	plenty := new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil)
+	return &FakeTransferer{receipts: make(map[string]Receipt), nonces: make(map[string]uint64), token: plenty, native: plenty}
+}
+
+//SetBalances sets the token and native balances reported for every account
+func (f *FakeTransferer) SetBalances(token, native *big.Int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token, f.native = token, native
+}
+
+//TokenBalance returns the token balance set with SetBalances
+func (f *FakeTransferer) TokenBalance(ctx context.Context, account string) (*big.Int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return new(big.Int).Set(f.token), nil
+}
+
+//NativeBalance returns the native balance set with SetBalances
+func (f *FakeTransferer) NativeBalance(ctx context.Context, account string) (*big.Int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return new(big.Int).Set(f.native), nil
+}
+
+//FakeDecimals are the decimals of the token simulated by FakeTransferer
+const FakeDecimals = 18
+
+//Decimals returns FakeDecimals
+func (f *FakeTransferer) Decimals(ctx context.Context) (uint8, error) {
+	return FakeDecimals, nil
+}
+
+//Transfer records the transfer, it is confirmed in the next fake block
+func (f *FakeTransferer) Transfer(ctx context.Context, to string, amount *big.Int, record Record) (SentTx, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nonce := f.nonce
+	sent, err := f.send(ctx, nonce, []BatchItem{{To: to, Amount: amount}}, record)
+	if err == nil {
+		f.nonce++
+	}
+	return sent, err
+}
+
+//Replace records the transfer again under the nonce of previous
+func (f *FakeTransferer) Replace(ctx context.Context, previous SentTx, to string, amount *big.Int, record Record) (SentTx, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.send(ctx, previous.Nonce, []BatchItem{{To: to, Amount: amount}}, record)
+}
+
+//TransferBatch records every item under a single fake transaction
+func (f *FakeTransferer) TransferBatch(ctx context.Context, items []BatchItem, record Record) (SentTx, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nonce := f.nonce
+	sent, err := f.send(ctx, nonce, items, record)
+	if err == nil {
+		f.nonce++
+	}
+	return sent, err
+}
+
+//ReplaceBatch records every item again under the nonce of previous
+func (f *FakeTransferer) ReplaceBatch(ctx context.Context, previous SentTx, items []BatchItem, record Record) (SentTx, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.send(ctx, previous.Nonce, items, record)
+}
+
+//send records items as one transaction with nonce, confirmed in the next fake block
+func (f *FakeTransferer) send(ctx context.Context, nonce uint64, items []BatchItem, record Record) (SentTx, error) {
+	if f.Err != nil {
+		return SentTx{}, f.Err
+	}
+	if len(items) == 0 {
+		return SentTx{}, fmt.Errorf("nothing to transfer")
+	}
+	for _, item := range items {
+		if !common.IsHexAddress(item.To) {
+			return SentTx{}, fmt.Errorf("invalid recipient address %q", item.To)
+		}
+	}
+	hash := crypto.Keccak256Hash([]byte(fmt.Sprintf("%d:%d:%s:%s", nonce, len(f.transfers), items[0].To, items[0].Amount))).Hex()
+	gas := 21000 * uint64(len(items))
+	sent := SentTx{Hash: hash, Nonce: nonce, Gas: gas, GasFeeCap: big.NewInt(1), GasTipCap: big.NewInt(1)}
+	if record != nil {
+		if err := record(ctx, sent); err != nil {
+			return SentTx{}, fmt.Errorf("unable to record transaction: %v", err)
+		}
+	}
+	for _, item := range items {
+		f.transfers = append(f.transfers, Transfer{To: item.To, Amount: item.Amount, TxHash: hash})
+	}
+	f.receipts[hash] = Receipt{Status: TxConfirmed, BlockNumber: nonce + 1, GasUsed: gas}
+	f.nonces[hash] = nonce
+	return sent, nil
+}
+
+//NonceUsed reports whether a transaction with nonce has a confirmed or reverted receipt
+func (f *FakeTransferer) NonceUsed(ctx context.Context, nonce uint64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for hash, n := range f.nonces {
+		if status := f.receipts[hash].Status; n == nonce && (status == TxConfirmed || status == TxReverted) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//Receipt returns the receipt of a recorded transfer
+func (f *FakeTransferer) Receipt(ctx context.Context, txHash string) (Receipt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	receipt, ok := f.receipts[txHash]
+	if !ok {
+		return Receipt{Status: TxNotFound}, nil
+	}
+	return receipt, nil
+}
+
+//SetReceipt overrides the receipt returned for txHash
+func (f *FakeTransferer) SetReceipt(txHash string, receipt Receipt) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.receipts[txHash] = receipt
+}
+
+//Transfers returns a copy of the recorded transfers
+func (f *FakeTransferer) Transfers() []Transfer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Transfer(nil), f.transfers...)
+}
@@ -0,0 +1,176 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+//ErrFeesAboveCap is returned instead of sending when network fees exceed the GasPolicy,
+//nothing was sent and the transfer can be retried later
+var ErrFeesAboveCap = errors.New("network fees exceed the gas policy")
+
+//GasPolicy bounds what payouts may spend on gas, nil fields are not enforced
+type GasPolicy struct {
+	//MaxFeePerGas caps the fee cap of every transaction
+	MaxFeePerGas *big.Int
+	//MaxPriorityFeePerGas caps the tip paid to the sequencer
+	MaxPriorityFeePerGas *big.Int
+	//MaxGasCostPerClaim caps gas limit times fee cap per paid out claim
+	MaxGasCostPerClaim *big.Int
+}
+
+//fees are the EIP-1559 fee parameters of a transaction
+type fees struct {
+	tipCap *big.Int
+	feeCap *big.Int
+}
+
+//suggestFees prices a transaction at twice the current base fee plus the suggested tip, within policy
+func (t *EthTransferer) suggestFees(ctx context.Context) (fees, error) {
+	head, err := t.backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fees{}, fmt.Errorf("unable to get latest header: %v", err)
+	}
+	if head.BaseFee == nil {
+		return fees{}, fmt.Errorf("chain does not support EIP-1559")
+	}
+	tip, err := t.backend.SuggestGasTipCap(ctx)
+	if err != nil {
+		return fees{}, fmt.Errorf("unable to suggest gas tip: %v", err)
+	}
+	policy := t.policy
+	if policy.MaxPriorityFeePerGas != nil && tip.Cmp(policy.MaxPriorityFeePerGas) > 0 {
+		tip = new(big.Int).Set(policy.MaxPriorityFeePerGas)
+	}
+	feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)
+	if policy.MaxFeePerGas != nil {
+		if new(big.Int).Add(head.BaseFee, tip).Cmp(policy.MaxFeePerGas) > 0 {
+			return fees{}, fmt.Errorf("%w: base fee %s wei", ErrFeesAboveCap, head.BaseFee)
+		}
+		if feeCap.Cmp(policy.MaxFeePerGas) > 0 {
+			feeCap = new(big.Int).Set(policy.MaxFeePerGas)
+		}
+	}
+	return fees{tipCap: tip, feeCap: feeCap}, nil
+}
+
+//checkBudget refuses transactions that could cost more than the per claim budget allows
+func (t *EthTransferer) checkBudget(gasLimit uint64, f fees, claims int) error {
+	if t.policy.MaxGasCostPerClaim == nil {
+		return nil
+	}
+	cost := new(big.Int).Mul(new(big.Int).SetUint64(gasLimit), f.feeCap)
+	budget := new(big.Int).Mul(t.policy.MaxGasCostPerClaim, big.NewInt(int64(claims)))
+	if cost.Cmp(budget) > 0 {
+		return fmt.Errorf("%w: gas cost up to %s wei over budget of %s wei", ErrFeesAboveCap, cost, budget)
+	}
+	return nil
+}
+
+//sendDynamic prices, signs and sends an EIP-1559 call of data to contract paying out claims claims
+func (t *EthTransferer) sendDynamic(ctx context.Context, to common.Address, data []byte, gasLimit uint64, claims int,
+	record Record) (SentTx, error) {
+	f, err := t.suggestFees(ctx)
+	if err != nil {
+		return SentTx{}, err
+	}
+	if err = t.checkBudget(gasLimit, f, claims); err != nil {
+		return SentTx{}, err
+	}
+	signedTx, err := t.send(ctx, t.dynamicTx(to, data, gasLimit, f), record)
+	if err != nil {
+		return SentTx{}, err
+	}
+	return sentTx(signedTx), nil
+}
+
+//replaceDynamic sends the call of data to contract under the nonce of previous, with both fees raised
+//past those of previous so the node accepts it in its place
+func (t *EthTransferer) replaceDynamic(ctx context.Context, previous SentTx, to common.Address, data []byte, gasLimit uint64,
+	claims int, record Record) (SentTx, error) {
+	f, err := t.replacementFees(ctx, previous)
+	if err != nil {
+		return SentTx{}, err
+	}
+	if err = t.checkBudget(gasLimit, f, claims); err != nil {
+		return SentTx{}, err
+	}
+	signedTx, err := t.signer.SignTx(ctx, t.dynamicTx(to, data, gasLimit, f)(previous.Nonce), t.chainID)
+	if err != nil {
+		return SentTx{}, fmt.Errorf("unable to sign transaction: %v", err)
+	}
+	if record != nil {
+		if err = record(ctx, sentTx(signedTx)); err != nil {
+			return SentTx{}, fmt.Errorf("unable to record transaction: %v", err)
+		}
+	}
+	if err = t.backend.SendTransaction(ctx, signedTx); err != nil && !isAlreadyKnown(err) {
+		return SentTx{}, fmt.Errorf("unable to send replacement of %s: %v", previous.Hash, err)
+	}
+	_ = t.nonces.Sent(ctx, previous.Nonce)
+	return sentTx(signedTx), nil
+}
+
+//replacementFees prices a replacement of previous at the current fees, or at least 12.5% above previous
+//as nodes only replace a pending transaction for 10% more
+func (t *EthTransferer) replacementFees(ctx context.Context, previous SentTx) (fees, error) {
+	f, err := t.suggestFees(ctx)
+	if err != nil {
+		return fees{}, err
+	}
+	if tip := bumpFee(previous.GasTipCap); tip.Cmp(f.tipCap) > 0 {
+		f.tipCap = tip
+	}
+	if feeCap := bumpFee(previous.GasFeeCap); feeCap.Cmp(f.feeCap) > 0 {
+		f.feeCap = feeCap
+	}
+	policy := t.policy
+	if policy.MaxPriorityFeePerGas != nil && f.tipCap.Cmp(policy.MaxPriorityFeePerGas) > 0 {
+		return fees{}, fmt.Errorf("%w: replacement tip %s wei", ErrFeesAboveCap, f.tipCap)
+	}
+	if policy.MaxFeePerGas != nil && f.feeCap.Cmp(policy.MaxFeePerGas) > 0 {
+		return fees{}, fmt.Errorf("%w: replacement fee cap %s wei", ErrFeesAboveCap, f.feeCap)
+	}
+	return f, nil
+}
+
+//bumpFee raises fee by 12.5%, rounded up
+func bumpFee(fee *big.Int) *big.Int {
+	if fee == nil {
+		return new(big.Int)
+	}
+	bumped := new(big.Int).Mul(fee, big.NewInt(9))
+	bumped.Add(bumped, big.NewInt(7))
+	return bumped.Div(bumped, big.NewInt(8))
+}
+
+//dynamicTx builds the EIP-1559 call of data to contract for a nonce
+func (t *EthTransferer) dynamicTx(to common.Address, data []byte, gasLimit uint64, f fees) func(nonce uint64) *types.Transaction {
+	return func(nonce uint64) *types.Transaction {
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:   t.chainID,
+			Nonce:     nonce,
+			GasTipCap: f.tipCap,
+			GasFeeCap: f.feeCap,
+			Gas:       gasLimit,
+			To:        &to,
+			Value:     big.NewInt(0),
+			Data:      data,
+		})
+	}
+}
+
+func sentTx(signedTx *types.Transaction) SentTx {
+	return SentTx{
+		Hash:      signedTx.Hash().Hex(),
+		Nonce:     signedTx.Nonce(),
+		Gas:       signedTx.Gas(),
+		GasFeeCap: signedTx.GasFeeCap(),
+		GasTipCap: signedTx.GasTipCap(),
+	}
+}
@@ -0,0 +1,179 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//NonceStore persists the last nonce used by an account so restarts do not reuse it
+type NonceStore interface {
+	LastNonce(ctx context.Context, account string) (uint64, bool, error)
+	//SaveNonce records nonce as used, the stored nonce never decreases
+	SaveNonce(ctx context.Context, account string, nonce uint64) error
+	//ResetNonce replaces the stored nonce so the next one used is pending, it may decrease
+	ResetNonce(ctx context.Context, account string, pending uint64) error
+}
+
+//NonceSource reads the pending nonce of an account from the chain
+type NonceSource interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+//NonceManager hands out consecutive nonces for a single sending account
+type NonceManager struct {
+	mu       sync.Mutex
+	account  common.Address
+	source   NonceSource
+	store    NonceStore
+	next     uint64
+	synced   bool
+	inFlight map[uint64]bool //nonces handed out and not yet sent or given back
+	stale    bool            //a nonce was given back below next, resync once none is in flight
+}
+
+//NewNonceManager creates a manager for account, store may be nil to keep nonces in memory only
+func NewNonceManager(account common.Address, source NonceSource, store NonceStore) *NonceManager {
+	return &NonceManager{account: account, source: source, store: store, inFlight: make(map[uint64]bool)}
+}
+
+//Sync sets the next nonce to the higher of the chain's pending nonce and the last persisted one
+func (m *NonceManager) Sync(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sync(ctx, true)
+}
+
+//Reset drops local and stored state and takes the next nonce from the chain so nonces that never reached
+//the network are used again instead of leaving a gap, it must not run while nonces are in flight
+func (m *NonceManager) Reset(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reset(ctx)
+}
+
+func (m *NonceManager) reset(ctx context.Context) error {
+	if err := m.sync(ctx, false); err != nil {
+		return err
+	}
+	if m.store != nil {
+		if err := m.store.ResetNonce(ctx, m.account.Hex(), m.next); err != nil {
+			return fmt.Errorf("unable to reset stored nonce: %v", err)
+		}
+	}
+	m.stale = false
+	return nil
+}
+
+func (m *NonceManager) sync(ctx context.Context, useStore bool) error {
+	pending, err := m.source.PendingNonceAt(ctx, m.account)
+	if err != nil {
+		return fmt.Errorf("unable to get pending nonce: %v", err)
+	}
+	next := pending
+	if useStore && m.store != nil {
+		last, ok, err := m.store.LastNonce(ctx, m.account.Hex())
+		if err != nil {
+			return fmt.Errorf("unable to load last nonce: %v", err)
+		}
+		if ok && last+1 > next {
+			next = last + 1
+		}
+	}
+	m.next = next
+	m.synced = true
+	return nil
+}
+
+//Next allocates the next nonce, allocation is serialized but the caller sends concurrently.
+//The nonce is only persisted once the caller reports it Sent, or given back with Release or Failed
+func (m *NonceManager) Next(ctx context.Context) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stale && len(m.inFlight) == 0 {
+		if err := m.reset(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if !m.synced {
+		if err := m.sync(ctx, true); err != nil {
+			return 0, err
+		}
+	}
+	nonce := m.next
+	m.next++
+	m.inFlight[nonce] = true
+	return nonce, nil
+}
+
+//Sent persists nonce once the network accepted a transaction with it
+func (m *NonceManager) Sent(ctx context.Context, nonce uint64) error {
+	m.mu.Lock()
+	delete(m.inFlight, nonce)
+	m.mu.Unlock()
+	if m.store == nil {
+		return nil
+	}
+	if err := m.store.SaveNonce(ctx, m.account.Hex(), nonce); err != nil {
+		return fmt.Errorf("unable to persist nonce: %v", err)
+	}
+	return nil
+}
+
+//Release gives back a nonce whose transaction was never sent, it is reused right away if it was the latest one
+//and otherwise once the nonces above it are no longer in flight
+func (m *NonceManager) Release(nonce uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.release(nonce)
+}
+
+//Failed gives back a nonce the node rejected, the next nonce is taken from the chain again once no other is
+//in flight as the node may have kept the transaction after all
+func (m *NonceManager) Failed(nonce uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.release(nonce)
+	m.stale = true
+}
+
+func (m *NonceManager) release(nonce uint64) {
+	delete(m.inFlight, nonce)
+	if m.next == nonce+1 {
+		m.next = nonce
+	} else {
+		m.stale = true
+	}
+}
+
+//Skip gives back a nonce the chain already used and moves past the chain's pending nonce,
+//never back over nonces still in flight
+func (m *NonceManager) Skip(ctx context.Context, nonce uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.inFlight, nonce)
+	pending, err := m.source.PendingNonceAt(ctx, m.account)
+	if err != nil {
+		return fmt.Errorf("unable to get pending nonce: %v", err)
+	}
+	if pending > m.next {
+		m.next = pending
+	}
+	return nil
+}
+
+//isNonceConflict reports whether the node rejected a transaction because its nonce was already used
+func isNonceConflict(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "nonce too low") ||
+		strings.Contains(msg, "replacement transaction underpriced")
+}
+
+//isAlreadyKnown reports whether the node already has the very same transaction, a resend that reached it before
+func isAlreadyKnown(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "already known") || strings.Contains(msg, "known transaction")
+}
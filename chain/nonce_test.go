@@ -0,0 +1,216 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//memNonceStore is a NonceStore for a single account
+type memNonceStore struct {
+	last  uint64
+	saved bool
+}
+
+func (s *memNonceStore) LastNonce(ctx context.Context, account string) (uint64, bool, error) {
+	return s.last, s.saved, nil
+}
+
+func (s *memNonceStore) SaveNonce(ctx context.Context, account string, nonce uint64) error {
+	if !s.saved || nonce > s.last {
+		s.last, s.saved = nonce, true
+	}
+	return nil
+}
+
+func (s *memNonceStore) ResetNonce(ctx context.Context, account string, pending uint64) error {
+	s.last, s.saved = pending-1, pending > 0
+	return nil
+}
+
+type pendingNonce uint64
+
+func (p pendingNonce) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return uint64(p), nil
+}
+
+//fakeChain takes nonces in any order, its pending nonce is the first one it has not seen
+type fakeChain struct {
+	mu   sync.Mutex
+	sent map[uint64]bool
+}
+
+func (c *fakeChain) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pending uint64
+	for c.sent[pending] {
+		pending++
+	}
+	return pending, nil
+}
+
+func (c *fakeChain) send(nonce uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent[nonce] = true
+}
+
+//rejectingBackend answers the next send with err, after handing it to the chain when forward is set
+type rejectingBackend struct {
+	*backends.SimulatedBackend
+	err     error
+	forward bool
+}
+
+func (b *rejectingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	err := b.err
+	if err == nil || b.forward {
+		if serr := b.SimulatedBackend.SendTransaction(ctx, tx); serr != nil {
+			return serr
+		}
+	}
+	b.err = nil
+	return err
+}
+
+func newRejectingTransferer(t *testing.T, err error, forward bool) (*EthTransferer, *backends.SimulatedBackend, *memNonceStore) {
+	simulated, sim := newSimulatedTransferer(t)
+	store := &memNonceStore{}
+	backend := &rejectingBackend{SimulatedBackend: sim, err: err, forward: forward}
+	return NewEthTransferer(backend, simulated.chainID, simulated.signer, testToken, store), sim, store
+}
+
+func TestNextPersistsOnlySentNonces(t *testing.T) {
+	ctx := context.Background()
+	store := &memNonceStore{}
+	nonces := NewNonceManager(common.Address{}, pendingNonce(5), store)
+
+	nonce, err := nonces.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), nonce)
+	assert.False(t, store.saved)
+
+	require.NoError(t, nonces.Sent(ctx, nonce))
+	assert.True(t, store.saved)
+	assert.Equal(t, uint64(5), store.last)
+}
+
+func TestResetResetsStoreFromPendingNonce(t *testing.T) {
+	ctx := context.Background()
+	store := &memNonceStore{last: 9, saved: true}
+	nonces := NewNonceManager(common.Address{}, pendingNonce(3), store)
+
+	nonce, err := nonces.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), nonce)
+
+	require.NoError(t, nonces.Reset(ctx))
+	assert.Equal(t, uint64(2), store.last)
+	nonce, err = nonces.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), nonce)
+
+	// a restart starts from the chain again instead of after the nonces that were never sent
+	nonces = NewNonceManager(common.Address{}, pendingNonce(3), store)
+	nonce, err = nonces.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), nonce)
+
+	require.NoError(t, NewNonceManager(common.Address{}, pendingNonce(0), store).Reset(ctx))
+	assert.False(t, store.saved)
+}
+
+func TestFailedSendKeepsOtherNoncesInFlight(t *testing.T) {
+	ctx := context.Background()
+	chain := &fakeChain{sent: make(map[uint64]bool)}
+	nonces := NewNonceManager(common.Address{}, chain, nil)
+
+	// three sends take their nonces before any reaches the chain, the one with nonce 1 is rejected
+	// and takes another nonce while the others are still in flight
+	var taken, done sync.WaitGroup
+	allocated, retried := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var sent []uint64
+	taken.Add(3)
+	go func() {
+		taken.Wait()
+		close(allocated)
+	}()
+	for i := 0; i < 3; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			nonce, err := nonces.Next(ctx)
+			taken.Done()
+			assert.NoError(t, err)
+			<-allocated
+			if nonce == 1 {
+				nonces.Failed(nonce)
+				nonce, err = nonces.Next(ctx)
+				assert.NoError(t, err)
+				close(retried)
+			} else {
+				<-retried
+			}
+			chain.send(nonce)
+			assert.NoError(t, nonces.Sent(ctx, nonce))
+			mu.Lock()
+			sent = append(sent, nonce)
+			mu.Unlock()
+		}()
+	}
+	done.Wait()
+	sort.Slice(sent, func(i, j int) bool { return sent[i] < sent[j] })
+	assert.Equal(t, []uint64{0, 2, 3}, sent, "no nonce in flight is handed out again")
+
+	// with nothing in flight the gap left by the failed send is filled from the chain
+	nonce, err := nonces.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), nonce)
+}
+
+func TestFailedSendLeavesNonceUnsaved(t *testing.T) {
+	ctx := context.Background()
+	transferer, sim, store := newRejectingTransferer(t, errors.New("insufficient funds for gas * price + value"), false)
+	to := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	_, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(1), nil)
+	require.Error(t, err)
+	assert.False(t, store.saved)
+
+	sent, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(1), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), sent.Nonce, "the nonce of the failed send is used again")
+	assert.True(t, store.saved)
+	assert.Equal(t, uint64(0), store.last)
+	sim.Commit()
+	assert.Equal(t, int64(1), balanceOf(t, transferer, to).Int64())
+}
+
+func TestAlreadyKnownIsSent(t *testing.T) {
+	ctx := context.Background()
+	transferer, sim, store := newRejectingTransferer(t, errors.New("already known"), true)
+	to := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	first, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(1), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), first.Nonce)
+	assert.True(t, store.saved)
+	assert.False(t, isNonceConflict(errors.New("already known")))
+
+	second, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(2), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), second.Nonce)
+	sim.Commit()
+	assert.Equal(t, int64(3), balanceOf(t, transferer, to).Int64())
+}
@@ -0,0 +1,122 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//erc20ABI is the part of the ERC-20 interface used to pay out rewards
+const erc20ABI = `[` +
+	`{"name":"transfer","type":"function","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},` +
+	`{"name":"balanceOf","type":"function","stateMutability":"view","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},` +
+	`{"name":"decimals","type":"function","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]}]`
+
+var tokenABI = mustParseABI(erc20ABI)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+//TokenUnits converts a whole token amount to base units of a token with the given decimals
+func TokenUnits(amount *big.Int, decimals uint8) *big.Int {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	return new(big.Int).Mul(amount, scale)
+}
+
+//ExactUnits converts a decimal token amount to base units of a token with the given decimals,
+//it fails rather than rounds when the amount is finer than a base unit
+func ExactUnits(amount *big.Rat, decimals uint8) (*big.Int, error) {
+	units := new(big.Rat).Mul(amount, new(big.Rat).SetInt(TokenUnits(big.NewInt(1), decimals)))
+	if !units.IsInt() {
+		return nil, fmt.Errorf("%s tokens cannot be expressed in %d decimals", amount.RatString(), decimals)
+	}
+	return new(big.Int).Set(units.Num()), nil
+}
+
+//Decimals reads decimals() from the token contract once and caches it
+func (t *EthTransferer) Decimals(ctx context.Context) (uint8, error) {
+	t.decimalsMu.Lock()
+	defer t.decimalsMu.Unlock()
+	if t.decimals != nil {
+		return *t.decimals, nil
+	}
+	var decimals uint8
+	if err := t.callToken(ctx, &decimals, "decimals"); err != nil {
+		return 0, err
+	}
+	t.decimals = &decimals
+	return decimals, nil
+}
+
+//BalanceReader reads the balances of the wallet paying out rewards
+type BalanceReader interface {
+	//TokenBalance returns the reward token balance of account in base units
+	TokenBalance(ctx context.Context, account string) (*big.Int, error)
+	//NativeBalance returns the balance of account in wei
+	NativeBalance(ctx context.Context, account string) (*big.Int, error)
+}
+
+//Sender is a transferer paying out from a single account
+type Sender interface {
+	//Account returns the address transfers are sent from
+	Account() common.Address
+}
+
+//Account returns the address of the signer transfers are sent from
+func (t *EthTransferer) Account() common.Address {
+	return t.from
+}
+
+//TokenBalance reads balanceOf(account) from the token contract
+func (t *EthTransferer) TokenBalance(ctx context.Context, account string) (*big.Int, error) {
+	if !common.IsHexAddress(account) {
+		return nil, fmt.Errorf("invalid account address %q", account)
+	}
+	var balance *big.Int
+	if err := t.callToken(ctx, &balance, "balanceOf", common.HexToAddress(account)); err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+//NativeBalance reads the ether balance of account at the latest block
+func (t *EthTransferer) NativeBalance(ctx context.Context, account string) (*big.Int, error) {
+	if !common.IsHexAddress(account) {
+		return nil, fmt.Errorf("invalid account address %q", account)
+	}
+	balance, err := t.backend.BalanceAt(ctx, common.HexToAddress(account), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get balance: %v", err)
+	}
+	return balance, nil
+}
+
+//callToken runs a read only method of the token contract and unpacks its single result into out
+func (t *EthTransferer) callToken(ctx context.Context, out interface{}, method string, args ...interface{}) error {
+	data, err := tokenABI.Pack(method, args...)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s: %v", method, err)
+	}
+	res, err := t.backend.CallContract(ctx, ethereum.CallMsg{From: t.from, To: &t.token, Data: data}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to call %s: %v", method, err)
+	}
+	values, err := tokenABI.Unpack(method, res)
+	if err != nil {
+		return fmt.Errorf("unable to decode %s: %v", method, err)
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("unexpected %s result", method)
+	}
+	return tokenABI.Methods[method].Outputs.Copy(out, values)
+}
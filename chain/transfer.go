@@ -0,0 +1,246 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+//TokenTransferer sends ERC-20 reward tokens from the master wallet
+type TokenTransferer interface {
+	//Transfer sends amount token base units to the given address
+	Transfer(ctx context.Context, to string, amount *big.Int, record Record) (SentTx, error)
+	//Decimals returns the decimals of the token, whole tokens are converted with TokenUnits
+	Decimals(ctx context.Context) (uint8, error)
+	//Receipt reports what happened to a previously sent transaction
+	Receipt(ctx context.Context, txHash string) (Receipt, error)
+	//Replace sends the transfer again under the nonce of previous with higher fees, so at most one of the two is mined
+	Replace(ctx context.Context, previous SentTx, to string, amount *big.Int, record Record) (SentTx, error)
+	//NonceUsed reports whether a mined transaction of the sending account used nonce
+	NonceUsed(ctx context.Context, nonce uint64) (bool, error)
+}
+
+//SentTx describes a transaction handed to the network
+type SentTx struct {
+	Hash      string
+	Nonce     uint64
+	Gas       uint64
+	GasFeeCap *big.Int
+	GasTipCap *big.Int
+}
+
+//Record is called with a signed transaction right before it is sent, nothing is sent when it fails.
+//A payout whose nonce turned out to be taken is recorded again with the transaction sent in its place,
+//so once Record was called the transaction may have reached the network even if sending fails
+type Record func(ctx context.Context, tx SentTx) error
+
+const (
+	//TxPending the transaction is known to the node but not mined
+	TxPending = "pending"
+	//TxConfirmed the transaction was mined and succeeded
+	TxConfirmed = "confirmed"
+	//TxReverted the transaction was mined and reverted
+	TxReverted = "reverted"
+	//TxNotFound the node does not know the transaction
+	TxNotFound = "not_found"
+)
+
+//Receipt is the outcome of a sent transaction
+type Receipt struct {
+	Status      string
+	BlockNumber uint64
+	GasUsed     uint64
+}
+
+//Backend is the subset of an ethereum client used to send transfers
+type Backend interface {
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	TransactionByHash(ctx context.Context, txHash common.Hash) (*types.Transaction, bool, error)
+}
+
+//EthTransferer transfers tokens through an ethereum json-rpc backend
+type EthTransferer struct {
+	backend Backend
+	chainID *big.Int
+	signer  Signer
+	from    common.Address
+	token   common.Address
+	nonces  *NonceManager
+	policy  GasPolicy
+
+	decimalsMu sync.Mutex
+	decimals   *uint8
+
+	batchContract common.Address
+	batchABI      *abi.ABI
+}
+
+//NewEthTransferer creates a transferer sending from the signer's account for the token contract at token,
+//nonces are persisted in store when it is not nil
+func NewEthTransferer(backend Backend, chainID *big.Int, signer Signer, token common.Address, store NonceStore) *EthTransferer {
+	from := signer.Address()
+	return &EthTransferer{
+		backend: backend,
+		chainID: chainID,
+		signer:  signer,
+		from:    from,
+		token:   token,
+		nonces:  NewNonceManager(from, backend, store),
+	}
+}
+
+//DialEthTransferer connects to rpcURL and syncs the master wallet nonce, when chainID is 0 it is read from the node
+func DialEthTransferer(ctx context.Context, rpcURL string, chainID int64, signer Signer, tokenAddress string, store NonceStore) (*EthTransferer, error) {
+	if !common.IsHexAddress(tokenAddress) {
+		return nil, fmt.Errorf("invalid token contract address %q", tokenAddress)
+	}
+	client, err := ethclient.DialContext(ctx, rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial %s: %v", rpcURL, err)
+	}
+	id := big.NewInt(chainID)
+	if chainID == 0 {
+		if id, err = client.ChainID(ctx); err != nil {
+			return nil, fmt.Errorf("unable to read chain id: %v", err)
+		}
+	}
+	t := NewEthTransferer(client, id, signer, common.HexToAddress(tokenAddress), store)
+	if err = t.nonces.Sync(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//SetGasPolicy bounds the fees of every transaction sent from now on
+func (t *EthTransferer) SetGasPolicy(policy GasPolicy) {
+	t.policy = policy
+}
+
+//Transfer sends an ERC-20 transfer(address,uint256) transaction for amount base units
+func (t *EthTransferer) Transfer(ctx context.Context, to string, amount *big.Int, record Record) (SentTx, error) {
+	data, gasLimit, err := t.transferCall(ctx, to, amount)
+	if err != nil {
+		return SentTx{}, err
+	}
+	return t.sendDynamic(ctx, t.token, data, gasLimit, 1, record)
+}
+
+//Replace sends the transfer again under the nonce of previous, paying more than previous did
+func (t *EthTransferer) Replace(ctx context.Context, previous SentTx, to string, amount *big.Int, record Record) (SentTx, error) {
+	data, gasLimit, err := t.transferCall(ctx, to, amount)
+	if err != nil {
+		return SentTx{}, err
+	}
+	return t.replaceDynamic(ctx, previous, t.token, data, gasLimit, 1, record)
+}
+
+//transferCall encodes the transfer of amount to to and estimates its gas
+func (t *EthTransferer) transferCall(ctx context.Context, to string, amount *big.Int) ([]byte, uint64, error) {
+	if !common.IsHexAddress(to) {
+		return nil, 0, fmt.Errorf("invalid recipient address %q", to)
+	}
+	if amount == nil || amount.Sign() <= 0 {
+		return nil, 0, fmt.Errorf("invalid token amount %v", amount)
+	}
+	data, err := tokenABI.Pack("transfer", common.HexToAddress(to), amount)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to encode transfer: %v", err)
+	}
+	gasLimit, err := t.backend.EstimateGas(ctx, ethereum.CallMsg{
+		From: t.from,
+		To:   &t.token,
+		Data: data,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to estimate gas: %v", err)
+	}
+	return data, gasLimit, nil
+}
+
+//NonceUsed reports whether the latest block includes a transaction of the master wallet with nonce
+func (t *EthTransferer) NonceUsed(ctx context.Context, nonce uint64) (bool, error) {
+	mined, err := t.backend.NonceAt(ctx, t.from, nil)
+	if err != nil {
+		return false, fmt.Errorf("unable to get nonce: %v", err)
+	}
+	return mined > nonce, nil
+}
+
+//send signs, records and sends the transaction built for the next nonce, resyncing once if the nonce was already used
+func (t *EthTransferer) send(ctx context.Context, build func(nonce uint64) *types.Transaction, record Record) (*types.Transaction, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := t.nonces.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		signedTx, err := t.signer.SignTx(ctx, build(nonce), t.chainID)
+		if err != nil {
+			t.nonces.Release(nonce)
+			return nil, fmt.Errorf("unable to sign transaction: %v", err)
+		}
+		if record != nil {
+			if err = record(ctx, sentTx(signedTx)); err != nil {
+				t.nonces.Release(nonce)
+				return nil, fmt.Errorf("unable to record transaction: %v", err)
+			}
+		}
+		err = t.backend.SendTransaction(ctx, signedTx)
+		if err == nil || isAlreadyKnown(err) {
+			// a nonce that failed to persist is covered by the next one saved, the manager keeps it in memory
+			_ = t.nonces.Sent(ctx, nonce)
+			return signedTx, nil
+		}
+		if !isNonceConflict(err) || attempt > 0 {
+			// nonces allocated after this one are still being sent, it is only taken back once they are done
+			t.nonces.Failed(nonce)
+			return nil, fmt.Errorf("unable to send transaction: %v", err)
+		}
+		if err = t.nonces.Skip(ctx, nonce); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//Receipt looks up the receipt of txHash, falling back to the mempool when it is not mined yet
+func (t *EthTransferer) Receipt(ctx context.Context, txHash string) (Receipt, error) {
+	hash := common.HexToHash(txHash)
+	receipt, err := t.backend.TransactionReceipt(ctx, hash)
+	if err == nil {
+		status := TxConfirmed
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			status = TxReverted
+		}
+		var block uint64
+		if receipt.BlockNumber != nil {
+			block = receipt.BlockNumber.Uint64()
+		}
+		return Receipt{Status: status, BlockNumber: block, GasUsed: receipt.GasUsed}, nil
+	}
+	if !errors.Is(err, ethereum.NotFound) {
+		return Receipt{}, fmt.Errorf("unable to get receipt: %v", err)
+	}
+	_, _, err = t.backend.TransactionByHash(ctx, hash)
+	if errors.Is(err, ethereum.NotFound) {
+		return Receipt{Status: TxNotFound}, nil
+	}
+	if err != nil {
+		return Receipt{}, fmt.Errorf("unable to get transaction: %v", err)
+	}
+	return Receipt{Status: TxPending}, nil
+}
@@ -0,0 +1,298 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDecimals = 6
+
+var testToken = common.HexToAddress("0x00000000000000000000000000000000000070c3")
+
+//assembler builds EVM bytecode with PUSH1 jump labels, enough for the test token
+type assembler struct {
+	code   []byte
+	labels map[string]byte
+	refs   map[int]string
+}
+
+func (a *assembler) op(ops ...vm.OpCode) {
+	for _, op := range ops {
+		a.code = append(a.code, byte(op))
+	}
+}
+
+func (a *assembler) push(data ...byte) {
+	a.code = append(a.code, byte(vm.PUSH1)+byte(len(data)-1))
+	a.code = append(a.code, data...)
+}
+
+func (a *assembler) pushLabel(name string) {
+	a.code = append(a.code, byte(vm.PUSH1), 0)
+	a.refs[len(a.code)-1] = name
+}
+
+func (a *assembler) label(name string) {
+	a.labels[name] = byte(len(a.code))
+	a.op(vm.JUMPDEST)
+}
+
+func (a *assembler) bytes() []byte {
+	for pos, name := range a.refs {
+		a.code[pos] = a.labels[name]
+	}
+	return a.code
+}
+
+//tokenCode is the runtime code of a minimal ERC-20: decimals() returns testDecimals,
+//transfer credits the recipient without debiting the sender and balanceOf reads the credit
+func tokenCode() []byte {
+	a := &assembler{labels: make(map[string]byte), refs: make(map[int]string)}
+	a.push(0)
+	a.op(vm.CALLDATALOAD)
+	a.push(0xe0)
+	a.op(vm.SHR)
+	for _, method := range []string{"decimals", "transfer", "balanceOf"} {
+		a.op(vm.DUP1)
+		a.push(tokenABI.Methods[method].ID...)
+		a.op(vm.EQ)
+		a.pushLabel(method)
+		a.op(vm.JUMPI)
+	}
+	a.push(0)
+	a.op(vm.DUP1, vm.REVERT)
+
+	a.label("decimals")
+	a.push(testDecimals)
+	a.push(0)
+	a.op(vm.MSTORE)
+	a.push(32)
+	a.push(0)
+	a.op(vm.RETURN)
+
+	a.label("transfer")
+	a.push(0x24)
+	a.op(vm.CALLDATALOAD)
+	a.push(0x04)
+	a.op(vm.CALLDATALOAD, vm.DUP1, vm.SLOAD, vm.DUP3, vm.ADD, vm.SWAP1, vm.SSTORE)
+	a.push(1)
+	a.push(0)
+	a.op(vm.MSTORE)
+	a.push(32)
+	a.push(0)
+	a.op(vm.RETURN)
+
+	a.label("balanceOf")
+	a.push(0x04)
+	a.op(vm.CALLDATALOAD, vm.SLOAD)
+	a.push(0)
+	a.op(vm.MSTORE)
+	a.push(32)
+	a.push(0)
+	a.op(vm.RETURN)
+	return a.bytes()
+}
+
+func newSimulatedTransferer(t *testing.T) (*EthTransferer, *backends.SimulatedBackend) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer, err := NewKeySigner(hexutil.Encode(crypto.FromECDSA(key)))
+	require.NoError(t, err)
+
+	funds := new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18))
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		signer.Address(): {Balance: funds},
+		testToken:        {Code: tokenCode()},
+	}, 10_000_000)
+	t.Cleanup(func() { sim.Close() })
+
+	chainID := sim.Blockchain().Config().ChainID
+	return NewEthTransferer(sim, chainID, signer, testToken, nil), sim
+}
+
+func balanceOf(t *testing.T, transferer *EthTransferer, account common.Address) *big.Int {
+	balance, err := transferer.TokenBalance(context.Background(), account.Hex())
+	require.NoError(t, err)
+	return balance
+}
+
+func TestTokenUnits(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		decimals uint8
+		want     string
+	}{
+		{1, 0, "1"},
+		{1, 6, "1000000"},
+		{25, 18, "25000000000000000000"},
+		{127 * 127, 18, "16129000000000000000000"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, TokenUnits(big.NewInt(tt.amount), tt.decimals).String())
+	}
+}
+
+func TestExactUnits(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals uint8
+		want     string
+	}{
+		{"2.5", 0, ""},
+		{"2.5", 1, "25"},
+		{"0.000001", 6, "1"},
+		{"0.0000001", 6, ""},
+		{"16129", 18, "16129000000000000000000"},
+	}
+	for _, tt := range tests {
+		amount, _ := new(big.Rat).SetString(tt.amount)
+		units, err := ExactUnits(amount, tt.decimals)
+		if tt.want == "" {
+			assert.Error(t, err, tt.amount)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, units.String())
+	}
+}
+
+func TestDecimalsReadsTokenContract(t *testing.T) {
+	transferer, _ := newSimulatedTransferer(t)
+
+	decimals, err := transferer.Decimals(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint8(testDecimals), decimals)
+}
+
+func TestNativeBalance(t *testing.T) {
+	transferer, _ := newSimulatedTransferer(t)
+
+	balance, err := transferer.NativeBalance(context.Background(), transferer.from.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "100000000000000000000", balance.String())
+}
+
+func TestAccountIsSignerAddress(t *testing.T) {
+	transferer, _ := newSimulatedTransferer(t)
+
+	var sender Sender = transferer
+	assert.Equal(t, transferer.signer.Address(), sender.Account())
+}
+
+func TestTransferPaysBaseUnits(t *testing.T) {
+	ctx := context.Background()
+	transferer, sim := newSimulatedTransferer(t)
+	to := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	// more than fits in an int64 once scaled
+	amount := TokenUnits(big.NewInt(20_000_000_000_000), testDecimals)
+	sent, err := transferer.Transfer(ctx, to.Hex(), amount, nil)
+	require.NoError(t, err)
+	sim.Commit()
+
+	receipt, err := transferer.Receipt(ctx, sent.Hash)
+	require.NoError(t, err)
+	// a gas limit estimated against the recipient instead of the token runs out of gas
+	assert.Equal(t, TxConfirmed, receipt.Status)
+	assert.Equal(t, 0, amount.Cmp(balanceOf(t, transferer, to)))
+	assert.Greater(t, sent.Gas, uint64(21000))
+	assert.NotNil(t, sent.GasFeeCap)
+	assert.NotNil(t, sent.GasTipCap)
+}
+
+func TestTransferUsesConsecutiveNonces(t *testing.T) {
+	ctx := context.Background()
+	transferer, sim := newSimulatedTransferer(t)
+	to := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	first, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(1), nil)
+	require.NoError(t, err)
+	second, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(2), nil)
+	require.NoError(t, err)
+	sim.Commit()
+
+	assert.Equal(t, first.Nonce+1, second.Nonce)
+	assert.Equal(t, int64(3), balanceOf(t, transferer, to).Int64())
+}
+
+func TestTransferRejectsInvalidInput(t *testing.T) {
+	ctx := context.Background()
+	transferer, _ := newSimulatedTransferer(t)
+
+	_, err := transferer.Transfer(ctx, "not an address", big.NewInt(1), nil)
+	assert.Error(t, err)
+	_, err = transferer.Transfer(ctx, testToken.Hex(), big.NewInt(0), nil)
+	assert.Error(t, err)
+	_, err = transferer.Transfer(ctx, testToken.Hex(), nil, nil)
+	assert.Error(t, err)
+}
+
+func TestTransferRefusesFeesAbovePolicy(t *testing.T) {
+	ctx := context.Background()
+	to := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	transferer, _ := newSimulatedTransferer(t)
+	transferer.SetGasPolicy(GasPolicy{MaxFeePerGas: big.NewInt(1)})
+	_, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(1), nil)
+	assert.True(t, errors.Is(err, ErrFeesAboveCap), "got %v", err)
+
+	transferer, _ = newSimulatedTransferer(t)
+	transferer.SetGasPolicy(GasPolicy{MaxGasCostPerClaim: big.NewInt(1)})
+	_, err = transferer.Transfer(ctx, to.Hex(), big.NewInt(1), nil)
+	assert.True(t, errors.Is(err, ErrFeesAboveCap), "got %v", err)
+}
+
+//droppingBackend loses the next drop transactions sent, like a node that evicts them from its mempool
+type droppingBackend struct {
+	*backends.SimulatedBackend
+	drop int
+}
+
+func (b *droppingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if b.drop > 0 {
+		b.drop--
+		return nil
+	}
+	return b.SimulatedBackend.SendTransaction(ctx, tx)
+}
+
+func TestReplaceSendsUnderTheSameNonce(t *testing.T) {
+	ctx := context.Background()
+	simulated, sim := newSimulatedTransferer(t)
+	transferer := NewEthTransferer(&droppingBackend{SimulatedBackend: sim, drop: 1}, simulated.chainID, simulated.signer,
+		testToken, nil)
+	to := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	first, err := transferer.Transfer(ctx, to.Hex(), big.NewInt(5), nil)
+	require.NoError(t, err)
+	receipt, err := transferer.Receipt(ctx, first.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, TxNotFound, receipt.Status)
+
+	second, err := transferer.Replace(ctx, first, to.Hex(), big.NewInt(5), nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Nonce, second.Nonce)
+	assert.Greater(t, second.GasTipCap.Cmp(first.GasTipCap), 0)
+	assert.Greater(t, second.GasFeeCap.Cmp(first.GasFeeCap), 0)
+	used, err := transferer.NonceUsed(ctx, first.Nonce)
+	require.NoError(t, err)
+	assert.False(t, used)
+	sim.Commit()
+
+	used, err = transferer.NonceUsed(ctx, first.Nonce)
+	require.NoError(t, err)
+	assert.True(t, used)
+	assert.Equal(t, int64(5), balanceOf(t, transferer, to).Int64())
+}
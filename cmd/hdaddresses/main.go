@@ -0,0 +1,39 @@
+//Command hdaddresses derives user wallet addresses offline from a hex HD wallet seed read
+//from stdin, it needs neither the database nor the key vault
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Godtide/rating/hdwallet"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/gommon/log"
+)
+
+func main() {
+	from := flag.Uint("from", 0, "first wallet index")
+	count := flag.Uint("count", 10, "number of wallets")
+	flag.Parse()
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Unable to read the seed : %v", err)
+	}
+	seed, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(line), "0x"))
+	if err != nil {
+		log.Fatalf("Seed is not hex : %v", err)
+	}
+	for i := uint32(*from); i < uint32(*from+*count); i++ {
+		key, err := hdwallet.DeriveUserKey(seed, i)
+		if err != nil {
+			fmt.Printf("%s\t%v\n", hdwallet.UserPath(i), err)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", hdwallet.UserPath(i), crypto.PubkeyToAddress(key.PublicKey).Hex())
+	}
+}
@@ -0,0 +1,37 @@
+//Command migrate applies the pending schema migrations of the SQL storage selected by STORAGE_DRIVER,
+//the service applies them on start as well, this lets them run ahead of a deploy
+package main
+
+import (
+	"context"
+
+	"github.com/Godtide/rating/config"
+	"github.com/Godtide/rating/sqlstore"
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/labstack/gommon/log"
+)
+
+func main() {
+	var cfg config.Properties
+	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		log.Fatalf("Configuration cannot be read : %v", err)
+	}
+	dsn := cfg.PostgresURL
+	switch cfg.StorageDriver {
+	case sqlstore.Postgres:
+	case sqlstore.SQLite:
+		dsn = cfg.SQLitePath
+	default:
+		log.Fatalf("STORAGE_DRIVER %q has no SQL schema to migrate", cfg.StorageDriver)
+	}
+	db, err := sqlstore.Open(cfg.StorageDriver, dsn)
+	if err != nil {
+		log.Fatalf("Unable to open the database : %v", err)
+	}
+	defer db.Close()
+	applied, err := db.Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to migrate : %v", err)
+	}
+	log.Infof("Applied %d migrations", applied)
+}
@@ -0,0 +1,81 @@
+//Command provisionwallets creates a custodial wallet for every user that has none, such users
+//were left behind when a signup failed after storing the user
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/Godtide/rating/config"
+	"github.com/Godtide/rating/handlers"
+	"github.com/Godtide/rating/keyvault"
+	"github.com/Godtide/rating/sqlstore"
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func main() {
+	var (
+		cfg     config.Properties
+		users   handlers.UserRepo
+		wallets handlers.WalletRepo
+	)
+	dryRun := flag.Bool("dry-run", false, "only report users without a wallet")
+	flag.Parse()
+	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		log.Fatalf("Configuration cannot be read : %v", err)
+	}
+	if cfg.KeyVaultBackend != "local" {
+		log.Fatalf("provisionwallets only supports the local key vault")
+	}
+	wrapper, err := keyvault.LoadLocalKeyWrapper(cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Unable to load the master key : %v", err)
+	}
+	ctx := context.Background()
+	// the HD wallet counter stays in mongo whatever the storage driver
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)))
+	if err != nil {
+		log.Fatalf("Unable to connect to database : %v", err)
+	}
+	defer c.Disconnect(ctx)
+	db := c.Database(cfg.DBName)
+	vault := keyvault.NewEnvelopeVault(wrapper)
+
+	switch cfg.StorageDriver {
+	case "mongo":
+		users = &handlers.MongoUserRepo{Col: db.Collection(cfg.UsersCollection)}
+		wallets = &handlers.MongoWalletRepo{Col: db.Collection(cfg.WalletCollection)}
+	case sqlstore.Postgres, sqlstore.SQLite:
+		dsn := cfg.PostgresURL
+		if cfg.StorageDriver == sqlstore.SQLite {
+			dsn = cfg.SQLitePath
+		}
+		sqlDB, err := sqlstore.Open(cfg.StorageDriver, dsn)
+		if err != nil {
+			log.Fatalf("Unable to open the database : %v", err)
+		}
+		defer sqlDB.Close()
+		users = &sqlstore.UserRepo{DB: sqlDB}
+		wallets = &sqlstore.WalletRepo{DB: sqlDB}
+	default:
+		log.Fatalf("Unknown storage driver %q", cfg.StorageDriver)
+	}
+
+	var generator handlers.WalletGenerator = handlers.RandomWalletGenerator{}
+	if cfg.WalletSeedSealed != "" {
+		generator = &handlers.HDWalletGenerator{
+			Vault:      vault,
+			SealedSeed: cfg.WalletSeedSealed,
+			CounterCol: db.Collection(cfg.CounterCollection),
+		}
+	}
+	report, err := handlers.ProvisionWallets(ctx, users, wallets, generator, vault, *dryRun)
+	if err != nil {
+		log.Fatalf("Unable to provision wallets : %v", err)
+	}
+	fmt.Printf("checked %d users, %d without a wallet, %d provisioned\n", report.Checked, report.Missing, report.Provisioned)
+}
@@ -0,0 +1,55 @@
+//Command repairwallets regenerates user wallets whose stored key is missing, unsealed or
+//does not derive the wallet address
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/Godtide/rating/config"
+	"github.com/Godtide/rating/handlers"
+	"github.com/Godtide/rating/keyvault"
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func main() {
+	var cfg config.Properties
+	dryRun := flag.Bool("dry-run", false, "only report broken wallets")
+	flag.Parse()
+	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		log.Fatalf("Configuration cannot be read : %v", err)
+	}
+	if cfg.KeyVaultBackend != "local" {
+		log.Fatalf("repairwallets only supports the local key vault")
+	}
+	wrapper, err := keyvault.LoadLocalKeyWrapper(cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Unable to load the master key : %v", err)
+	}
+	ctx := context.Background()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)))
+	if err != nil {
+		log.Fatalf("Unable to connect to database : %v", err)
+	}
+	defer c.Disconnect(ctx)
+	db := c.Database(cfg.DBName)
+	vault := keyvault.NewEnvelopeVault(wrapper)
+
+	var generator handlers.WalletGenerator = handlers.RandomWalletGenerator{}
+	if cfg.WalletSeedSealed != "" {
+		generator = &handlers.HDWalletGenerator{
+			Vault:      vault,
+			SealedSeed: cfg.WalletSeedSealed,
+			CounterCol: db.Collection(cfg.CounterCollection),
+		}
+	}
+	report, err := handlers.RepairWallets(ctx, generator, vault, db.Collection(cfg.WalletCollection), *dryRun)
+	if err != nil {
+		log.Fatalf("Unable to repair wallets : %v", err)
+	}
+	fmt.Printf("checked %d wallets, %d broken, %d regenerated\n", report.Checked, report.Broken, report.Regenerated)
+}
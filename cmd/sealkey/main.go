@@ -0,0 +1,92 @@
+//Command sealkey seals secrets with the configured key vault. By default it reads a hex private
+//key from stdin for MASTER_SEALED_KEY; -seed reads a hex HD wallet seed and -new-seed generates
+//one for WALLET_SEED_SEALED, printing the plain seed to stderr for offline backup.
+//-new-master-key creates the MASTER_KEY_FILE of the local key vault, it refuses to replace one.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Godtide/rating/config"
+	"github.com/Godtide/rating/hdwallet"
+	"github.com/Godtide/rating/keyvault"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/labstack/gommon/log"
+)
+
+func readHex() []byte {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Unable to read stdin : %v", err)
+	}
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(line), "0x"))
+	if err != nil {
+		log.Fatalf("Input is not hex : %v", err)
+	}
+	return raw
+}
+
+func main() {
+	var (
+		cfg    config.Properties
+		secret []byte
+	)
+	seed := flag.Bool("seed", false, "seal a hex HD wallet seed instead of a private key")
+	newSeed := flag.Bool("new-seed", false, "generate and seal a new HD wallet seed")
+	newMasterKey := flag.Bool("new-master-key", false, "generate the master key file of the local key vault")
+	flag.Parse()
+	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		log.Fatalf("Configuration cannot be read : %v", err)
+	}
+	if cfg.KeyVaultBackend != "local" {
+		log.Fatalf("sealkey only supports the local key vault")
+	}
+	if *newMasterKey {
+		wrapper, err := keyvault.GenerateLocalMasterKey(cfg.MasterKeyFile)
+		if err != nil {
+			log.Fatalf("Unable to generate the master key : %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "master key %s written to %s (back it up, sealed values cannot be opened without it)\n",
+			wrapper.KeyID(), cfg.MasterKeyFile)
+		return
+	}
+	wrapper, err := keyvault.LoadLocalKeyWrapper(cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Unable to load the master key : %v", err)
+	}
+
+	switch {
+	case *newSeed:
+		secret = make([]byte, hdwallet.MaxSeedLen)
+		if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+			log.Fatalf("Unable to generate a seed : %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "seed (back this up offline): %s\n", hex.EncodeToString(secret))
+	case *seed:
+		secret = readHex()
+		if len(secret) < hdwallet.MinSeedLen || len(secret) > hdwallet.MaxSeedLen {
+			log.Fatalf("Seed must be between %d and %d bytes", hdwallet.MinSeedLen, hdwallet.MaxSeedLen)
+		}
+	default:
+		secret = readHex()
+		key, err := crypto.ToECDSA(secret)
+		if err != nil {
+			log.Fatalf("Invalid private key : %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "sealed key for %s\n", crypto.PubkeyToAddress(key.PublicKey).Hex())
+	}
+	sealed, err := keyvault.NewEnvelopeVault(wrapper).Encrypt(context.Background(), secret)
+	if err != nil {
+		log.Fatalf("Unable to seal : %v", err)
+	}
+	fmt.Println(sealed)
+}
@@ -1,5 +1,10 @@
 package config
 
+import "fmt"
+
+//MinJwtSecretLength is the shortest JWT_TOKEN_SECRET the service starts with
+const MinJwtSecretLength = 32
+
 //Properties Configuration properties based on env variables.
 type Properties struct {
 	Port                  string `env:"MY_APP_PORT" env-default:"8080"`
@@ -11,8 +16,55 @@ type Properties struct {
 	UsersRewardCollection string `env:"USERS_REWARD_COL_NAME" env-default:"users_reward"`
 	RewardCollection      string `env:"REWARD_COL_NAME" env-default:"reward"`
 	WalletCollection      string `env:"USERS_COL_NAME" env-default:"wallet"`
-	MasterPrivateKey      string `env:"MASTER_PRIVATE_KEY" env-default:""`
+	IdempotencyCollection string `env:"IDEMPOTENCY_COL_NAME" env-default:"idempotency_keys"`
+	TransactionCollection string `env:"TRANSACTION_COL_NAME" env-default:"transactions"`
+	CounterCollection     string `env:"COUNTER_COL_NAME" env-default:"counters"`
+	ChallengeCollection   string `env:"CHALLENGE_COL_NAME" env-default:"wallet_challenges"`
+	RatingCollection      string `env:"RATING_COL_NAME" env-default:"ratings"`
+	ScoreCollection       string `env:"SCORE_COL_NAME" env-default:"rating_scores"`
+	RatingRuleCollection  string `env:"RATING_RULE_COL_NAME" env-default:"rating_rules"`
+	StorageDriver         string `env:"STORAGE_DRIVER" env-default:"mongo"`                                          //mongo, postgres, sqlite, stores users, rewards, user rewards, wallets and ratings, the payout ledger stays in Mongo
+	PostgresURL           string `env:"POSTGRES_URL" env-default:"postgres://localhost:5432/rating?sslmode=disable"` //STORAGE_DRIVER=postgres
+	SQLitePath            string `env:"SQLITE_PATH" env-default:"rating.db"`                                         //STORAGE_DRIVER=sqlite, local runs only
+	MasterPrivateKey      string `env:"MASTER_PRIVATE_KEY" env-default:""`                                           //plain hex, dev only
+	MasterSealedKey       string `env:"MASTER_SEALED_KEY" env-default:""`                                            //master private key sealed by the key vault, see cmd/sealkey
+	KeyVaultBackend       string `env:"KEY_VAULT" env-default:"local"`                                               //local
+	MasterKeyFile         string `env:"MASTER_KEY_FILE" env-default:"master.key"`                                    //local key vault master key, see cmd/sealkey -new-master-key
+	WalletSeedSealed      string `env:"WALLET_SEED_SEALED" env-default:""`                                           //HD seed for user wallets sealed by the key vault, see cmd/sealkey
 	MasterPublicKey       string `env:"MASTER_PUBLIC_KEY" env-default:""`
 	ApiKey                string `env:"ApiKey" env-default:"07f0dfde071243bdbc4c3a53562536cf"`
 	ContractAdrress       string `env:"ContractAddress" env-default:"0xB318E25681c0B51DfFA80535Ea49b340c72cC40e"`
+	TransferBackend       string `env:"TRANSFER_BACKEND" env-default:"eth"`                       //eth, fake
+	RPCURL                string `env:"RPC_URL" env-default:""`                                   //defaults to infura optimism mainnet with ApiKey
+	ChainID               int64  `env:"CHAIN_ID" env-default:"0"`                                 //0 reads the chain id from the node
+	GasMaxFeeWei          string `env:"GAS_MAX_FEE_WEI" env-default:"1000000000"`                 //EIP-1559 max fee per gas, empty disables
+	GasMaxPriorityFeeWei  string `env:"GAS_MAX_PRIORITY_FEE_WEI" env-default:"100000000"`         //EIP-1559 max priority fee per gas, empty disables
+	GasMaxCostPerClaimWei string `env:"GAS_MAX_COST_PER_CLAIM_WEI" env-default:"200000000000000"` //gas budget per paid out claim, empty disables
+	AdminEmail            string `env:"ADMIN_EMAIL" env-default:""`
+	AdminPassword         string `env:"ADMIN_PASSWORD" env-default:""`
+	ExpiryJobSchedule     string `env:"EXPIRY_JOB_SCHEDULE" env-default:"@every 5m"`
+	TxWatchSchedule       string `env:"TX_WATCH_SCHEDULE" env-default:"@every 15s"`
+	TxMaxAttempts         int    `env:"TX_MAX_ATTEMPTS" env-default:"3"`
+	TxDropAfterMinutes    int    `env:"TX_DROP_AFTER_MINUTES" env-default:"30"`
+	BatchPayouts          bool   `env:"BATCH_PAYOUTS" env-default:"false"`
+	BatchContract         string `env:"BATCH_CONTRACT_ADDRESS" env-default:""` //Disperse contract, approved to spend the reward token
+	BatchMaxSize          int    `env:"BATCH_MAX_SIZE" env-default:"50"`
+	BatchMaxWaitSeconds   int    `env:"BATCH_MAX_WAIT_SECONDS" env-default:"300"`
+	TreasurySchedule      string `env:"TREASURY_SCHEDULE" env-default:"@every 1m"`
+	TreasuryMinTokens     string `env:"TREASURY_MIN_TOKENS" env-default:"1000"`                 //whole tokens, claims are held below it
+	TreasuryMinNativeWei  string `env:"TREASURY_MIN_NATIVE_WEI" env-default:"1000000000000000"` //gas money, claims are held below it
+}
+
+//TokenProperties configure the access tokens signed by the API server, the command line tools do not read them
+type TokenProperties struct {
+	JwtTokenSecret string `env:"JWT_TOKEN_SECRET" env-required:"true"` //HMAC key of the access tokens, MinJwtSecretLength bytes or more
+	JwtTokenTTL    int    `env:"JWT_TOKEN_TTL_MINUTES" env-default:"15"`
+}
+
+//CheckJwtSecret fails on a JWT_TOKEN_SECRET too short to sign access tokens with
+func (p TokenProperties) CheckJwtSecret() error {
+	if len(p.JwtTokenSecret) < MinJwtSecretLength {
+		return fmt.Errorf("JWT_TOKEN_SECRET must be at least %d bytes, got %d", MinJwtSecretLength, len(p.JwtTokenSecret))
+	}
+	return nil
 }
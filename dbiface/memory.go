@@ -0,0 +1,627 @@
+package dbiface
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//MemoryCollection is a CollectionAPI kept in memory for tests and offline development.
+//It understands equality filters, the $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin and $exists operators,
+//the $set, $unset, $setOnInsert, $inc, $max, $min and $push updates, sorting, limits and upserts
+type MemoryCollection struct {
+	mu     sync.Mutex
+	docs   []bson.M
+	unique []string
+}
+
+var _ CollectionAPI = (*MemoryCollection)(nil)
+
+//NewMemoryCollection creates an empty collection, values of the unique fields must not repeat
+//across documents that have them, like a sparse unique index
+func NewMemoryCollection(unique ...string) *MemoryCollection {
+	return &MemoryCollection{unique: unique}
+}
+
+//InsertOne stores a copy of document, generating an ObjectID when it has no _id
+func (m *MemoryCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := toDoc(document)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err = m.checkUnique(doc, -1); err != nil {
+		return nil, err
+	}
+	m.docs = append(m.docs, doc)
+	return &mongo.InsertOneResult{InsertedID: doc["_id"]}, nil
+}
+
+//CountDocuments counts the documents matching filter
+func (m *MemoryCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	matched, err := m.match(filter)
+	return int64(len(matched)), err
+}
+
+//Find returns a cursor over the matching documents
+func (m *MemoryCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	o := options.MergeFindOptions(opts...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	matched, err := m.match(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.sort(matched, o.Sort); err != nil {
+		return nil, err
+	}
+	if o.Skip != nil {
+		if int(*o.Skip) >= len(matched) {
+			matched = nil
+		} else {
+			matched = matched[*o.Skip:]
+		}
+	}
+	if o.Limit != nil && *o.Limit > 0 && int(*o.Limit) < len(matched) {
+		matched = matched[:*o.Limit]
+	}
+	docs := make([]interface{}, len(matched))
+	for i, idx := range matched {
+		docs[i] = m.docs[idx]
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+//FindOne returns the first matching document
+func (m *MemoryCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	o := options.MergeFindOneOptions(opts...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, err := m.first(filter, o.Sort)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	return singleResult(m.docs[idx], nil)
+}
+
+//FindOneAndDelete removes the first matching document and returns it
+func (m *MemoryCollection) FindOneAndDelete(ctx context.Context, filter interface{}, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndDeleteOptions(opts...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, err := m.first(filter, o.Sort)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	doc := m.docs[idx]
+	m.docs = append(m.docs[:idx], m.docs[idx+1:]...)
+	return singleResult(doc, nil)
+}
+
+//FindOneAndUpdate updates the first matching document and returns it as it was before, or after when asked to
+func (m *MemoryCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	after := o.ReturnDocument != nil && *o.ReturnDocument == options.After
+	upsert := o.Upsert != nil && *o.Upsert
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, err := m.first(filter, o.Sort)
+	if err == mongo.ErrNoDocuments && upsert {
+		doc, err := m.upsert(filter, update)
+		if err != nil {
+			return singleResult(nil, err)
+		}
+		if !after {
+			return singleResult(nil, mongo.ErrNoDocuments)
+		}
+		return singleResult(doc, nil)
+	}
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	before := m.docs[idx]
+	if _, err = m.apply(idx, update, false); err != nil {
+		return singleResult(nil, err)
+	}
+	if after {
+		return singleResult(m.docs[idx], nil)
+	}
+	return singleResult(before, nil)
+}
+
+//UpdateOne updates the first matching document
+func (m *MemoryCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return m.update(filter, update, false, opts...)
+}
+
+//UpdateMany updates every matching document
+func (m *MemoryCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return m.update(filter, update, true, opts...)
+}
+
+//DeleteOne removes the first matching document
+func (m *MemoryCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, err := m.first(filter, nil)
+	if err == mongo.ErrNoDocuments {
+		return &mongo.DeleteResult{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.docs = append(m.docs[:idx], m.docs[idx+1:]...)
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
+}
+
+func (m *MemoryCollection) update(filter interface{}, update interface{}, many bool, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	o := options.MergeUpdateOptions(opts...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	matched, err := m.match(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		if o.Upsert == nil || !*o.Upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		doc, err := m.upsert(filter, update)
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: doc["_id"]}, nil
+	}
+	if !many {
+		matched = matched[:1]
+	}
+	res := &mongo.UpdateResult{MatchedCount: int64(len(matched))}
+	for _, idx := range matched {
+		modified, err := m.apply(idx, update, false)
+		if err != nil {
+			return res, err
+		}
+		if modified {
+			res.ModifiedCount++
+		}
+	}
+	return res, nil
+}
+
+//upsert inserts a document built from the equality conditions of filter and update
+func (m *MemoryCollection) upsert(filter interface{}, update interface{}) (bson.M, error) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	for k, cond := range f {
+		if strings.HasPrefix(k, "$") || isOperatorDoc(cond) {
+			continue
+		}
+		doc[k] = cond
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	m.docs = append(m.docs, doc)
+	if _, err = m.apply(len(m.docs)-1, update, true); err != nil {
+		m.docs = m.docs[:len(m.docs)-1]
+		return nil, err
+	}
+	return m.docs[len(m.docs)-1], nil
+}
+
+//apply runs the update operators on the document at idx, documents are replaced and never mutated
+//so results handed out earlier stay as they were
+func (m *MemoryCollection) apply(idx int, update interface{}, inserting bool) (bool, error) {
+	u, err := toDoc(update)
+	if err != nil {
+		return false, err
+	}
+	doc := copyDoc(m.docs[idx])
+	for op, arg := range u {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("memory collection: %s needs a document", op)
+		}
+		for k, v := range fields {
+			switch op {
+			case "$set":
+				doc[k] = v
+			case "$setOnInsert":
+				if inserting {
+					doc[k] = v
+				}
+			case "$unset":
+				delete(doc, k)
+			case "$inc":
+				sum, err := add(doc[k], v)
+				if err != nil {
+					return false, err
+				}
+				doc[k] = sum
+			case "$max", "$min":
+				old, ok := doc[k]
+				c, comparable := compare(v, old)
+				if !ok || (comparable && ((op == "$max" && c > 0) || (op == "$min" && c < 0))) {
+					doc[k] = v
+				}
+			case "$push":
+				list, _ := doc[k].(primitive.A)
+				doc[k] = append(append(primitive.A{}, list...), v)
+			default:
+				return false, fmt.Errorf("memory collection: unsupported update operator %s", op)
+			}
+		}
+	}
+	if err = m.checkUnique(doc, idx); err != nil {
+		return false, err
+	}
+	modified := !reflect.DeepEqual(doc, m.docs[idx])
+	m.docs[idx] = doc
+	return modified, nil
+}
+
+//checkUnique reports a duplicate key error when doc repeats a unique value of another document
+func (m *MemoryCollection) checkUnique(doc bson.M, self int) error {
+	for _, field := range append([]string{"_id"}, m.unique...) {
+		value, ok := doc[field]
+		if !ok {
+			continue
+		}
+		for i, other := range m.docs {
+			if i != self && other[field] != nil && equal(other[field], value) {
+				return mongo.WriteException{WriteErrors: []mongo.WriteError{{
+					Code:    11000,
+					Message: fmt.Sprintf("E11000 duplicate key error dup key: { %s: %v }", field, value),
+				}}}
+			}
+		}
+	}
+	return nil
+}
+
+//match returns the indexes of the documents matching filter in insertion order
+func (m *MemoryCollection) match(filter interface{}) ([]int, error) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	var matched []int
+	for i, doc := range m.docs {
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, i)
+		}
+	}
+	return matched, nil
+}
+
+func (m *MemoryCollection) first(filter interface{}, order interface{}) (int, error) {
+	matched, err := m.match(filter)
+	if err != nil {
+		return 0, err
+	}
+	if len(matched) == 0 {
+		return 0, mongo.ErrNoDocuments
+	}
+	if err = m.sort(matched, order); err != nil {
+		return 0, err
+	}
+	return matched[0], nil
+}
+
+//sort orders document indexes by a sort specification such as bson.M{"createdAt": 1}
+func (m *MemoryCollection) sort(idx []int, order interface{}) error {
+	if order == nil {
+		return nil
+	}
+	raw, err := bson.Marshal(order)
+	if err != nil {
+		return err
+	}
+	var keys bson.D
+	if err = bson.Unmarshal(raw, &keys); err != nil {
+		return err
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		for _, key := range keys {
+			a, b := m.docs[idx[i]][key.Key], m.docs[idx[j]][key.Key]
+			c, _ := compare(a, b)
+			if c == 0 {
+				continue
+			}
+			if n, _ := toFloat(key.Value); n < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func matches(doc bson.M, filter bson.M) (bool, error) {
+	for k, cond := range filter {
+		switch k {
+		case "$and", "$or":
+			list, ok := cond.(primitive.A)
+			if !ok {
+				return false, fmt.Errorf("memory collection: %s needs an array", k)
+			}
+			matchedAny := false
+			for _, item := range list {
+				sub, ok := item.(bson.M)
+				if !ok {
+					return false, fmt.Errorf("memory collection: %s needs documents", k)
+				}
+				ok, err := matches(doc, sub)
+				if err != nil {
+					return false, err
+				}
+				if k == "$and" && !ok {
+					return false, nil
+				}
+				matchedAny = matchedAny || ok
+			}
+			if k == "$or" && !matchedAny {
+				return false, nil
+			}
+			continue
+		}
+		value, present := doc[k]
+		if !isOperatorDoc(cond) {
+			if !present || !equal(value, cond) {
+				return false, nil
+			}
+			continue
+		}
+		for op, arg := range cond.(bson.M) {
+			ok, err := matchOperator(op, value, present, arg)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(op string, value interface{}, present bool, arg interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return present && equal(value, arg), nil
+	case "$ne":
+		return !present || !equal(value, arg), nil
+	case "$exists":
+		want, _ := arg.(bool)
+		return present == want, nil
+	case "$in", "$nin":
+		list, ok := arg.(primitive.A)
+		if !ok {
+			return false, fmt.Errorf("memory collection: %s needs an array", op)
+		}
+		found := false
+		for _, item := range list {
+			if present && equal(value, item) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		if !present {
+			return false, nil
+		}
+		c, ok := compare(value, arg)
+		if !ok {
+			return false, nil
+		}
+		switch op {
+		case "$gt":
+			return c > 0, nil
+		case "$gte":
+			return c >= 0, nil
+		case "$lt":
+			return c < 0, nil
+		}
+		return c <= 0, nil
+	}
+	return false, fmt.Errorf("memory collection: unsupported query operator %s", op)
+}
+
+func isOperatorDoc(v interface{}) bool {
+	doc, ok := v.(bson.M)
+	if !ok || len(doc) == 0 {
+		return false
+	}
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+//toDoc converts documents, filters and updates into the bson.M form stored documents have
+func toDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+func copyDoc(doc bson.M) bson.M {
+	c, _ := toDoc(doc)
+	return c
+}
+
+func singleResult(doc bson.M, err error) *mongo.SingleResult {
+	if doc == nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return mongo.NewSingleResultFromDocument(doc, err, nil)
+}
+
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+//compare orders two bson values of the same kind, ok is false when they cannot be compared,
+//a missing value sorts before anything else
+func compare(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, true
+		case a == nil:
+			return -1, true
+		}
+		return 1, true
+	}
+	if x, ok := toInt(a); ok {
+		if y, ok := toInt(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if x, ok := toRat(a); ok {
+		if y, ok := toRat(b); ok {
+			_, ad := a.(primitive.Decimal128)
+			_, bd := b.(primitive.Decimal128)
+			if ad || bd {
+				return x.Cmp(y), true
+			}
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case bool:
+		y, ok := b.(bool)
+		switch {
+		case !ok || x == y:
+			return 0, ok
+		case !x:
+			return -1, true
+		}
+		return 1, true
+	case primitive.DateTime:
+		y, ok := b.(primitive.DateTime)
+		switch {
+		case !ok || x == y:
+			return 0, ok
+		case x < y:
+			return -1, true
+		}
+		return 1, true
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:]), ok
+	}
+	return 0, false
+}
+
+//toRat reads numbers exactly, decimals included
+func toRat(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case primitive.Decimal128:
+		return new(big.Rat).SetString(n.String())
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(n) == nil {
+			return nil, false
+		}
+		return r, true
+	}
+	if n, ok := toInt(v); ok {
+		return new(big.Rat).SetInt64(n), true
+	}
+	return nil, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func add(a, b interface{}) (interface{}, error) {
+	if a == nil {
+		return b, nil
+	}
+	x, xi := toInt(a)
+	y, yi := toInt(b)
+	if xi && yi {
+		return x + y, nil
+	}
+	fx, ok := toFloat(a)
+	fy, ok2 := toFloat(b)
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("memory collection: cannot $inc %T by %T", a, b)
+	}
+	return fx + fy, nil
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
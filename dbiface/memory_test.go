@@ -0,0 +1,98 @@
+package dbiface
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type testDoc struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Username string             `bson:"username"`
+	UserID   primitive.ObjectID `bson:"user_id,omitempty"`
+	Count    int                `bson:"count"`
+	At       time.Time          `bson:"at"`
+}
+
+func TestMemoryCollectionEqualityFilters(t *testing.T) {
+	ctx := context.Background()
+	col := NewMemoryCollection("username")
+	user := primitive.NewObjectID()
+	res, err := col.InsertOne(ctx, testDoc{Username: "a@example.com", UserID: user})
+	require.NoError(t, err)
+	_, err = col.InsertOne(ctx, testDoc{Username: "b@example.com"})
+	require.NoError(t, err)
+
+	var doc testDoc
+	require.NoError(t, col.FindOne(ctx, bson.M{"_id": res.InsertedID}).Decode(&doc))
+	assert.Equal(t, "a@example.com", doc.Username)
+	require.NoError(t, col.FindOne(ctx, bson.M{"user_id": user}).Decode(&doc))
+	assert.Equal(t, user, doc.UserID)
+	var other testDoc
+	require.NoError(t, col.FindOne(ctx, bson.M{"username": "b@example.com"}).Decode(&other))
+	assert.True(t, other.UserID.IsZero())
+
+	err = col.FindOne(ctx, bson.M{"username": "c@example.com"}).Decode(&doc)
+	assert.Equal(t, mongo.ErrNoDocuments, err)
+
+	_, err = col.InsertOne(ctx, testDoc{Username: "a@example.com"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+}
+
+func TestMemoryCollectionFindSortsAndLimits(t *testing.T) {
+	ctx := context.Background()
+	col := NewMemoryCollection()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := col.InsertOne(ctx, testDoc{Count: i, At: now.Add(time.Duration(-i) * time.Minute)})
+		require.NoError(t, err)
+	}
+
+	cursor, err := col.Find(ctx, bson.M{"count": bson.M{"$gte": 1}}, options.Find().SetSort(bson.M{"at": 1}).SetLimit(2))
+	require.NoError(t, err)
+	var docs []testDoc
+	require.NoError(t, cursor.All(ctx, &docs))
+	require.Len(t, docs, 2)
+	assert.Equal(t, 4, docs[0].Count)
+	assert.Equal(t, 3, docs[1].Count)
+
+	n, err := col.CountDocuments(ctx, bson.M{"count": bson.M{"$in": []int{0, 2, 9}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestMemoryCollectionUpdates(t *testing.T) {
+	ctx := context.Background()
+	col := NewMemoryCollection()
+	res, err := col.InsertOne(ctx, testDoc{Username: "a@example.com", Count: 1})
+	require.NoError(t, err)
+
+	upd, err := col.UpdateOne(ctx, bson.M{"_id": res.InsertedID, "count": 1}, bson.M{"$inc": bson.M{"count": 2}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), upd.ModifiedCount)
+	upd, err = col.UpdateOne(ctx, bson.M{"_id": res.InsertedID, "count": 1}, bson.M{"$inc": bson.M{"count": 2}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), upd.MatchedCount)
+
+	upd, err = col.UpdateOne(ctx, bson.M{"username": "new@example.com"}, bson.M{"$set": bson.M{"count": 7}}, options.Update().SetUpsert(true))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), upd.UpsertedCount)
+
+	var doc testDoc
+	err = col.FindOneAndUpdate(ctx, bson.M{"username": "new@example.com"}, bson.M{"$max": bson.M{"count": 9}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+	require.NoError(t, err)
+	assert.Equal(t, 9, doc.Count)
+
+	require.NoError(t, col.FindOneAndDelete(ctx, bson.M{"username": "new@example.com"}).Decode(&doc))
+	del, err := col.DeleteOne(ctx, bson.M{"username": "new@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), del.DeletedCount)
+}
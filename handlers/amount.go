@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/Godtide/rating/chain"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	//maxAmountScale is the number of decimals a TokenAmount may have, those of most ERC-20 tokens
+	maxAmountScale = 18
+	//maxAmountDigits is the number of digits before the decimal point of a TokenAmount,
+	//with maxAmountScale it fits the 34 digits of a Decimal128
+	maxAmountDigits = 16
+)
+
+var amountPattern = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]+))?$`)
+
+//TokenAmount is an exact, non-negative decimal amount of whole tokens such as "12.5", the zero value is 0.
+//It is a string in JSON, a Decimal128 in mongo and a decimal string in SQL
+type TokenAmount struct {
+	rat *big.Rat
+}
+
+//ParseTokenAmount reads a decimal such as "12.5", with at most maxAmountDigits digits before
+//the point and maxAmountScale after it
+func ParseTokenAmount(s string) (TokenAmount, error) {
+	m := amountPattern.FindStringSubmatch(s)
+	if m == nil {
+		return TokenAmount{}, fmt.Errorf("%q is not a decimal amount", s)
+	}
+	if len(strings.TrimLeft(m[1], "0")) > maxAmountDigits || len(strings.TrimRight(m[2], "0")) > maxAmountScale {
+		return TokenAmount{}, fmt.Errorf("%q has more than %d digits or %d decimals", s, maxAmountDigits, maxAmountScale)
+	}
+	rat, _ := new(big.Rat).SetString(s)
+	return TokenAmount{rat: rat}, nil
+}
+
+//Rat returns the amount as a new big.Rat
+func (a TokenAmount) Rat() *big.Rat {
+	if a.rat == nil {
+		return new(big.Rat)
+	}
+	return new(big.Rat).Set(a.rat)
+}
+
+//Sign returns 0 for the zero amount and 1 otherwise
+func (a TokenAmount) Sign() int {
+	return a.Rat().Sign()
+}
+
+//Cmp compares a and b like big.Rat.Cmp
+func (a TokenAmount) Cmp(b TokenAmount) int {
+	return a.Rat().Cmp(b.Rat())
+}
+
+//Mul returns a times b, it may have up to twice as many decimals as its factors
+func (a TokenAmount) Mul(b TokenAmount) TokenAmount {
+	return TokenAmount{rat: new(big.Rat).Mul(a.Rat(), b.Rat())}
+}
+
+//BaseUnits converts the amount to base units of a token with the given decimals,
+//failing when it is finer than a base unit
+func (a TokenAmount) BaseUnits(decimals uint8) (*big.Int, error) {
+	return chain.ExactUnits(a.Rat(), decimals)
+}
+
+//scale returns the number of decimals needed to write the amount
+func (a TokenAmount) scale() int {
+	denom, pow, ten := a.Rat().Denom(), big.NewInt(1), big.NewInt(10)
+	n := 0
+	// amounts are decimals, the denominator divides a power of ten
+	for new(big.Int).Rem(pow, denom).Sign() != 0 && n < 2*(maxAmountDigits+maxAmountScale) {
+		pow.Mul(pow, ten)
+		n++
+	}
+	return n
+}
+
+//String writes the amount without trailing zeros, such as "12.5"
+func (a TokenAmount) String() string {
+	r := a.Rat()
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	return strings.TrimRight(r.FloatString(a.scale()), "0")
+}
+
+//SortKey writes the amount zero padded to maxAmountDigits digits before the point and maxAmountScale
+//after it, such as "0000000000000012.500000000000000000". Keys compare as text like their amounts do,
+//for stores without an exact decimal type
+func (a TokenAmount) SortKey() string {
+	whole, fraction, _ := strings.Cut(a.Rat().FloatString(maxAmountScale), ".")
+	if len(whole) < maxAmountDigits {
+		whole = strings.Repeat("0", maxAmountDigits-len(whole)) + whole
+	}
+	return whole + "." + fraction
+}
+
+//MarshalJSON writes the amount as a string, JSON numbers lose precision in most clients
+func (a TokenAmount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+//UnmarshalJSON reads a string, or a number as sent before amounts were decimals
+func (a *TokenAmount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	amount, err := ParseTokenAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+//MarshalBSONValue stores the amount as a Decimal128
+func (a TokenAmount) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	d, err := primitive.ParseDecimal128(a.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(d)
+}
+
+//UnmarshalBSONValue reads a Decimal128, or the integers stored before amounts were decimals
+func (a *TokenAmount) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	var s string
+	switch t {
+	case bsontype.Decimal128:
+		s = raw.Decimal128().String()
+	case bsontype.Int32:
+		s = fmt.Sprint(raw.Int32())
+	case bsontype.Int64:
+		s = fmt.Sprint(raw.Int64())
+	case bsontype.Null:
+		*a = TokenAmount{}
+		return nil
+	default:
+		return fmt.Errorf("cannot read a token amount from %s", t)
+	}
+	rat, ok := new(big.Rat).SetString(s)
+	if !ok || rat.Sign() < 0 {
+		return fmt.Errorf("%s is not a token amount", s)
+	}
+	*a = TokenAmount{rat: rat}
+	return nil
+}
+
+//Value stores the amount as a decimal string
+func (a TokenAmount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+//Scan reads a decimal column, text in SQLite and NUMERIC in PostgreSQL
+func (a *TokenAmount) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case int64:
+		s = fmt.Sprint(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a token amount", src)
+	}
+	rat, ok := new(big.Rat).SetString(s)
+	if !ok || rat.Sign() < 0 {
+		return fmt.Errorf("%q is not a token amount", s)
+	}
+	*a = TokenAmount{rat: rat}
+	return nil
+}
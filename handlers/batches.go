@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Godtide/rating/chain"
+	"github.com/Godtide/rating/dbiface"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+const (
+	//TransactionQueued waiting to be flushed in the next payout batch
+	TransactionQueued = "queued"
+	//TransactionSending taken by a payout batch that is being sent, it carries the txHash once the batch is signed
+	TransactionSending = "sending"
+)
+
+//sendingTimeout is how long a batch may stay sending, or a held payout releasing, before it is taken for
+//abandoned by a crashed run
+const sendingTimeout = 2 * time.Minute
+
+//Batcher accumulates claim payouts and sends them together once MaxSize
+//claims are queued or the oldest one has waited MaxWait
+type Batcher struct {
+	TransactionCol dbiface.CollectionAPI
+	Transferer     chain.BatchTransferer
+	MaxSize        int
+	MaxWait        time.Duration
+
+	mu sync.Mutex
+}
+
+//Enqueue adds a payout to the next batch and flushes right away when the batch is full
+func (b *Batcher) Enqueue(ctx context.Context, userRewardID primitive.ObjectID, wallet string, amount *big.Int, attempt int) (Transaction, error) {
+	now := time.Now()
+	tx := Transaction{
+		ID:           primitive.NewObjectID(),
+		UserRewardId: userRewardID,
+		Wallet:       wallet,
+		Amount:       amount.String(),
+		Status:       TransactionQueued,
+		Attempt:      attempt,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if _, err := b.TransactionCol.InsertOne(ctx, tx); err != nil {
+		return tx, err
+	}
+	go func() {
+		if _, err := b.Run(context.Background()); err != nil {
+			log.Errorf("Unable to flush payout batch : %v", err)
+		}
+	}()
+	return tx, nil
+}
+
+//Run flushes queued payouts that reached a threshold, it returns the number of payouts sent
+func (b *Batcher) Run(ctx context.Context) (int64, error) {
+	if !b.mu.TryLock() {
+		// a flush is already running and will pick up everything queued
+		return 0, nil
+	}
+	defer b.mu.Unlock()
+	if err := b.recover(ctx); err != nil {
+		return 0, err
+	}
+	var sent int64
+	for {
+		queued, err := b.nextBatch(ctx)
+		if err != nil {
+			return sent, err
+		}
+		if len(queued) == 0 || (len(queued) < b.MaxSize && time.Since(queued[0].CreatedAt) < b.MaxWait) {
+			return sent, nil
+		}
+		if err = b.flush(ctx, queued); err != nil {
+			return sent, err
+		}
+		sent += int64(len(queued))
+	}
+}
+
+func (b *Batcher) nextBatch(ctx context.Context) ([]Transaction, error) {
+	var queued []Transaction
+	opts := options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(int64(b.MaxSize))
+	cursor, err := b.TransactionCol.Find(ctx, bson.M{"status": TransactionQueued}, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &queued)
+	return queued, err
+}
+
+//flush takes the queued payouts for a new batch, records the hash of the batch transaction on them
+//before it is sent and hands them to the TransactionWatcher once it was
+func (b *Batcher) flush(ctx context.Context, queued []Transaction) error {
+	batchID := primitive.NewObjectID()
+	ids := make([]primitive.ObjectID, len(queued))
+	for i, tx := range queued {
+		ids[i] = tx.ID
+	}
+	_, err := b.TransactionCol.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "status": TransactionQueued},
+		bson.M{"$set": bson.M{"status": TransactionSending, "batch_id": batchID, "updatedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	// another flush may have taken some of them first
+	batch, err := findTransactions(ctx, bson.M{"batch_id": batchID, "status": TransactionSending}, b.TransactionCol)
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+	items := make([]chain.BatchItem, len(batch))
+	for i, tx := range batch {
+		amount, err := parseAmount(tx)
+		if err != nil {
+			return err
+		}
+		items[i] = chain.BatchItem{To: tx.Wallet, Amount: amount}
+	}
+	recorded := false
+	sent, err := b.Transferer.TransferBatch(ctx, items, func(ctx context.Context, sent chain.SentTx) error {
+		recorded = true
+		return b.setSending(ctx, batchID, len(batch), sent)
+	})
+	if err != nil && !recorded {
+		// nothing was sent, the payouts go out with the next flush
+		_, uerr := b.TransactionCol.UpdateMany(ctx, bson.M{"batch_id": batchID, "status": TransactionSending},
+			bson.M{"$set": bson.M{"status": TransactionQueued, "updatedAt": time.Now()}, "$unset": bson.M{"batch_id": ""}})
+		if uerr != nil {
+			log.Errorf("Unable to queue the payouts of batch %s again : %v", batchID.Hex(), uerr)
+		}
+		return err
+	}
+	if err != nil {
+		// the batch may have reached the network, recover hands it to the watcher once it timed out
+		log.Errorf("Unable to send payout batch %s : %v", batchID.Hex(), err)
+		return err
+	}
+	_, err = b.TransactionCol.UpdateMany(ctx, bson.M{"batch_id": batchID, "status": TransactionSending},
+		bson.M{"$set": bson.M{"status": TransactionPending, "updatedAt": time.Now()}})
+	if err != nil {
+		log.Errorf("Batch %s sent but its payouts were not updated : %v", sent.Hash, err)
+		return err
+	}
+	log.Infof("Sent payout batch %s with %d transfers", sent.Hash, len(batch))
+	return nil
+}
+
+//setSending records the signed batch transaction on the payouts of batchID
+func (b *Batcher) setSending(ctx context.Context, batchID primitive.ObjectID, size int, sent chain.SentTx) error {
+	set := sentFields(sent)
+	set["batchSize"] = size
+	_, err := b.TransactionCol.UpdateMany(ctx, bson.M{"batch_id": batchID, "status": TransactionSending}, bson.M{"$set": set})
+	return err
+}
+
+//recover resolves the batches a flush left sending for longer than sendingTimeout. A batch without a txHash
+//was never signed and is queued again, any other may have reached the network and goes to the
+//TransactionWatcher, which checks its receipt and only ever sends it again under its nonce
+func (b *Batcher) recover(ctx context.Context) error {
+	stale := bson.M{"status": TransactionSending, "updatedAt": bson.M{"$lt": time.Now().Add(-sendingTimeout)}}
+	abandoned, err := findTransactions(ctx, stale, b.TransactionCol)
+	if err != nil {
+		return err
+	}
+	for _, tx := range abandoned {
+		update := bson.M{"$set": bson.M{"status": TransactionPending, "updatedAt": time.Now()}}
+		if tx.TxHash == "" {
+			update = bson.M{"$set": bson.M{"status": TransactionQueued, "updatedAt": time.Now()}, "$unset": bson.M{"batch_id": ""}}
+		}
+		if _, err = b.TransactionCol.UpdateOne(ctx, bson.M{"_id": tx.ID, "status": TransactionSending}, update); err != nil {
+			return err
+		}
+		log.Warnf("Payout %s of batch %s was left sending, txHash %q", tx.ID.Hex(), tx.BatchId.Hex(), tx.TxHash)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//Operator compares a field with the value of a Condition
+type Operator string
+
+const (
+	//OpEq selects records whose field equals the value
+	OpEq Operator = "eq"
+	//OpGt selects records whose field is above the value
+	OpGt Operator = "gt"
+	//OpGte selects records whose field is at or above the value
+	OpGte Operator = "gte"
+	//OpLt selects records whose field is below the value
+	OpLt Operator = "lt"
+	//OpLte selects records whose field is at or below the value
+	OpLte Operator = "lte"
+	//OpIn selects records whose field equals one of the values
+	OpIn Operator = "in"
+	//OpExists selects records whose field is set when the value is true, unset when false.
+	//Query parameters cannot use it
+	OpExists Operator = "exists"
+)
+
+//Condition compares Field, a json field name, with Value. Value is a string, an int64, a primitive.ObjectID,
+//a time.Time or a TokenAmount after the kind of the field, a slice of them for OpIn
+type Condition struct {
+	Field string
+	Op    Operator
+	Value interface{}
+}
+
+//Filter selects records matching every Condition
+type Filter []Condition
+
+//Eq is a Condition selecting records whose field equals value
+func Eq(field string, value interface{}) Condition {
+	return Condition{Field: field, Op: OpEq, Value: value}
+}
+
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	intField
+	idField
+	timeField
+	decimalField
+)
+
+//fields are the fields of a resource filters may select on
+type fields map[string]fieldKind
+
+var (
+	userFields = fields{"_id": idField, "username": textField}
+	//rewardFields are the fields GET /rewards may filter on
+	rewardFields = fields{
+		"_id":              idField,
+		"type":             textField,
+		"points":           decimalField,
+		"amountRedeemable": decimalField,
+		"expiry":           intField,
+		"createdAt":        timeField,
+		"updatedAt":        timeField,
+		"deletedAt":        timeField,
+	}
+	//userRewardFields are the fields GET /reward may filter on
+	userRewardFields = fields{
+		"_id":       idField,
+		"user_id":   idField,
+		"reward_id": idField,
+		"status":    textField,
+		"txHash":    textField,
+		"createdAt": timeField,
+		"expiresAt": timeField,
+	}
+	//ratingFields are the fields GET /ratings may filter on
+	ratingFields = fields{
+		"_id":       idField,
+		"user_id":   idField,
+		"rater_id":  idField,
+		"source":    textField,
+		"event":     textField,
+		"value":     intField,
+		"createdAt": timeField,
+	}
+	ratingRuleFields = fields{"_id": idField, "rewardType": textField, "createdAt": timeField}
+)
+
+//operators lists the operators each kind of field supports
+var operators = map[fieldKind][]Operator{
+	textField:    {OpEq, OpIn},
+	idField:      {OpEq, OpIn},
+	intField:     {OpEq, OpGt, OpGte, OpLt, OpLte, OpIn},
+	timeField:    {OpEq, OpGt, OpGte, OpLt, OpLte},
+	decimalField: {OpEq, OpGt, OpGte, OpLt, OpLte, OpIn},
+}
+
+//check returns an ErrInvalidFilter unless every condition of filter is on a field of fs
+//with a value of its kind
+func (fs fields) check(filter Filter) error {
+	for _, cond := range filter {
+		kind, ok := fs[cond.Field]
+		if !ok {
+			return fmt.Errorf("%w: unknown field %s", ErrInvalidFilter, cond.Field)
+		}
+		if cond.Op == OpExists {
+			if _, ok := cond.Value.(bool); !ok {
+				return fmt.Errorf("%w: %s[exists] needs a bool", ErrInvalidFilter, cond.Field)
+			}
+			continue
+		}
+		values := []interface{}{cond.Value}
+		if cond.Op == OpIn {
+			list, ok := cond.Value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%w: %s[in] needs a list", ErrInvalidFilter, cond.Field)
+			}
+			values = list
+		}
+		for _, value := range values {
+			var ok bool
+			switch kind {
+			case textField:
+				_, ok = value.(string)
+			case intField:
+				_, ok = value.(int64)
+			case idField:
+				_, ok = value.(primitive.ObjectID)
+			case timeField:
+				_, ok = value.(time.Time)
+			case decimalField:
+				_, ok = value.(TokenAmount)
+			}
+			if !ok {
+				return fmt.Errorf("%w: %s cannot be compared with %T", ErrInvalidFilter, cond.Field, value)
+			}
+		}
+	}
+	return nil
+}
+
+//parseFilter reads a Filter over the fields of fs from the query parameters other than pageParams.
+//A parameter field=value compares with eq, field[op]=value with op; in takes a comma separated list
+//and times are RFC 3339 or a date, so createdAt[gte]=2024-01-01&createdAt[lt]=2024-02-01 selects January
+func parseFilter(q url.Values, fs fields) (Filter, error) {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if !pageParams[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	filter := Filter{}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		name, op := k, OpEq
+		if i := strings.IndexByte(k, '['); i > 0 && strings.HasSuffix(k, "]") {
+			name, op = k[:i], Operator(k[i+1:len(k)-1])
+		}
+		kind, ok := fs[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown field %s", ErrInvalidFilter, name)
+		}
+		if !supports(kind, op) {
+			return nil, fmt.Errorf("%w: %s does not support %s", ErrInvalidFilter, name, op)
+		}
+		if len(q[k]) > 1 || seen[name+string(op)] {
+			return nil, fmt.Errorf("%w: %s[%s] is given more than once", ErrInvalidFilter, name, op)
+		}
+		seen[name+string(op)] = true
+
+		raw := []string{q[k][0]}
+		if op == OpIn {
+			raw = strings.Split(q[k][0], ",")
+		}
+		values := make([]interface{}, 0, len(raw))
+		for _, s := range raw {
+			value, err := parseValue(kind, s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s %v", ErrInvalidFilter, name, err)
+			}
+			values = append(values, value)
+		}
+		cond := Condition{Field: name, Op: op, Value: values[0]}
+		if op == OpIn {
+			cond.Value = values
+		}
+		filter = append(filter, cond)
+	}
+	return filter, nil
+}
+
+func supports(kind fieldKind, op Operator) bool {
+	for _, supported := range operators[kind] {
+		if supported == op {
+			return true
+		}
+	}
+	return false
+}
+
+func parseValue(kind fieldKind, s string) (interface{}, error) {
+	switch kind {
+	case intField:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("is not a number")
+		}
+		return n, nil
+	case idField:
+		id, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			return nil, fmt.Errorf("is not an id")
+		}
+		return id, nil
+	case decimalField:
+		amount, err := ParseTokenAmount(s)
+		if err != nil {
+			return nil, fmt.Errorf("is not a decimal amount")
+		}
+		return amount, nil
+	case timeField:
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, fmt.Errorf("is not a RFC 3339 time or a date")
+		}
+		return t, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,1063 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Godtide/rating/chain"
+	"github.com/Godtide/rating/config"
+	"github.com/Godtide/rating/dbiface"
+	"github.com/Godtide/rating/keyvault"
+	"github.com/Godtide/rating/scheduler"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+var _ = ConfigureTokens(config.TokenProperties{JwtTokenSecret: "test-secret-0123456789abcdef0123456789", JwtTokenTTL: 15})
+
+const (
+	testAdmin    = "admin@example.com"
+	testPassword = "correct horse battery"
+)
+
+//testServer wires every handler onto in-memory collections the same way main does
+type testServer struct {
+	e              *echo.Echo
+	users          *UsersHandler
+	vault          keyvault.KeyVault
+	transactionCol *dbiface.MemoryCollection
+	walletRepo     *MongoWalletRepo
+	userRewardRepo *MongoUserRewardRepo
+	transferer     *chain.FakeTransferer
+	treasury       *Treasury
+}
+
+func newTestServer(t *testing.T) *testServer {
+	wrapper, err := keyvault.NewLocalKeyWrapper(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	vault := keyvault.NewEnvelopeVault(wrapper)
+
+	s := &testServer{
+		transactionCol: dbiface.NewMemoryCollection(),
+		walletRepo:     &MongoWalletRepo{Col: dbiface.NewMemoryCollection()},
+		userRewardRepo: &MongoUserRewardRepo{Col: dbiface.NewMemoryCollection("grantKey")},
+		transferer:     chain.NewFakeTransferer(),
+	}
+	userRepo := &MongoUserRepo{Col: dbiface.NewMemoryCollection("username")}
+	rewardRepo := &MongoRewardRepo{Col: dbiface.NewMemoryCollection()}
+	require.NoError(t, SeedAdmin(context.Background(), testAdmin, testPassword, userRepo))
+
+	s.treasury = &Treasury{
+		Account:          "0x00000000000000000000000000000000000000aa",
+		Balances:         s.transferer,
+		MinTokens:        big.NewInt(1000),
+		MinNativeBalance: big.NewInt(1),
+		TransactionCol:   s.transactionCol,
+		UserRewardRepo:   s.userRewardRepo,
+		Transferer:       s.transferer,
+	}
+	sched := scheduler.New()
+	require.NoError(t, sched.Add("check-treasury", "@every 1h", 0, s.treasury.Run))
+
+	uh := &UsersHandler{UserRepo: userRepo, WalletRepo: s.walletRepo, Vault: vault, Wallets: RandomWalletGenerator{}}
+	s.users, s.vault = uh, vault
+	us := &UserRewardHandler{
+		UserRewardRepo: s.userRewardRepo,
+		RewardRepo:     rewardRepo,
+		WalletRepo:     s.walletRepo,
+		IdempotencyCol: dbiface.NewMemoryCollection(),
+		TransactionCol: s.transactionCol,
+		Transferer:     s.transferer,
+		Treasury:       s.treasury,
+	}
+	wh := &WalletHandler{WalletRepo: s.walletRepo, ChallengeCol: dbiface.NewMemoryCollection()}
+	ar := &RewardHandler{UserRewardRepo: s.userRewardRepo, RewardRepo: rewardRepo}
+	jh := &JobsHandler{Scheduler: sched}
+	th := &TransactionHandler{TransactionCol: s.transactionCol, UserRewardRepo: s.userRewardRepo}
+	trh := &TreasuryHandler{Treasury: s.treasury}
+	rh := &RatingHandler{
+		RatingRepo:     &MongoRatingRepo{Col: dbiface.NewMemoryCollection("key"), ScoreCol: dbiface.NewMemoryCollection()},
+		RuleRepo:       &MongoRatingRuleRepo{Col: dbiface.NewMemoryCollection()},
+		UserRepo:       userRepo,
+		RewardRepo:     rewardRepo,
+		UserRewardRepo: s.userRewardRepo,
+	}
+
+	s.e = echo.New()
+	s.e.POST("/users", uh.CreateUser)
+	s.e.POST("/login", uh.AuthnUser)
+	s.e.POST("/reward/create", us.CreateUserRewards, testAuth)
+	s.e.POST("/reward/claim/:id", us.ClaimReward, testAuth)
+	s.e.GET("/reward/:id/transactions", th.GetUserRewardTransactions, testAuth)
+	s.e.GET("/rewards", ar.GetRewards, testAuth)
+	s.e.GET("/rewards/:id", ar.GetReward, testAuth)
+	s.e.GET("/reward", us.GetUserRewards, testAuth)
+	s.e.POST("/wallet/challenge", wh.CreateLinkChallenge, testAuth)
+	s.e.POST("/wallet/link", wh.LinkWallet, testAuth)
+	s.e.POST("/ratings", rh.CreateRating, testAuth)
+	s.e.GET("/ratings", rh.GetRatings, testAuth)
+	s.e.GET("/users/:id/score", rh.GetScore, testAuth)
+	adm := s.e.Group("/admin", testAuth, testAdminOnly)
+	adm.POST("/reward", ar.CreateRewards)
+	adm.PUT("/reward/:id", ar.UpdateReward)
+	adm.DELETE("/reward/:id", ar.ArchiveReward)
+	adm.POST("/reward/:id/restore", ar.RestoreReward)
+	adm.POST("/rating-rules", rh.CreateRatingRule)
+	adm.GET("/rating-rules", rh.GetRatingRules)
+	adm.DELETE("/rating-rules/:id", rh.DeleteRatingRule)
+	adm.GET("/jobs", jh.GetJobs)
+	adm.GET("/treasury", trh.GetTreasury)
+	return s
+}
+
+//testAuth and testAdminOnly mirror the middlewares of main
+func testAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, err := ParseToken(strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired token")
+		}
+		c.Set(ClaimsKey, claims)
+		return next(c)
+	}
+}
+
+func testAdminOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if claims, ok := CurrentUser(c); !ok || !claims.IsAdmin {
+			return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+		}
+		return next(c)
+	}
+}
+
+func (s *testServer) do(method, path, token string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, out interface{}) {
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), out), rec.Body.String())
+}
+
+//signup registers a user and returns its access token and id
+func (s *testServer) signup(t *testing.T, email string) (string, string) {
+	rec := s.do(http.MethodPost, "/users", "", map[string]string{"username": email, "password": testPassword})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	return s.login(t, email)
+}
+
+func (s *testServer) login(t *testing.T, email string) (string, string) {
+	rec := s.do(http.MethodPost, "/login", "", map[string]string{"username": email, "password": testPassword})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var token tokenResponse
+	decode(t, rec, &token)
+	claims, err := ParseToken(token.Token)
+	require.NoError(t, err)
+	return token.Token, claims.UserID
+}
+
+//grant creates a reward type as admin and grants it to userID, returning the UserReward id
+func (s *testServer) grant(t *testing.T, adminToken, userID string) string {
+	rec := s.do(http.MethodPost, "/admin/reward", adminToken,
+		map[string]interface{}{"type": "high", "points": 2, "amountRedeemable": 3, "expiry": 7})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rewardID string
+	decode(t, rec, &rewardID)
+
+	rec = s.do(http.MethodPost, "/reward/create", adminToken, map[string]string{"user_id": userID, "reward_id": rewardID})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var userRewardID string
+	decode(t, rec, &userRewardID)
+	return userRewardID
+}
+
+func TestCreateUser(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := s.do(http.MethodPost, "/users", "", map[string]string{"username": "ada@example.com", "password": testPassword})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var wallet Wallet
+	decode(t, rec, &wallet)
+	assert.True(t, strings.HasPrefix(wallet.PublicKey, "0x"))
+	assert.NotContains(t, rec.Body.String(), "private")
+
+	rec = s.do(http.MethodPost, "/users", "", map[string]string{"username": "ada@example.com", "password": testPassword})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = s.do(http.MethodPost, "/users", "", map[string]string{"username": "not an email", "password": testPassword})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+//failingWalletRepo fails to store wallets
+type failingWalletRepo struct {
+	WalletRepo
+}
+
+func (failingWalletRepo) Create(ctx context.Context, wallet Wallet) (Wallet, error) {
+	return Wallet{}, fmt.Errorf("disk full")
+}
+
+//standaloneTransactor answers like a mongo server that is not part of a replica set
+type standaloneTransactor struct{}
+
+func (standaloneTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fmt.Errorf("%w: IllegalOperation", ErrNoTransactions)
+}
+
+func TestCreateUserLeavesNoUserWithoutWallet(t *testing.T) {
+	for name, transactor := range map[string]Transactor{"no transactor": nil, "standalone": standaloneTransactor{}} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.users.Transactor = transactor
+			s.users.WalletRepo = failingWalletRepo{s.walletRepo}
+			body := map[string]string{"username": "ada@example.com", "password": testPassword}
+
+			rec := s.do(http.MethodPost, "/users", "", body)
+			assert.Equal(t, http.StatusInternalServerError, rec.Code)
+			_, err := s.users.UserRepo.FindByUsername(context.Background(), "ada@example.com")
+			assert.Equal(t, ErrNotFound, err)
+
+			s.users.WalletRepo = s.walletRepo
+			rec = s.do(http.MethodPost, "/users", "", body)
+			assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+func TestProvisionWallets(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	s.signup(t, "ada@example.com")
+	admin, err := s.users.UserRepo.FindByUsername(ctx, testAdmin)
+	require.NoError(t, err)
+
+	report, err := ProvisionWallets(ctx, s.users.UserRepo, s.walletRepo, RandomWalletGenerator{}, s.vault, true)
+	require.NoError(t, err)
+	assert.Equal(t, ProvisionReport{Checked: 2, Missing: 1}, report)
+	_, err = s.walletRepo.FindByUser(ctx, admin.ID)
+	assert.Equal(t, ErrNotFound, err)
+
+	report, err = ProvisionWallets(ctx, s.users.UserRepo, s.walletRepo, RandomWalletGenerator{}, s.vault, false)
+	require.NoError(t, err)
+	assert.Equal(t, ProvisionReport{Checked: 2, Missing: 1, Provisioned: 1}, report)
+	wallet, err := s.walletRepo.FindByUser(ctx, admin.ID)
+	require.NoError(t, err)
+	unsealed, err := unsealWallet(ctx, wallet, s.vault)
+	require.NoError(t, err)
+	assert.NoError(t, verifyWalletKey(unsealed))
+}
+
+func TestAuthnUser(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := s.signup(t, "ada@example.com")
+	assert.NotEmpty(t, token)
+
+	rec := s.do(http.MethodPost, "/login", "", map[string]string{"username": "ada@example.com", "password": "wrong password"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = s.do(http.MethodPost, "/login", "", map[string]string{"username": "bob@example.com", "password": testPassword})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCreateUserRewardsIsAdminOnly(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	rec := s.do(http.MethodPost, "/admin/reward", admin,
+		map[string]interface{}{"type": "high", "points": 2, "amountRedeemable": 3, "expiry": 7})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rewardID string
+	decode(t, rec, &rewardID)
+	mallory, malloryID := s.signup(t, "mallory@example.com")
+	_, bobID := s.signup(t, "bob@example.com")
+
+	for _, userID := range []string{malloryID, bobID} {
+		rec = s.do(http.MethodPost, "/reward/create", mallory, map[string]string{"user_id": userID, "reward_id": rewardID})
+		assert.Equal(t, http.StatusForbidden, rec.Code, userID)
+	}
+	granted, err := s.userRewardRepo.Find(context.Background(), Filter{}, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, granted)
+
+	rec = s.do(http.MethodPost, "/reward/create", admin, map[string]string{"user_id": bobID, "reward_id": rewardID})
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+}
+
+func TestConfigureTokensRejectsShortSecret(t *testing.T) {
+	assert.Error(t, ConfigureTokens(config.TokenProperties{}))
+	assert.Error(t, ConfigureTokens(config.TokenProperties{JwtTokenSecret: "abrakadabra", JwtTokenTTL: 15}))
+	assert.Equal(t, "test-secret-0123456789abcdef0123456789", prop.JwtTokenSecret)
+}
+
+func TestProtectedRoutesRequireToken(t *testing.T) {
+	s := newTestServer(t)
+	assert.Equal(t, http.StatusUnauthorized, s.do(http.MethodGet, "/rewards", "", nil).Code)
+
+	token, _ := s.signup(t, "ada@example.com")
+	assert.Equal(t, http.StatusForbidden, s.do(http.MethodGet, "/admin/jobs", token, nil).Code)
+	rec := s.do(http.MethodPost, "/admin/reward", token,
+		map[string]interface{}{"type": "high", "points": 2, "amountRedeemable": 3, "expiry": 7})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestCreateAndGetRewards(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+
+	rec := s.do(http.MethodPost, "/admin/reward", admin, map[string]interface{}{"type": "high", "points": 2})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	for _, kind := range []string{"high", "low"} {
+		rec = s.do(http.MethodPost, "/admin/reward", admin,
+			map[string]interface{}{"type": kind, "points": 2, "amountRedeemable": 3, "expiry": 7})
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var rewards []Reward
+	rec = s.do(http.MethodGet, "/rewards", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &rewards)
+	assert.Len(t, rewards, 2)
+
+	rec = s.do(http.MethodGet, "/rewards?type=low", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &rewards)
+	require.Len(t, rewards, 1)
+	assert.Equal(t, "low", rewards[0].Type)
+
+	rec = s.do(http.MethodGet, "/rewards?_id=nope", admin, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestFilterRewards(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	for points, kind := range map[int]string{2: "low", 5: "medium", 9: "high"} {
+		rec := s.do(http.MethodPost, "/admin/reward", admin,
+			map[string]interface{}{"type": kind, "points": points, "amountRedeemable": 3, "expiry": 7})
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+
+	for query, want := range map[string][]string{
+		"points=5":                   {"medium"},
+		"points[gt]=2":               {"medium", "high"},
+		"points[gte]=2&points[lt]=9": {"low", "medium"},
+		"points[in]=2,9":             {"low", "high"},
+		"type[in]=low,medium":        {"low", "medium"},
+		"createdAt[gte]=" + today + "&createdAt[lt]=" + tomorrow: {"low", "medium", "high"},
+		"createdAt[gte]=" + tomorrow:                             {},
+	} {
+		var rewards []Reward
+		rec := s.do(http.MethodGet, "/rewards?"+query, admin, nil)
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		decode(t, rec, &rewards)
+		kinds := []string{}
+		for _, reward := range rewards {
+			kinds = append(kinds, reward.Type)
+		}
+		assert.ElementsMatch(t, want, kinds, query)
+	}
+
+	for _, query := range []string{"password=x", "points=ten", "points[like]=5", "type[gt]=low",
+		"createdAt[gt]=yesterday", "points=2&points[eq]=5", "points=2&points=5"} {
+		rec := s.do(http.MethodGet, "/rewards?"+query, admin, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestRewardPages(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	for _, points := range []string{"3", "1", "10", "3", "1.5"} {
+		rec := s.do(http.MethodPost, "/admin/reward", admin,
+			map[string]interface{}{"type": "high", "points": points, "amountRedeemable": 3, "expiry": 7})
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var seen []string
+	path := "/rewards?limit=2&sort=-points&type=high"
+	for pages := 0; path != ""; pages++ {
+		require.Less(t, pages, 3)
+		rec := s.do(http.MethodGet, path, admin, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var rewards []Reward
+		decode(t, rec, &rewards)
+		for _, reward := range rewards {
+			seen = append(seen, reward.Points.String())
+		}
+		path = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			require.NotEmpty(t, rec.Header().Get(NextCursorHeader))
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	assert.Equal(t, []string{"10", "3", "3", "1.5", "1"}, seen)
+
+	rec := s.do(http.MethodGet, "/rewards?limit=2&sort=points", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	next := rec.Header().Get(NextCursorHeader)
+	require.NotEmpty(t, next)
+	for _, query := range []string{"limit=0", "limit=500", "sort=type", "after=nope", "sort=-points&after=" + next} {
+		rec := s.do(http.MethodGet, "/rewards?"+query, admin, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestGetUserRewardsScopedToCaller(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	ada, adaID := s.signup(t, "ada@example.com")
+	_, bobID := s.signup(t, "bob@example.com")
+	s.grant(t, admin, adaID)
+	s.grant(t, admin, bobID)
+
+	var userRewards []UserReward
+	rec := s.do(http.MethodGet, "/reward?status=open", ada, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	decode(t, rec, &userRewards)
+	require.Len(t, userRewards, 1)
+	assert.Equal(t, adaID, userRewards[0].UserId.Hex())
+
+	rec = s.do(http.MethodGet, "/reward?user_id="+bobID, ada, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &userRewards)
+	assert.Empty(t, userRewards)
+
+	rec = s.do(http.MethodGet, "/reward?user_id[in]="+adaID+","+bobID+"&status=open", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &userRewards)
+	assert.Len(t, userRewards, 2)
+
+	assert.Equal(t, http.StatusBadRequest, s.do(http.MethodGet, "/reward?expiresAt[lt]=soon", admin, nil).Code)
+}
+
+func TestRewardVersionsAndArchive(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	rec := s.do(http.MethodPost, "/admin/reward", admin,
+		map[string]interface{}{"type": "high", "points": 2, "amountRedeemable": 3, "expiry": 7})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rewardID string
+	decode(t, rec, &rewardID)
+	grant := func() UserReward {
+		rec := s.do(http.MethodPost, "/reward/create", admin, map[string]string{"user_id": userID, "reward_id": rewardID})
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var id string
+		decode(t, rec, &id)
+		var userRewards []UserReward
+		decode(t, s.do(http.MethodGet, "/reward?_id="+id, token, nil), &userRewards)
+		require.Len(t, userRewards, 1)
+		return userRewards[0]
+	}
+	old := grant()
+	assert.Equal(t, 1, old.RewardVersion)
+
+	update := map[string]interface{}{"type": "high", "points": 5, "amountRedeemable": 3, "expiry": 7, "version": 1}
+	rec = s.do(http.MethodPut, "/admin/reward/"+rewardID, admin, update)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var reward Reward
+	decode(t, rec, &reward)
+	assert.Equal(t, 2, reward.Version)
+	assert.Equal(t, "5", reward.Points.String())
+	assert.Equal(t, http.StatusConflict, s.do(http.MethodPut, "/admin/reward/"+rewardID, admin, update).Code)
+	assert.Equal(t, http.StatusForbidden, s.do(http.MethodPut, "/admin/reward/"+rewardID, token, update).Code)
+
+	rec = s.do(http.MethodGet, "/rewards/"+rewardID+"?version=1", token, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &reward)
+	assert.Equal(t, "2", reward.Points.String())
+	assert.Equal(t, http.StatusNotFound, s.do(http.MethodGet, "/rewards/"+rewardID+"?version=3", token, nil).Code)
+	assert.Equal(t, 2, grant().RewardVersion)
+
+	// paid out on the terms of version 1
+	rec = s.do(http.MethodPost, "/reward/claim/"+old.ID.Hex(), token, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	transfers := s.transferer.Transfers()
+	require.Len(t, transfers, 1)
+	assert.Equal(t, chain.TokenUnits(big.NewInt(6), chain.FakeDecimals), transfers[0].Amount)
+
+	rec = s.do(http.MethodDelete, "/admin/reward/"+rewardID, admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	decode(t, rec, &reward)
+	assert.False(t, reward.DeletedAt.IsZero())
+	var rewards []Reward
+	rec = s.do(http.MethodGet, "/rewards", token, nil)
+	decode(t, rec, &rewards)
+	assert.Empty(t, rewards)
+	assert.Equal(t, http.StatusForbidden, s.do(http.MethodGet, "/rewards?archived=true", token, nil).Code)
+	rec = s.do(http.MethodGet, "/rewards?archived=true", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &rewards)
+	assert.Len(t, rewards, 1)
+	rec = s.do(http.MethodPost, "/reward/create", admin, map[string]string{"user_id": userID, "reward_id": rewardID})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	update["version"] = 2
+	assert.Equal(t, http.StatusConflict, s.do(http.MethodPut, "/admin/reward/"+rewardID, admin, update).Code)
+	assert.Equal(t, http.StatusOK, s.do(http.MethodGet, "/rewards/"+rewardID, token, nil).Code)
+
+	rec = s.do(http.MethodPost, "/admin/reward/"+rewardID+"/restore", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = s.do(http.MethodGet, "/rewards", token, nil)
+	decode(t, rec, &rewards)
+	assert.Len(t, rewards, 1)
+}
+
+func TestUnsetZeroDeletedAt(t *testing.T) {
+	ctx := context.Background()
+	repo := &MongoRewardRepo{Col: dbiface.NewMemoryCollection()}
+	legacyID, archivedID := primitive.NewObjectID(), primitive.NewObjectID()
+	_, err := repo.Col.InsertOne(ctx, bson.M{"_id": legacyID, "type": "high", "version": 1, "deletedAt": time.Time{}})
+	require.NoError(t, err)
+	_, err = repo.Col.InsertOne(ctx, bson.M{"_id": archivedID, "type": "high", "version": 1, "deletedAt": time.Now()})
+	require.NoError(t, err)
+	unarchived := Filter{{Field: "deletedAt", Op: OpExists, Value: false}}
+	rewards, err := repo.Find(ctx, unarchived, Page{})
+	require.NoError(t, err)
+	assert.Empty(t, rewards)
+
+	require.NoError(t, repo.UnsetZeroDeletedAt(ctx))
+	rewards, err = repo.Find(ctx, unarchived, Page{})
+	require.NoError(t, err)
+	require.Len(t, rewards, 1)
+	assert.Equal(t, legacyID, rewards[0].ID)
+	updated, err := repo.Update(ctx, Reward{ID: legacyID, Type: "low", Version: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 2, updated.Version)
+	archived, err := repo.Archive(ctx, legacyID, time.Now())
+	require.NoError(t, err)
+	assert.False(t, archived.DeletedAt.IsZero())
+	_, err = repo.Update(ctx, Reward{ID: archivedID, Type: "low", Version: 1})
+	assert.Equal(t, ErrConflict, err)
+}
+
+func TestRewardDecimalAmounts(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+
+	// malformed amounts are not parsed, zero amounts and payouts out of range are invalid
+	for _, amounts := range [][2]interface{}{{"-1", 1}, {"ten", 1}, {"1e3", 1}, {"0.0000000000000000001", 1}} {
+		rec := s.do(http.MethodPost, "/admin/reward", admin,
+			map[string]interface{}{"type": "high", "points": amounts[0], "amountRedeemable": amounts[1], "expiry": 7})
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "%v %s", amounts, rec.Body.String())
+	}
+	for _, amounts := range [][2]interface{}{{0, 1}, {"10000000000", "10000000"}, {"0.000000001", "0.0000000001"}} {
+		rec := s.do(http.MethodPost, "/admin/reward", admin,
+			map[string]interface{}{"type": "high", "points": amounts[0], "amountRedeemable": amounts[1], "expiry": 7})
+		assert.Equal(t, http.StatusBadRequest, rec.Code, "%v %s", amounts, rec.Body.String())
+	}
+
+	// 200 points overflowed the int8 points used before
+	rec := s.do(http.MethodPost, "/admin/reward", admin,
+		map[string]interface{}{"type": "high", "points": "200", "amountRedeemable": "0.0125", "expiry": 7})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rewardID string
+	decode(t, rec, &rewardID)
+	rec = s.do(http.MethodGet, "/rewards/"+rewardID, token, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"points":"200","amountRedeemable":"0.0125"`)
+
+	rec = s.do(http.MethodPost, "/reward/create", admin, map[string]string{"user_id": userID, "reward_id": rewardID})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var id string
+	decode(t, rec, &id)
+	rec = s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	transfers := s.transferer.Transfers()
+	require.Len(t, transfers, 1)
+	assert.Equal(t, chain.TokenUnits(big.NewInt(25), chain.FakeDecimals-1), transfers[0].Amount)
+}
+
+func TestRatingsGrantRewards(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	ada, adaID := s.signup(t, "ada@example.com")
+	bob, bobID := s.signup(t, "bob@example.com")
+	carol, _ := s.signup(t, "carol@example.com")
+	rec := s.do(http.MethodPost, "/admin/reward", admin,
+		map[string]interface{}{"type": "high", "points": 2, "amountRedeemable": 3, "expiry": 7})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rewardID string
+	decode(t, rec, &rewardID)
+
+	rec = s.do(http.MethodPost, "/admin/rating-rules", admin, map[string]interface{}{"rewardType": "high", "minCount": 2, "minAverage": 4})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rule RatingRule
+	decode(t, rec, &rule)
+	assert.Equal(t, RatingAverage(400), rule.MinAverage)
+	for _, invalid := range []map[string]interface{}{
+		{"rewardType": "gold", "minCount": 2, "minAverage": 4},
+		{"rewardType": "high", "minCount": 0, "minAverage": 4},
+		{"rewardType": "high", "minCount": 2, "minAverage": 6},
+		{"rewardType": "high", "minCount": 2, "minAverage": 0.5},
+	} {
+		assert.Equal(t, http.StatusBadRequest, s.do(http.MethodPost, "/admin/rating-rules", admin, invalid).Code, "%v", invalid)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, s.do(http.MethodPost, "/admin/rating-rules", admin, map[string]interface{}{
+		"rewardType": "high", "minCount": 2, "minAverage": 4.125}).Code, "averages have at most two decimals")
+	assert.Equal(t, http.StatusForbidden, s.do(http.MethodPost, "/admin/rating-rules", ada, map[string]interface{}{
+		"rewardType": "high", "minCount": 1, "minAverage": 1}).Code)
+
+	granted := func() []UserReward {
+		var userRewards []UserReward
+		decode(t, s.do(http.MethodGet, "/reward", ada, nil), &userRewards)
+		return userRewards
+	}
+	rate := func(token string, body map[string]interface{}) int {
+		return s.do(http.MethodPost, "/ratings", token, body).Code
+	}
+	require.Equal(t, http.StatusCreated, rate(bob, map[string]interface{}{"user_id": adaID, "value": 5}))
+	assert.Equal(t, http.StatusConflict, rate(bob, map[string]interface{}{"user_id": adaID, "value": 1}))
+	assert.Equal(t, http.StatusBadRequest, rate(ada, map[string]interface{}{"user_id": adaID, "value": 5}))
+	assert.Equal(t, http.StatusBadRequest, rate(bob, map[string]interface{}{"user_id": primitive.NewObjectID().Hex(), "value": 5}))
+	assert.Equal(t, http.StatusBadRequest, rate(carol, map[string]interface{}{"user_id": adaID, "value": 6}))
+	assert.Equal(t, http.StatusForbidden, rate(carol, map[string]interface{}{"user_id": adaID, "value": 5, "event": "order-1"}))
+	require.Equal(t, http.StatusCreated, rate(carol, map[string]interface{}{"user_id": adaID, "value": 5}))
+	assert.Empty(t, granted(), "ratings users give each other do not count toward rules")
+
+	require.Equal(t, http.StatusCreated, rate(admin, map[string]interface{}{"user_id": adaID, "value": 5, "event": "order-1"}))
+	assert.Empty(t, granted(), "one system rating is below the minimum count")
+	// an average of exactly 4 reaches the rule
+	require.Equal(t, http.StatusCreated, rate(admin, map[string]interface{}{"user_id": adaID, "value": 3, "event": "order-2"}))
+	userRewards := granted()
+	require.Len(t, userRewards, 1)
+	assert.Equal(t, rewardID, userRewards[0].RewardId.Hex())
+	assert.Equal(t, UserRewardOpen, userRewards[0].Status)
+	assert.Equal(t, grantKey(rule.ID, userRewards[0].UserId), userRewards[0].GrantKey)
+
+	// the rule grants ada once
+	assert.Equal(t, http.StatusConflict, rate(admin, map[string]interface{}{"user_id": adaID, "value": 5, "event": "order-1"}))
+	require.Equal(t, http.StatusCreated, rate(admin, map[string]interface{}{"user_id": adaID, "value": 5, "event": "order-3"}))
+	assert.Len(t, granted(), 1)
+
+	var score Score
+	decode(t, s.do(http.MethodGet, "/users/"+adaID+"/score", bob, nil), &score)
+	assert.Equal(t, int64(5), score.Count)
+	assert.Equal(t, int64(23), score.Total)
+	assert.InDelta(t, 23.0/5, score.Average, 1e-9)
+	assert.Equal(t, int64(3), score.SystemCount)
+	assert.Equal(t, int64(13), score.SystemTotal)
+	decode(t, s.do(http.MethodGet, "/users/"+bobID+"/score", bob, nil), &score)
+	assert.Equal(t, int64(0), score.Count)
+
+	var ratings []Rating
+	decode(t, s.do(http.MethodGet, "/ratings?sort=-value", ada, nil), &ratings)
+	require.Len(t, ratings, 5)
+	assert.Equal(t, 3, ratings[4].Value)
+	decode(t, s.do(http.MethodGet, "/ratings", bob, nil), &ratings)
+	assert.Empty(t, ratings, "users only list the ratings they received")
+	decode(t, s.do(http.MethodGet, "/ratings?source=system&sort=createdAt", admin, nil), &ratings)
+	require.Len(t, ratings, 3)
+	assert.Equal(t, "order-1", ratings[0].Event)
+
+	var rules []RatingRule
+	decode(t, s.do(http.MethodGet, "/admin/rating-rules", admin, nil), &rules)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, http.StatusNoContent, s.do(http.MethodDelete, "/admin/rating-rules/"+rule.ID.Hex(), admin, nil).Code)
+	assert.Equal(t, http.StatusNotFound, s.do(http.MethodDelete, "/admin/rating-rules/"+rule.ID.Hex(), admin, nil).Code)
+}
+
+func TestRatingRuleComparesAveragesExactly(t *testing.T) {
+	for _, c := range []struct {
+		average   string
+		total     int64
+		count     int64
+		satisfied bool
+	}{
+		{"4.6", 23, 5, true},
+		{"4.67", 14, 3, false},
+		{"4.66", 14, 3, true},
+		{"3.3", 33, 10, true},
+		{"3.31", 33, 10, false},
+	} {
+		average, err := ParseRatingAverage(c.average)
+		require.NoError(t, err)
+		assert.Equal(t, c.average, average.String())
+		rule := RatingRule{MinCount: 1, MinAverage: average}
+		assert.Equal(t, c.satisfied, rule.satisfiedBy(Score{SystemCount: c.count, SystemTotal: c.total}), "%+v", c)
+		assert.False(t, rule.satisfiedBy(Score{Count: c.count, Total: c.total}), "ratings by users do not count")
+	}
+	for _, invalid := range []string{"4.125", "-1", "4.", "", "1e2"} {
+		_, err := ParseRatingAverage(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCreateUserRewardsRejectsUnknownReward(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	_, userID := s.signup(t, "ada@example.com")
+
+	rec := s.do(http.MethodPost, "/reward/create", admin,
+		map[string]string{"user_id": userID, "reward_id": primitive.NewObjectID().Hex()})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestClaimReward(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	other, _ := s.signup(t, "bob@example.com")
+	id := s.grant(t, admin, userID)
+
+	assert.Equal(t, http.StatusForbidden, s.do(http.MethodPost, "/reward/claim/"+id, other, nil).Code)
+
+	rec := s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var txHash string
+	decode(t, rec, &txHash)
+
+	transfers := s.transferer.Transfers()
+	require.Len(t, transfers, 1)
+	assert.Equal(t, txHash, transfers[0].TxHash)
+	assert.Equal(t, chain.TokenUnits(big.NewInt(6), chain.FakeDecimals), transfers[0].Amount)
+
+	rec = s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Len(t, s.transferer.Transfers(), 1)
+
+	var transactions []Transaction
+	rec = s.do(http.MethodGet, "/reward/"+id+"/transactions", token, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &transactions)
+	require.Len(t, transactions, 1)
+	assert.Equal(t, TransactionPending, transactions[0].Status)
+	assert.Equal(t, http.StatusForbidden, s.do(http.MethodGet, "/reward/"+id+"/transactions", other, nil).Code)
+}
+
+func TestClaimRewardReplaysIdempotencyKey(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	id := s.grant(t, admin, userID)
+
+	first := s.do(http.MethodPost, "/reward/claim/"+id, token, nil, IdempotencyKeyHeader, "claim-1")
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	second := s.do(http.MethodPost, "/reward/claim/"+id, token, nil, IdempotencyKeyHeader, "claim-1")
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.JSONEq(t, first.Body.String(), second.Body.String())
+	assert.Len(t, s.transferer.Transfers(), 1)
+}
+
+func TestClaimRewardRetriesWhenFeesAboveCap(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	id := s.grant(t, admin, userID)
+
+	s.transferer.Err = fmt.Errorf("%w: base fee too high", chain.ErrFeesAboveCap)
+	rec := s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, claimRetryAfter, rec.Header().Get(echo.HeaderRetryAfter))
+
+	s.transferer.Err = nil
+	rec = s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestClaimRewardHeldWhileTreasuryPaused(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	id := s.grant(t, admin, userID)
+
+	s.transferer.SetBalances(big.NewInt(0), big.NewInt(0))
+	_, err := s.treasury.Run(context.Background())
+	require.NoError(t, err)
+
+	var status TreasuryStatus
+	rec := s.do(http.MethodGet, "/admin/treasury", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &status)
+	assert.True(t, status.Paused)
+
+	rec = s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var tx Transaction
+	decode(t, rec, &tx)
+	assert.Equal(t, TransactionHeld, tx.Status)
+	assert.Empty(t, s.transferer.Transfers())
+
+	s.transferer.SetBalances(new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil), big.NewInt(1e18))
+	released, err := s.treasury.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+	assert.Len(t, s.transferer.Transfers(), 1)
+}
+
+//cancellingTransferer calls onRecorded once a transfer is recorded, before it is sent
+type cancellingTransferer struct {
+	*chain.FakeTransferer
+	onRecorded func()
+}
+
+func (c cancellingTransferer) Transfer(ctx context.Context, to string, amount *big.Int, record chain.Record) (chain.SentTx, error) {
+	return c.FakeTransferer.Transfer(ctx, to, amount, func(ctx context.Context, sent chain.SentTx) error {
+		if err := record(ctx, sent); err != nil {
+			return err
+		}
+		c.onRecorded()
+		return nil
+	})
+}
+
+func TestTreasuryRecordsReleasedTransfersBeforeSending(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	id := s.grant(t, admin, userID)
+
+	s.transferer.SetBalances(big.NewInt(0), big.NewInt(0))
+	_, err := s.treasury.Run(ctx)
+	require.NoError(t, err)
+	rec := s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var held Transaction
+	decode(t, rec, &held)
+
+	// a release that crashed before recording its transfer leaves the payout releasing
+	_, err = s.transactionCol.UpdateOne(ctx, bson.M{"_id": held.ID},
+		bson.M{"$set": bson.M{"status": TransactionReleasing, "updatedAt": time.Now().Add(-time.Hour)}})
+	require.NoError(t, err)
+
+	s.transferer.SetBalances(new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil), big.NewInt(1e18))
+	jobCtx, cancel := context.WithCancel(ctx)
+	var recorded Transaction
+	s.treasury.Transferer = cancellingTransferer{FakeTransferer: s.transferer, onRecorded: func() {
+		require.NoError(t, s.transactionCol.FindOne(ctx, bson.M{"_id": held.ID}).Decode(&recorded))
+		// the job times out while the transfer is sent
+		cancel()
+	}}
+	released, err := s.treasury.Run(jobCtx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+	assert.Equal(t, TransactionPending, recorded.Status, "recorded before it is sent")
+
+	transfers := s.transferer.Transfers()
+	require.Len(t, transfers, 1)
+	assert.Equal(t, transfers[0].TxHash, recorded.TxHash)
+	userRewardID, _ := primitive.ObjectIDFromHex(id)
+	userReward, err := s.userRewardRepo.FindByID(ctx, userRewardID)
+	require.NoError(t, err)
+	assert.Equal(t, recorded.TxHash, userReward.TxHash)
+
+	require.Error(t, jobCtx.Err())
+	ledgerCtx, cancelLedger := ledgerContext(jobCtx)
+	defer cancelLedger()
+	assert.NoError(t, ledgerCtx.Err(), "ledger writes outlive the job")
+}
+
+func TestWatcherReplacesDroppedTransferUnderItsNonce(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	id := s.grant(t, admin, userID)
+	rec := s.do(http.MethodPost, "/reward/claim/"+id, token, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var dropped string
+	decode(t, rec, &dropped)
+	s.transferer.SetReceipt(dropped, chain.Receipt{Status: chain.TxNotFound})
+
+	w := &TransactionWatcher{TransactionCol: s.transactionCol, UserRewardRepo: s.userRewardRepo, Transferer: s.transferer,
+		MaxAttempts: 3}
+	settled, err := w.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), settled)
+
+	transactions, err := findTransactions(ctx, bson.M{}, s.transactionCol)
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	tx := transactions[0]
+	assert.Equal(t, TransactionPending, tx.Status)
+	assert.Equal(t, []string{dropped}, tx.Replaced)
+	transfers := s.transferer.Transfers()
+	require.Len(t, transfers, 2)
+	assert.Equal(t, tx.TxHash, transfers[1].TxHash)
+	assert.Equal(t, transfers[0].Amount, transfers[1].Amount)
+	used, err := s.transferer.NonceUsed(ctx, tx.Nonce)
+	require.NoError(t, err)
+	assert.True(t, used, "the replacement is mined under the nonce of the dropped transfer")
+
+	settled, err = w.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), settled)
+	userRewardID, _ := primitive.ObjectIDFromHex(id)
+	userReward, err := s.userRewardRepo.FindByID(ctx, userRewardID)
+	require.NoError(t, err)
+	assert.Equal(t, UserRewardRedeemed, userReward.Status)
+	assert.Equal(t, tx.TxHash, userReward.TxHash)
+}
+
+func TestBatcherSendsEachPayoutOnce(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	b := &Batcher{TransactionCol: s.transactionCol, Transferer: s.transferer, MaxSize: 2, MaxWait: time.Hour}
+	queue := func(status, txHash string, updatedAt time.Time) Transaction {
+		tx := Transaction{ID: primitive.NewObjectID(), UserRewardId: primitive.NewObjectID(),
+			Wallet: "0x9858EfFD232B4033E47d90003D41EC34EcaEda94", Amount: "5", Status: status, TxHash: txHash, Attempt: 1,
+			CreatedAt: updatedAt, UpdatedAt: updatedAt}
+		_, err := s.transactionCol.InsertOne(ctx, tx)
+		require.NoError(t, err)
+		return tx
+	}
+	queue(TransactionQueued, "", time.Now())
+	queue(TransactionQueued, "", time.Now())
+
+	s.transferer.Err = errors.New("connection refused")
+	_, err := b.Run(ctx)
+	assert.Error(t, err)
+	queued, err := findTransactions(ctx, bson.M{"status": TransactionQueued, "batch_id": bson.M{"$exists": false}}, s.transactionCol)
+	require.NoError(t, err)
+	assert.Len(t, queued, 2, "payouts of a batch that was never signed are queued again")
+
+	s.transferer.Err = nil
+	sent, err := b.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), sent)
+	pending, err := findTransactions(ctx, bson.M{"status": TransactionPending}, s.transactionCol)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, pending[0].TxHash, pending[1].TxHash)
+	assert.Equal(t, pending[0].BatchId, pending[1].BatchId)
+	assert.Len(t, s.transferer.Transfers(), 2)
+
+	// a flush that crashed after signing is handed to the watcher instead of being sent again
+	abandoned := queue(TransactionSending, "0xabandoned", time.Now().Add(-time.Hour))
+	_, err = b.Run(ctx)
+	require.NoError(t, err)
+	recovered, err := findTransactions(ctx, bson.M{"_id": abandoned.ID}, s.transactionCol)
+	require.NoError(t, err)
+	require.Len(t, recovered, 1)
+	assert.Equal(t, TransactionPending, recovered[0].Status)
+	assert.Len(t, s.transferer.Transfers(), 2)
+}
+
+func TestLinkWallet(t *testing.T) {
+	s := newTestServer(t)
+	token, userID := s.signup(t, "ada@example.com")
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+
+	rec := s.do(http.MethodPost, "/wallet/challenge", token, map[string]string{"address": "nope"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = s.do(http.MethodPost, "/wallet/challenge", token, map[string]string{"address": address})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var challenge linkChallenge
+	decode(t, rec, &challenge)
+
+	sign := func(message string) string {
+		sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+		require.NoError(t, err)
+		sig[crypto.RecoveryIDOffset] += 27
+		return hexutil.Encode(sig)
+	}
+	link := map[string]string{"address": address, "nonce": challenge.Nonce, "signature": sign("something else")}
+	rec = s.do(http.MethodPost, "/wallet/link", token, link)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// the failed attempt used up the challenge
+	link["signature"] = sign(challenge.Message)
+	rec = s.do(http.MethodPost, "/wallet/link", token, link)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	used := challenge.Nonce
+	rec = s.do(http.MethodPost, "/wallet/challenge", token, map[string]string{"address": address})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	decode(t, rec, &challenge)
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	require.NoError(t, err)
+	assert.Len(t, nonce, challengeNonceSize)
+	assert.NotEqual(t, used, challenge.Nonce)
+	link = map[string]string{"address": address, "nonce": challenge.Nonce, "signature": sign(challenge.Message)}
+	rec = s.do(http.MethodPost, "/wallet/link", token, link)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	uid, _ := primitive.ObjectIDFromHex(userID)
+	wallet, err := s.walletRepo.FindByUser(context.Background(), uid)
+	require.NoError(t, err)
+	assert.True(t, wallet.External)
+	assert.Equal(t, address, wallet.PublicKey)
+}
+
+//missedReads is a collection whose lookups find nothing, like a check racing with the write it should see
+type missedReads struct {
+	*dbiface.MemoryCollection
+}
+
+func (c missedReads) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+}
+
+func TestLinkExternalConflictsOnUniqueIndex(t *testing.T) {
+	ctx := context.Background()
+	repo := &MongoWalletRepo{Col: missedReads{dbiface.NewMemoryCollection("public_key")}}
+	address := "0x9858EfFD232B4033E47d90003D41EC34EcaEda94"
+
+	_, err := repo.LinkExternal(ctx, primitive.NewObjectID(), address, time.Now())
+	require.NoError(t, err)
+	_, err = repo.LinkExternal(ctx, primitive.NewObjectID(), address, time.Now())
+	assert.True(t, errors.Is(err, ErrConflict), "%v", err)
+}
+
+func TestGetJobs(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+
+	var statuses []scheduler.Status
+	rec := s.do(http.MethodGet, "/admin/jobs", admin, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decode(t, rec, &statuses)
+	assert.Len(t, statuses, 1)
+}
+
+func TestExpireUserRewards(t *testing.T) {
+	s := newTestServer(t)
+	admin, _ := s.login(t, testAdmin)
+	token, userID := s.signup(t, "ada@example.com")
+	id := s.grant(t, admin, userID)
+
+	oid, _ := primitive.ObjectIDFromHex(id)
+	_, err := s.userRewardRepo.Col.UpdateOne(context.Background(), bson.M{"_id": oid},
+		bson.M{"$set": bson.M{"expiresAt": time.Now().Add(-time.Hour)}})
+	require.NoError(t, err)
+	expired, err := ExpireUserRewards(context.Background(), s.userRewardRepo)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), expired)
+	assert.Equal(t, http.StatusConflict, s.do(http.MethodPost, "/reward/claim/"+id, token, nil).Code)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Godtide/rating/dbiface"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/context"
+)
+
+const (
+	//IdempotencyKeyHeader lets clients safely retry non idempotent requests
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	idempotencyProcessing = "processing"
+	idempotencyDone       = "done"
+	maxIdempotencyKeyLen  = 255
+)
+
+//idempotencyRecord stores the outcome of a request made with an Idempotency-Key
+type idempotencyRecord struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"user_id"`
+	Path      string    `bson:"path"`
+	Status    string    `bson:"status"`
+	Code      int       `bson:"code,omitempty"`
+	Body      []byte    `bson:"body,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+//withIdempotency runs fn at most once per user and key, replaying the stored response on retries
+func withIdempotency(c echo.Context, collection dbiface.CollectionAPI, userID, key string, fn func() (int, interface{})) error {
+	ctx := context.Background()
+	if len(key) > maxIdempotencyKeyLen {
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "idempotency key too long"})
+	}
+	record := idempotencyRecord{
+		ID:        userID + ":" + key,
+		UserID:    userID,
+		Path:      c.Request().URL.Path,
+		Status:    idempotencyProcessing,
+		CreatedAt: time.Now(),
+	}
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Errorf("Unable to store idempotency key : %v", err)
+			return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
+		}
+		var stored idempotencyRecord
+		if err = collection.FindOne(ctx, bson.M{"_id": record.ID}).Decode(&stored); err != nil {
+			log.Errorf("Unable to read idempotency key : %v", err)
+			return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to read idempotency key"})
+		}
+		switch {
+		case stored.Path != record.Path:
+			return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "idempotency key was used for another request"})
+		case stored.Status != idempotencyDone:
+			return c.JSON(http.StatusConflict, errorMessage{Message: "request with this idempotency key is in progress"})
+		}
+		return c.JSONBlob(stored.Code, stored.Body)
+	}
+
+	code, res := fn()
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.Errorf("Unable to encode response : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to encode response"})
+	}
+	if code >= http.StatusInternalServerError {
+		// nothing was committed, let the client retry with the same key
+		if _, err = collection.DeleteOne(ctx, bson.M{"_id": record.ID}); err != nil {
+			log.Errorf("Unable to release idempotency key : %v", err)
+		}
+		return c.JSONBlob(code, body)
+	}
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": record.ID},
+		bson.M{"$set": bson.M{"status": idempotencyDone, "code": code, "body": body}})
+	if err != nil {
+		log.Errorf("Unable to store idempotent response : %v", err)
+	}
+	return c.JSONBlob(code, body)
+}
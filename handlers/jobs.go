@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Godtide/rating/scheduler"
+	"github.com/labstack/echo/v4"
+)
+
+//JobsHandler exposes the state of background jobs
+type JobsHandler struct {
+	Scheduler *scheduler.Scheduler
+}
+
+//GetJobs lists background jobs with their last run status
+func (h *JobsHandler) GetJobs(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.Scheduler.Statuses())
+}
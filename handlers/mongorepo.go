@@ -0,0 +1,481 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Godtide/rating/dbiface"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+//MongoUserRepo is a UserRepo on a mongo collection
+type MongoUserRepo struct {
+	Col dbiface.CollectionAPI
+}
+
+//MongoRewardRepo is a RewardRepo on a mongo collection
+type MongoRewardRepo struct {
+	Col dbiface.CollectionAPI
+}
+
+//MongoUserRewardRepo is a UserRewardRepo on a mongo collection
+type MongoUserRewardRepo struct {
+	Col dbiface.CollectionAPI
+}
+
+//MongoWalletRepo is a WalletRepo on a mongo collection
+type MongoWalletRepo struct {
+	Col dbiface.CollectionAPI
+}
+
+//MongoRatingRepo is a RatingRepo on a mongo collection of ratings and one of scores keyed by user id
+type MongoRatingRepo struct {
+	Col      dbiface.CollectionAPI
+	ScoreCol dbiface.CollectionAPI
+}
+
+//MongoRatingRuleRepo is a RatingRuleRepo on a mongo collection
+type MongoRatingRuleRepo struct {
+	Col dbiface.CollectionAPI
+}
+
+//MongoTransactor is a Transactor on mongo session transactions, they need a replica set or mongos
+type MongoTransactor struct {
+	Client *mongo.Client
+}
+
+//illegalOperation is the code standalone servers answer transactions with
+const illegalOperation = 20
+
+//WithTransaction runs fn in a session transaction, retrying it on transient errors
+func (t *MongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := t.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(illegalOperation) {
+		return fmt.Errorf("%w: %v", ErrNoTransactions, err)
+	}
+	return err
+}
+
+//mongoError maps driver errors to the repository errors
+func mongoError(err error) error {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+//mongoFilter turns filter into a query after checking it against fs, whose names are the bson field names
+func mongoFilter(filter Filter, fs fields) (bson.M, error) {
+	if err := fs.check(filter); err != nil {
+		return nil, err
+	}
+	query := bson.M{}
+	var and []bson.M
+	for _, cond := range filter {
+		op, value := "$"+string(cond.Op), cond.Value
+		if cond.Op == OpIn {
+			value = primitive.A(cond.Value.([]interface{}))
+		}
+		ops, ok := query[cond.Field].(bson.M)
+		if !ok {
+			ops = bson.M{}
+			query[cond.Field] = ops
+		}
+		if _, taken := ops[op]; taken {
+			// the same comparison twice, both have to hold
+			and = append(and, bson.M{cond.Field: bson.M{op: value}})
+			continue
+		}
+		ops[op] = value
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	return query, nil
+}
+
+//mongoPage adds the range of page to query and returns the order and limit of page
+func mongoPage(query bson.M, page Page) *options.FindOptions {
+	field, dir, op := page.SortField(), 1, "$gt"
+	if page.Desc {
+		dir, op = -1, "$lt"
+	}
+	opts := options.Find().SetSort(bson.D{{Key: field, Value: dir}, {Key: "_id", Value: dir}})
+	if field == "_id" {
+		opts.SetSort(bson.D{{Key: "_id", Value: dir}})
+	}
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+	if page.After != nil {
+		past := bson.M{"_id": bson.M{op: page.After.ID}}
+		if field != "_id" {
+			past = bson.M{"$or": []bson.M{
+				{field: bson.M{op: page.After.Value}},
+				{field: page.After.Value, "_id": bson.M{op: page.After.ID}},
+			}}
+		}
+		and, _ := query["$and"].([]bson.M)
+		query["$and"] = append(and, past)
+	}
+	return opts
+}
+
+func findAll(ctx context.Context, col dbiface.CollectionAPI, filter Filter, page Page, fs fields, results interface{}) error {
+	if _, ok := fs[page.SortField()]; !ok {
+		return fmt.Errorf("%w: cannot sort on %s", ErrInvalidFilter, page.Sort)
+	}
+	query, err := mongoFilter(filter, fs)
+	if err != nil {
+		return err
+	}
+	cursor, err := col.Find(ctx, query, mongoPage(query, page))
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+//Create inserts the user with a new id
+func (r *MongoUserRepo) Create(ctx context.Context, user User) (User, error) {
+	user.ID = primitive.NewObjectID()
+	if _, err := r.Col.InsertOne(ctx, user); err != nil {
+		return User{}, mongoError(err)
+	}
+	return user, nil
+}
+
+//FindByID returns the user with id
+func (r *MongoUserRepo) FindByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	var user User
+	err := r.Col.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	return user, mongoError(err)
+}
+
+//FindByUsername returns the user registered under username
+func (r *MongoUserRepo) FindByUsername(ctx context.Context, username string) (User, error) {
+	var user User
+	err := r.Col.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	return user, mongoError(err)
+}
+
+//SetAdmin grants or revokes the admin role
+func (r *MongoUserRepo) SetAdmin(ctx context.Context, id primitive.ObjectID, admin bool) error {
+	res, err := r.Col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"isadmin": admin}})
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//Find returns the users matching filter
+func (r *MongoUserRepo) Find(ctx context.Context, filter Filter, page Page) ([]User, error) {
+	users := []User{}
+	err := findAll(ctx, r.Col, filter, page, userFields, &users)
+	return users, err
+}
+
+//Delete removes the user with id
+func (r *MongoUserRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.Col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//Create inserts the reward with a new id
+func (r *MongoRewardRepo) Create(ctx context.Context, reward Reward) (Reward, error) {
+	reward.ID = primitive.NewObjectID()
+	if _, err := r.Col.InsertOne(ctx, reward); err != nil {
+		return Reward{}, mongoError(err)
+	}
+	return reward, nil
+}
+
+//FindByID returns the reward with id
+func (r *MongoRewardRepo) FindByID(ctx context.Context, id primitive.ObjectID) (Reward, error) {
+	var reward Reward
+	err := r.Col.FindOne(ctx, bson.M{"_id": id}).Decode(&reward)
+	return reward, mongoError(err)
+}
+
+//FindVersion returns the reward with the terms of version
+func (r *MongoRewardRepo) FindVersion(ctx context.Context, id primitive.ObjectID, version int) (Reward, error) {
+	reward, err := r.FindByID(ctx, id)
+	if err != nil {
+		return Reward{}, err
+	}
+	reward, ok := reward.AtVersion(version)
+	if !ok {
+		return Reward{}, ErrNotFound
+	}
+	return reward, nil
+}
+
+//Update replaces the terms of the reward if it is still unarchived at reward.Version, pushing its previous terms
+func (r *MongoRewardRepo) Update(ctx context.Context, reward Reward) (Reward, error) {
+	current, err := r.FindByID(ctx, reward.ID)
+	if err != nil {
+		return Reward{}, err
+	}
+	if current.Version != reward.Version || !current.DeletedAt.IsZero() {
+		return Reward{}, ErrConflict
+	}
+	var updated Reward
+	err = r.Col.FindOneAndUpdate(ctx,
+		bson.M{"_id": reward.ID, "version": reward.Version, "deletedAt": bson.M{"$exists": false}},
+		bson.M{
+			"$set": bson.M{"type": reward.Type, "points": reward.Points, "amountRedeemable": reward.AmountRedeemable,
+				"expiry": reward.Expiry, "updatedAt": reward.UpdatedAt},
+			"$inc":  bson.M{"version": 1},
+			"$push": bson.M{"versions": current.Terms()},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		// changed in between
+		return Reward{}, ErrConflict
+	}
+	return updated, mongoError(err)
+}
+
+//Archive sets deletedAt unless it is set already
+func (r *MongoRewardRepo) Archive(ctx context.Context, id primitive.ObjectID, at time.Time) (Reward, error) {
+	_, err := r.Col.UpdateOne(ctx, bson.M{"_id": id, "deletedAt": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"deletedAt": at}})
+	if err != nil {
+		return Reward{}, mongoError(err)
+	}
+	return r.FindByID(ctx, id)
+}
+
+//Restore unsets deletedAt
+func (r *MongoRewardRepo) Restore(ctx context.Context, id primitive.ObjectID) (Reward, error) {
+	if _, err := r.Col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"deletedAt": ""}}); err != nil {
+		return Reward{}, mongoError(err)
+	}
+	return r.FindByID(ctx, id)
+}
+
+//UnsetZeroDeletedAt unarchives the rewards stored with a zero deletedAt before its tag omitted it
+func (r *MongoRewardRepo) UnsetZeroDeletedAt(ctx context.Context) error {
+	_, err := r.Col.UpdateMany(ctx, bson.M{"deletedAt": bson.M{"$lte": time.Unix(0, 0)}}, bson.M{"$unset": bson.M{"deletedAt": ""}})
+	return mongoError(err)
+}
+
+//Find returns the rewards matching filter
+func (r *MongoRewardRepo) Find(ctx context.Context, filter Filter, page Page) ([]Reward, error) {
+	rewards := []Reward{}
+	err := findAll(ctx, r.Col, filter, page, rewardFields, &rewards)
+	return rewards, err
+}
+
+//Create inserts the userReward with a new id
+func (r *MongoUserRewardRepo) Create(ctx context.Context, userReward UserReward) (UserReward, error) {
+	userReward.ID = primitive.NewObjectID()
+	if _, err := r.Col.InsertOne(ctx, userReward); err != nil {
+		return UserReward{}, mongoError(err)
+	}
+	return userReward, nil
+}
+
+//FindByID returns the userReward with id
+func (r *MongoUserRewardRepo) FindByID(ctx context.Context, id primitive.ObjectID) (UserReward, error) {
+	var userReward UserReward
+	err := r.Col.FindOne(ctx, bson.M{"_id": id}).Decode(&userReward)
+	return userReward, mongoError(err)
+}
+
+//Find returns the userRewards matching filter
+func (r *MongoUserRewardRepo) Find(ctx context.Context, filter Filter, page Page) ([]UserReward, error) {
+	userRewards := []UserReward{}
+	err := findAll(ctx, r.Col, filter, page, userRewardFields, &userRewards)
+	return userRewards, err
+}
+
+//Transition atomically moves the userReward, claims also require it to be unexpired
+func (r *MongoUserRewardRepo) Transition(ctx context.Context, id primitive.ObjectID, change StatusChange, txHash string) (bool, error) {
+	filter := bson.M{"_id": id, "status": change.From}
+	if change.To == UserRewardClaiming {
+		filter["expiresAt"] = bson.M{"$gt": change.At}
+	}
+	fields := bson.M{"status": change.To}
+	if txHash != "" {
+		fields["txHash"] = txHash
+	}
+	update := bson.M{
+		"$set":  fields,
+		"$push": bson.M{"history": change},
+	}
+	res, err := r.Col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, mongoError(err)
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+//SetTxHash records the transaction currently paying out the userReward
+func (r *MongoUserRewardRepo) SetTxHash(ctx context.Context, id primitive.ObjectID, txHash string) error {
+	_, err := r.Col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"txHash": txHash}})
+	return mongoError(err)
+}
+
+//Expire moves open and failed userRewards past their expiresAt to expired
+func (r *MongoUserRewardRepo) Expire(ctx context.Context, now time.Time) (int64, error) {
+	var expired int64
+	for _, from := range []string{UserRewardOpen, UserRewardFailed} {
+		filter := bson.M{"status": from, "expiresAt": bson.M{"$lte": now}}
+		update := bson.M{
+			"$set": bson.M{"status": UserRewardExpired},
+			"$push": bson.M{"history": StatusChange{
+				From:   from,
+				To:     UserRewardExpired,
+				At:     now,
+				Reason: "expired by scheduler",
+			}},
+		}
+		res, err := r.Col.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return expired, mongoError(err)
+		}
+		expired += res.ModifiedCount
+	}
+	return expired, nil
+}
+
+//Delete removes the userReward with id
+func (r *MongoUserRewardRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.Col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//Create inserts the wallet with a new id
+func (r *MongoWalletRepo) Create(ctx context.Context, wallet Wallet) (Wallet, error) {
+	wallet.ID = primitive.NewObjectID()
+	if _, err := r.Col.InsertOne(ctx, wallet); err != nil {
+		return Wallet{}, mongoError(err)
+	}
+	return wallet, nil
+}
+
+//FindByUser returns the external wallet of the user if one is linked, else the custodial one
+func (r *MongoWalletRepo) FindByUser(ctx context.Context, userID primitive.ObjectID) (Wallet, error) {
+	var wallet Wallet
+	opts := options.FindOne().SetSort(bson.M{"external": -1})
+	err := r.Col.FindOne(ctx, bson.M{"user_id": userID}, opts).Decode(&wallet)
+	return wallet, mongoError(err)
+}
+
+//LinkExternal upserts the external wallet of the user
+func (r *MongoWalletRepo) LinkExternal(ctx context.Context, userID primitive.ObjectID, address string, at time.Time) (Wallet, error) {
+	var other Wallet
+	err := r.Col.FindOne(ctx, bson.M{"public_key": address, "user_id": bson.M{"$ne": userID}}).Decode(&other)
+	if err == nil {
+		return Wallet{}, ErrConflict
+	}
+	if err != mongo.ErrNoDocuments {
+		return Wallet{}, err
+	}
+	_, err = r.Col.UpdateOne(ctx, bson.M{"user_id": userID, "external": true},
+		bson.M{"$set": bson.M{"public_key": address, "linkedAt": at}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return Wallet{}, mongoError(err)
+	}
+	return Wallet{UserId: userID, PublicKey: address, External: true, LinkedAt: at}, nil
+}
+
+//Create inserts the rating with a new id, then adds it to the score of the rated user. The rating is
+//deleted again when the score cannot be updated, so it is never left out of the score
+func (r *MongoRatingRepo) Create(ctx context.Context, rating Rating) (Rating, Score, error) {
+	rating.ID = primitive.NewObjectID()
+	if _, err := r.Col.InsertOne(ctx, rating); err != nil {
+		return Rating{}, Score{}, mongoError(err)
+	}
+	var score Score
+	inc := bson.M{"count": 1, "total": rating.Value, "systemCount": 0, "systemTotal": 0}
+	if rating.Source == RatingBySystem {
+		inc["systemCount"], inc["systemTotal"] = 1, rating.Value
+	}
+	err := r.ScoreCol.FindOneAndUpdate(ctx, bson.M{"_id": rating.UserId},
+		bson.M{"$inc": inc, "$max": bson.M{"updatedAt": rating.CreatedAt}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&score)
+	if err != nil {
+		if _, delErr := r.Col.DeleteOne(ctx, bson.M{"_id": rating.ID}); delErr != nil {
+			return Rating{}, Score{}, fmt.Errorf("%v, and the rating %s left out of the score: %v", err, rating.ID.Hex(), delErr)
+		}
+		return Rating{}, Score{}, mongoError(err)
+	}
+	return rating, score, nil
+}
+
+//Find returns the ratings matching filter
+func (r *MongoRatingRepo) Find(ctx context.Context, filter Filter, page Page) ([]Rating, error) {
+	ratings := []Rating{}
+	err := findAll(ctx, r.Col, filter, page, ratingFields, &ratings)
+	return ratings, err
+}
+
+//Score returns the score of the user
+func (r *MongoRatingRepo) Score(ctx context.Context, userID primitive.ObjectID) (Score, error) {
+	score := Score{UserId: userID}
+	err := r.ScoreCol.FindOne(ctx, bson.M{"_id": userID}).Decode(&score)
+	if err == mongo.ErrNoDocuments {
+		return score, nil
+	}
+	return score, mongoError(err)
+}
+
+//Create inserts the rule with a new id
+func (r *MongoRatingRuleRepo) Create(ctx context.Context, rule RatingRule) (RatingRule, error) {
+	rule.ID = primitive.NewObjectID()
+	if _, err := r.Col.InsertOne(ctx, rule); err != nil {
+		return RatingRule{}, mongoError(err)
+	}
+	return rule, nil
+}
+
+//Find returns the rules matching filter
+func (r *MongoRatingRuleRepo) Find(ctx context.Context, filter Filter, page Page) ([]RatingRule, error) {
+	rules := []RatingRule{}
+	err := findAll(ctx, r.Col, filter, page, ratingRuleFields, &rules)
+	return rules, err
+}
+
+//Delete removes the rule with id
+func (r *MongoRatingRuleRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.Col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return mongoError(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+	//NextCursorHeader carries the after parameter of the next page of a listing
+	NextCursorHeader = "X-Next-Cursor"
+)
+
+//pageParams are the query parameters of pagination, they are not filters
+var pageParams = map[string]bool{"limit": true, "after": true, "sort": true}
+
+//Page selects a slice of a listing ordered by Sort then _id, the zero Page lists every record by _id
+type Page struct {
+	Limit int    //at most Limit records, all of them when 0
+	Sort  string //json field name, _id when empty
+	Desc  bool
+	After *Cursor //only records past it
+}
+
+//Cursor is the position of a record in a listing, the value of its sort field and its id
+type Cursor struct {
+	Value interface{}
+	ID    primitive.ObjectID
+}
+
+//SortField returns the field p is ordered by
+func (p Page) SortField() string {
+	if p.Sort == "" {
+		return "_id"
+	}
+	return p.Sort
+}
+
+//cursorToken is the opaque after parameter, it is only valid for the sort it was issued for
+type cursorToken struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func (p Page) sortParam() string {
+	if p.Desc {
+		return "-" + p.SortField()
+	}
+	return p.SortField()
+}
+
+//parsePage reads limit, sort and after from query parameters. sort is a field of sorts, descending
+//when prefixed with -, after is the cursor a previous page of the same sort returned
+func parsePage(q url.Values, fs fields, sorts []string) (Page, error) {
+	page := Page{Limit: defaultPageLimit}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidFilter, maxPageLimit)
+		}
+		page.Limit = limit
+	}
+	if s := q.Get("sort"); s != "" {
+		page.Sort, page.Desc = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		sortable := false
+		for _, field := range sorts {
+			sortable = sortable || field == page.Sort
+		}
+		if !sortable {
+			return page, fmt.Errorf("%w: cannot sort on %s", ErrInvalidFilter, page.Sort)
+		}
+	}
+	if s := q.Get("after"); s != "" {
+		var token cursorToken
+		raw, err := base64.RawURLEncoding.DecodeString(s)
+		if err == nil {
+			err = json.Unmarshal(raw, &token)
+		}
+		if err != nil || token.Sort != page.sortParam() {
+			return page, fmt.Errorf("%w: after is not a cursor of this listing", ErrInvalidFilter)
+		}
+		id, err := primitive.ObjectIDFromHex(token.ID)
+		if err != nil {
+			return page, fmt.Errorf("%w: after is not a cursor of this listing", ErrInvalidFilter)
+		}
+		value, err := parseValue(fs[page.SortField()], token.Value)
+		if err != nil {
+			return page, fmt.Errorf("%w: after is not a cursor of this listing", ErrInvalidFilter)
+		}
+		page.After = &Cursor{Value: value, ID: id}
+	}
+	return page, nil
+}
+
+//more asks for one record past the page, telling whether a next page exists
+func (p Page) more() Page {
+	p.Limit++
+	return p
+}
+
+//next returns the after parameter of the page following the record at value and id
+func (p Page) next(value interface{}, id primitive.ObjectID) string {
+	token := cursorToken{Sort: p.sortParam(), ID: id.Hex()}
+	switch v := value.(type) {
+	case time.Time:
+		token.Value = v.UTC().Format(time.RFC3339Nano)
+	case int64:
+		token.Value = strconv.FormatInt(v, 10)
+	case primitive.ObjectID:
+		token.Value = v.Hex()
+	default:
+		token.Value = fmt.Sprint(v)
+	}
+	raw, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+//setNextPage points the Link and X-Next-Cursor headers at the page following the current one
+func setNextPage(c echo.Context, next string) {
+	if next == "" {
+		return
+	}
+	u := *c.Request().URL
+	q := u.Query()
+	q.Set("after", next)
+	u.RawQuery = q.Encode()
+	c.Response().Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+	c.Response().Header().Set(NextCursorHeader, next)
+}
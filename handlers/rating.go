@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+)
+
+const (
+	//RatingByUser a rating one user gave another
+	RatingByUser = "user"
+	//RatingBySystem a rating an admin submitted for a system event, such as a completed order
+	RatingBySystem = "system"
+)
+
+//Rating rates a user from 1 to 5, the ratings of a user add up to their Score
+type Rating struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	UserId    primitive.ObjectID `json:"user_id" bson:"user_id"`                       //the rated user
+	RaterId   primitive.ObjectID `json:"rater_id,omitempty" bson:"rater_id,omitempty"` //the rating user, unset for system events
+	Source    string             `json:"source" bson:"source"`                         //user, system
+	Event     string             `json:"event,omitempty" bson:"event,omitempty"`       //the system event rated on
+	Value     int                `json:"value" bson:"value"`
+	Comment   string             `json:"comment,omitempty" bson:"comment,omitempty"`
+	Key       string             `json:"-" bson:"key"` //unique, a user rates another once and an event rates a user once
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+//ratingKey is the Key of a rating, by the rater or for the event when there is no rater
+func ratingKey(rating Rating) string {
+	if rating.Source == RatingBySystem {
+		return "system:" + rating.Event + ":" + rating.UserId.Hex()
+	}
+	return "user:" + rating.RaterId.Hex() + ":" + rating.UserId.Hex()
+}
+
+//Score sums up the ratings of a user
+type Score struct {
+	UserId      primitive.ObjectID `json:"user_id" bson:"_id"`
+	Count       int64              `json:"count" bson:"count"`
+	Total       int64              `json:"total" bson:"total"` //sum of the rating values
+	Average     float64            `json:"average" bson:"-"`
+	SystemCount int64              `json:"systemCount" bson:"systemCount"` //ratings on system events, rating rules go by those alone
+	SystemTotal int64              `json:"systemTotal" bson:"systemTotal"` //sum of the values of the ratings on system events
+	UpdatedAt   time.Time          `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+func (s Score) averaged() Score {
+	if s.Count > 0 {
+		s.Average = float64(s.Total) / float64(s.Count)
+	}
+	return s
+}
+
+//ratingRequest is the payload rating a user, admins set Event to rate on a system event instead of as themselves
+type ratingRequest struct {
+	UserId  primitive.ObjectID `json:"user_id" validate:"required"`
+	Value   int                `json:"value" validate:"required,min=1,max=5"`
+	Comment string             `json:"comment" validate:"max=500"`
+	Event   string             `json:"event" validate:"max=200"`
+}
+
+//RatingHandler takes ratings and applies the rating rules to the scores they change
+type RatingHandler struct {
+	RatingRepo     RatingRepo
+	RuleRepo       RatingRuleRepo
+	UserRepo       UserRepo
+	RewardRepo     RewardRepo
+	UserRewardRepo UserRewardRepo
+}
+
+//CreateRating rates a user once per rater, or once per system event for admins, and grants the rewards
+//of the rating rules the new score of the user satisfies
+func (h *RatingHandler) CreateRating(c echo.Context) error {
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	var req ratingRequest
+	c.Echo().Validator = &ratingValidator{validator: v}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind : %v", err)
+		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse request payload"})
+	}
+	if err := c.Validate(req); err != nil {
+		log.Errorf("Unable to validate the rating %+v %v", req, err)
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
+	}
+	rating := Rating{UserId: req.UserId, Source: RatingByUser, Value: req.Value, Comment: req.Comment, CreatedAt: time.Now()}
+	if req.Event != "" {
+		if !claims.IsAdmin {
+			return c.JSON(http.StatusForbidden, errorMessage{Message: "only admins rate on system events"})
+		}
+		rating.Source, rating.Event = RatingBySystem, req.Event
+	} else {
+		raterID, err := primitive.ObjectIDFromHex(claims.UserID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+		}
+		if raterID == req.UserId {
+			return c.JSON(http.StatusBadRequest, errorMessage{Message: "users cannot rate themselves"})
+		}
+		rating.RaterId = raterID
+	}
+	rating.Key = ratingKey(rating)
+
+	ctx := context.Background()
+	if _, err := h.UserRepo.FindByID(ctx, req.UserId); err != nil {
+		log.Errorf("Unable to find the rated user %s : %v", req.UserId.Hex(), err)
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unknown user"})
+	}
+	rating, score, err := h.RatingRepo.Create(ctx, rating)
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, errorMessage{Message: "user already rated"})
+	}
+	if err != nil {
+		log.Errorf("Unable to insert the rating : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
+	}
+	applyRatingRules(ctx, score, h.RuleRepo, h.RewardRepo, h.UserRewardRepo)
+	return c.JSON(http.StatusCreated, rating)
+}
+
+//ratingSorts are the fields GET /ratings may sort on
+var ratingSorts = []string{"_id", "createdAt", "value"}
+
+func ratingSortValue(rating Rating, field string) interface{} {
+	switch field {
+	case "createdAt":
+		return rating.CreatedAt
+	case "value":
+		return int64(rating.Value)
+	}
+	return rating.ID
+}
+
+//findRatings returns a page of the ratings matching q and the cursor of the next page, if any.
+//scope is added to the conditions of q
+func findRatings(ctx context.Context, q url.Values, scope Filter, repo RatingRepo) ([]Rating, string, *echo.HTTPError) {
+	ratings, next := []Rating{}, ""
+	filter, err := parseFilter(q, ratingFields)
+	var page Page
+	if err == nil {
+		page, err = parsePage(q, ratingFields, ratingSorts)
+	}
+	if err == nil {
+		ratings, err = repo.Find(ctx, append(filter, scope...), page.more())
+	}
+	if errors.Is(err, ErrInvalidFilter) {
+		log.Errorf("Unable to filter the ratings : %v", err)
+		return ratings, next,
+			echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: err.Error()})
+	}
+	if err != nil {
+		log.Errorf("Unable to find the ratings : %v", err)
+		return ratings, next,
+			echo.NewHTTPError(http.StatusNotFound, errorMessage{Message: "unable to find the ratings"})
+	}
+	if len(ratings) > page.Limit {
+		ratings = ratings[:page.Limit]
+		last := ratings[page.Limit-1]
+		next = page.next(ratingSortValue(last, page.SortField()), last.ID)
+	}
+	return ratings, next, nil
+}
+
+//GetRatings lists a page of ratings, users other than admins only see the ratings they received
+func (h *RatingHandler) GetRatings(c echo.Context) error {
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	var scope Filter
+	if !claims.IsAdmin {
+		userID, err := primitive.ObjectIDFromHex(claims.UserID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+		}
+		scope = Filter{Eq("user_id", userID)}
+	}
+	ratings, next, httpError := findRatings(context.Background(), c.QueryParams(), scope, h.RatingRepo)
+	if httpError != nil {
+		return c.JSON(httpError.Code, httpError.Message)
+	}
+	setNextPage(c, next)
+	return c.JSON(http.StatusOK, ratings)
+}
+
+//GetScore gets the score of a user, a zero score when nobody rated them yet
+func (h *RatingHandler) GetScore(c echo.Context) error {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		log.Errorf("Unable to convert to Object ID : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
+	}
+	score, err := h.RatingRepo.Score(context.Background(), userID)
+	if err != nil {
+		log.Errorf("Unable to find the score of user %s : %v", userID.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to find the score"})
+	}
+	return c.JSON(http.StatusOK, score.averaged())
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+)
+
+//RatingAverage is an average rating with at most two decimals such as 4.25, kept exactly in hundredths
+type RatingAverage int64
+
+var averagePattern = regexp.MustCompile(`^([0-9]{1,9})(?:\.([0-9]{1,2}))?$`)
+
+//ParseRatingAverage reads a decimal such as "4.25"
+func ParseRatingAverage(s string) (RatingAverage, error) {
+	m := averagePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("%q is not an average with at most two decimals", s)
+	}
+	whole, _ := strconv.ParseInt(m[1], 10, 64)
+	hundredths, _ := strconv.ParseInt((m[2] + "00")[:2], 10, 64)
+	return RatingAverage(whole*100 + hundredths), nil
+}
+
+//String writes the average without trailing zeros, such as "4.5"
+func (a RatingAverage) String() string {
+	s := fmt.Sprintf("%d.%02d", a/100, a%100)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+//MarshalJSON writes the average as a number
+func (a RatingAverage) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+//UnmarshalJSON reads a number or a string
+func (a *RatingAverage) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	average, err := ParseRatingAverage(s)
+	if err != nil {
+		return err
+	}
+	*a = average
+	return nil
+}
+
+//RatingRule grants a reward of RewardType to every user whose score reaches MinCount ratings on system events
+//averaging MinAverage or more, once per user
+type RatingRule struct {
+	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	RewardType string             `json:"rewardType" bson:"rewardType" validate:"required"` //high, medium, low
+	MinCount   int64              `json:"minCount" bson:"minCount" validate:"required,min=1"`
+	MinAverage RatingAverage      `json:"minAverage" bson:"minAverageHundredths" validate:"min=100,max=500"` //1 to 5
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+//satisfiedBy tells whether the system ratings of score reach the thresholds of the rule. Ratings users give
+//each other do not count, anyone can sign up raters to pay themselves out. The average is compared exactly
+func (r RatingRule) satisfiedBy(score Score) bool {
+	return score.SystemCount >= r.MinCount && score.SystemTotal*100 >= int64(r.MinAverage)*score.SystemCount
+}
+
+//grantKey is the GrantKey of the userReward rule grants to userID, it is unique so a rule grants a user once
+func grantKey(ruleID, userID primitive.ObjectID) string {
+	return "rule:" + ruleID.Hex() + ":" + userID.Hex()
+}
+
+//rewardOfType returns the newest unarchived reward of rewardType, ErrNotFound when there is none
+func rewardOfType(ctx context.Context, rewardType string, repo RewardRepo) (Reward, error) {
+	rewards, err := repo.Find(ctx, Filter{Eq("type", rewardType), {Field: "deletedAt", Op: OpExists, Value: false}},
+		Page{Limit: 1, Sort: "createdAt", Desc: true})
+	if err != nil {
+		return Reward{}, err
+	}
+	if len(rewards) == 0 {
+		return Reward{}, ErrNotFound
+	}
+	return rewards[0], nil
+}
+
+//applyRatingRules grants the rewards of the rules score satisfies that did not grant its user yet and returns
+//the userRewards created. Failures are logged, the rule is applied again on the next rating of the user
+func applyRatingRules(ctx context.Context, score Score, rules RatingRuleRepo, rewards RewardRepo, userRewards UserRewardRepo) []UserReward {
+	all, err := rules.Find(ctx, Filter{}, Page{})
+	if err != nil {
+		log.Errorf("Unable to find the rating rules : %v", err)
+		return nil
+	}
+	var granted []UserReward
+	for _, rule := range all {
+		if !rule.satisfiedBy(score) {
+			continue
+		}
+		reward, err := rewardOfType(ctx, rule.RewardType, rewards)
+		if err != nil {
+			log.Errorf("Rating rule %s has no %s reward to grant : %v", rule.ID.Hex(), rule.RewardType, err)
+			continue
+		}
+		userReward := openUserReward(UserReward{UserId: score.UserId, GrantKey: grantKey(rule.ID, score.UserId)}, reward)
+		userReward, err = userRewards.Create(ctx, userReward)
+		if errors.Is(err, ErrConflict) {
+			// granted on an earlier rating
+			continue
+		}
+		if err != nil {
+			log.Errorf("Unable to grant the reward of rating rule %s to user %s : %v", rule.ID.Hex(), score.UserId.Hex(), err)
+			continue
+		}
+		log.Infof("Rating rule %s granted reward %s to user %s", rule.ID.Hex(), reward.ID.Hex(), score.UserId.Hex())
+		granted = append(granted, userReward)
+	}
+	return granted
+}
+
+//CreateRatingRule adds a rule, there has to be an unarchived reward of its type. It applies from the next
+//rating of each user on
+func (h *RatingHandler) CreateRatingRule(c echo.Context) error {
+	var rule RatingRule
+	c.Echo().Validator = &ratingValidator{validator: v}
+	if err := c.Bind(&rule); err != nil {
+		log.Errorf("Unable to bind : %v", err)
+		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse request payload"})
+	}
+	if err := c.Validate(rule); err != nil {
+		log.Errorf("Unable to validate the rating rule %+v %v", rule, err)
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
+	}
+	ctx := context.Background()
+	if _, err := rewardOfType(ctx, rule.RewardType, h.RewardRepo); err != nil {
+		log.Errorf("No reward of type %s : %v", rule.RewardType, err)
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "no reward of this type"})
+	}
+	rule.CreatedAt = time.Now()
+	rule, err := h.RuleRepo.Create(ctx, rule)
+	if err != nil {
+		log.Errorf("Unable to insert the rating rule : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
+	}
+	return c.JSON(http.StatusCreated, rule)
+}
+
+//GetRatingRules lists every rating rule
+func (h *RatingHandler) GetRatingRules(c echo.Context) error {
+	rules, err := h.RuleRepo.Find(context.Background(), Filter{}, Page{})
+	if err != nil {
+		log.Errorf("Unable to find the rating rules : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to find the rating rules"})
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+//DeleteRatingRule removes a rule, the userRewards it granted are kept
+func (h *RatingHandler) DeleteRatingRule(c echo.Context) error {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		log.Errorf("Unable to convert to Object ID : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
+	}
+	err = h.RuleRepo.Delete(context.Background(), id)
+	if errors.Is(err, ErrNotFound) {
+		return c.JSON(http.StatusNotFound, errorMessage{Message: "unable to find the rating rule"})
+	}
+	if err != nil {
+		log.Errorf("Unable to delete rating rule %s : %v", id.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to delete the rating rule"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+)
+
+var (
+	//ErrNotFound is returned by repositories when nothing matches
+	ErrNotFound = errors.New("not found")
+	//ErrConflict is returned by repositories when a write collides with existing data
+	ErrConflict = errors.New("conflict")
+	//ErrInvalidFilter is returned by repositories for filters or pages they cannot apply
+	ErrInvalidFilter = errors.New("invalid filter")
+	//ErrNoTransactions is returned by a Transactor whose database cannot run transactions
+	ErrNoTransactions = errors.New("transactions not supported")
+)
+
+//Transactor runs fn in a database transaction, repository calls made with the ctx passed to fn
+//take part in it and are rolled back when fn returns an error
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+//UserRepo stores users
+type UserRepo interface {
+	//Create stores a new user, ErrConflict when the username is taken
+	Create(ctx context.Context, user User) (User, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (User, error)
+	FindByUsername(ctx context.Context, username string) (User, error)
+	//Find returns the users matching filter in the order and range of page
+	Find(ctx context.Context, filter Filter, page Page) ([]User, error)
+	SetAdmin(ctx context.Context, id primitive.ObjectID, admin bool) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+//RewardRepo stores the reward types admins create
+type RewardRepo interface {
+	Create(ctx context.Context, reward Reward) (Reward, error)
+	//FindByID returns the reward with its current terms, archived or not
+	FindByID(ctx context.Context, id primitive.ObjectID) (Reward, error)
+	//FindVersion returns the reward with the terms of version, ErrNotFound when it never had that version
+	FindVersion(ctx context.Context, id primitive.ObjectID, version int) (Reward, error)
+	Find(ctx context.Context, filter Filter, page Page) ([]Reward, error)
+	//Update stores the type and terms of reward as its next version, keeping the terms it had at reward.Version.
+	//ErrConflict when the reward is no longer at reward.Version or is archived
+	Update(ctx context.Context, reward Reward) (Reward, error)
+	//Archive sets DeletedAt to at unless the reward is already archived
+	Archive(ctx context.Context, id primitive.ObjectID, at time.Time) (Reward, error)
+	//Restore clears DeletedAt
+	Restore(ctx context.Context, id primitive.ObjectID) (Reward, error)
+}
+
+//UserRewardRepo stores rewards granted to users
+type UserRewardRepo interface {
+	Create(ctx context.Context, userReward UserReward) (UserReward, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (UserReward, error)
+	Find(ctx context.Context, filter Filter, page Page) ([]UserReward, error)
+	//Transition moves a UserReward to change.To if it is still in change.From and records change in its history,
+	//txHash is stored along when not empty. It returns false when the UserReward was no longer in change.From
+	Transition(ctx context.Context, id primitive.ObjectID, change StatusChange, txHash string) (bool, error)
+	SetTxHash(ctx context.Context, id primitive.ObjectID, txHash string) error
+	//Expire moves every open or failed UserReward whose expiresAt passed before now to expired
+	Expire(ctx context.Context, now time.Time) (int64, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+//WalletRepo stores user wallets, private keys are only ever stored sealed
+type WalletRepo interface {
+	Create(ctx context.Context, wallet Wallet) (Wallet, error)
+	//FindByUser returns the wallet payouts go to, a linked external wallet before the custodial one
+	FindByUser(ctx context.Context, userID primitive.ObjectID) (Wallet, error)
+	//LinkExternal records address as the external wallet of the user, ErrConflict when another user linked it
+	LinkExternal(ctx context.Context, userID primitive.ObjectID, address string, at time.Time) (Wallet, error)
+}
+
+//RatingRepo stores ratings and the score they add up to for each rated user
+type RatingRepo interface {
+	//Create stores the rating and adds its value to the score of the rated user, returning the new score.
+	//ErrConflict when a rating with the same Key exists
+	Create(ctx context.Context, rating Rating) (Rating, Score, error)
+	Find(ctx context.Context, filter Filter, page Page) ([]Rating, error)
+	//Score returns the score of the user, a zero Score when nobody rated them yet
+	Score(ctx context.Context, userID primitive.ObjectID) (Score, error)
+}
+
+//RatingRuleRepo stores the rules granting rewards to users whose score reaches their thresholds
+type RatingRuleRepo interface {
+	Create(ctx context.Context, rule RatingRule) (RatingRule, error)
+	Find(ctx context.Context, filter Filter, page Page) ([]RatingRule, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
@@ -1,14 +1,16 @@
 package handlers
 
 import (
-	"github.com/Godtide/rating/dbiface"
+	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/net/context"
+	"math/big"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -16,30 +18,91 @@ import (
 type Reward struct {
 	ID               primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	Type             string             `json:"type" bson:"type" validate:"required"` //high. medium, low
-	Points           int8               `json:"points, omitempty" bson:"points" validate:"required"`
-	AmountRedeemable int8               `json:"amountRedeemable, omitempty" bson:"amountRedeemable" validate:"required"`
-	expiry           int8               `json:"expiry" bson:"expiry" validate:"required"` //expiry in days
-	CreatedAt        time.Time          `json:"createdAt, omitempty" bson:"createdAt, omitempty"`
-	UpdatedAt        time.Time          `json:"updatedAt, omitempty" bson:"updatedAt, omitempty"`
-	DeletedAt        time.Time          `json:"deletedAt, omitempty" bson:"deletedAt, omitempty"`
+	Points           TokenAmount        `json:"points" bson:"points"`
+	AmountRedeemable TokenAmount        `json:"amountRedeemable" bson:"amountRedeemable"`       //tokens paid per point
+	Expiry           int8               `json:"expiry" bson:"expiry" validate:"required,min=1"` //expiry in days
+	CreatedAt        time.Time          `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	UpdatedAt        time.Time          `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	DeletedAt        time.Time          `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"` //set while archived
+	Version          int                `json:"version" bson:"version"`                         //bumped by every update
+	Versions         []RewardTerms      `json:"-" bson:"versions,omitempty"`                    //the terms of earlier versions
+}
+
+//RewardTerms are the terms of a Reward at one version, userRewards are paid out on the terms
+//of the version they were granted under
+type RewardTerms struct {
+	Version          int         `json:"version" bson:"version"`
+	Points           TokenAmount `json:"points" bson:"points"`
+	AmountRedeemable TokenAmount `json:"amountRedeemable" bson:"amountRedeemable"`
+	Expiry           int8        `json:"expiry" bson:"expiry"`
+	Since            time.Time   `json:"since" bson:"since"`
+}
+
+//Terms returns the current terms of the reward
+func (r Reward) Terms() RewardTerms {
+	since := r.UpdatedAt
+	if since.IsZero() {
+		since = r.CreatedAt
+	}
+	return RewardTerms{Version: r.Version, Points: r.Points, AmountRedeemable: r.AmountRedeemable, Expiry: r.Expiry, Since: since}
+}
+
+//AtVersion returns the reward with the terms of version, false when it never had that version
+func (r Reward) AtVersion(version int) (Reward, bool) {
+	if version == r.Version {
+		return r, true
+	}
+	for _, terms := range r.Versions {
+		if terms.Version == version {
+			r.Version, r.Points, r.AmountRedeemable, r.Expiry = terms.Version, terms.Points, terms.AmountRedeemable, terms.Expiry
+			return r, true
+		}
+	}
+	return Reward{}, false
+}
+
+//maxPayout caps the tokens a reward pays out, Points times AmountRedeemable
+var maxPayout = new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(maxAmountDigits), nil))
+
+//validateAmounts checks points and amountRedeemable are positive and that their product, the payout
+//of the reward, is at most maxPayout tokens with no more than maxAmountScale decimals
+func validateAmounts(points, amountRedeemable TokenAmount) error {
+	if points.Sign() <= 0 || amountRedeemable.Sign() <= 0 {
+		return fmt.Errorf("points and amountRedeemable must be positive")
+	}
+	payout := points.Mul(amountRedeemable)
+	if payout.Rat().Cmp(maxPayout) > 0 || payout.scale() > maxAmountScale {
+		return fmt.Errorf("points times amountRedeemable must be at most %s tokens with %d decimals",
+			maxPayout.RatString(), maxAmountScale)
+	}
+	return nil
+}
+
+//rewardUpdate is the admin payload replacing the terms of a reward, Version is the version it was read at
+type rewardUpdate struct {
+	Type             string      `json:"type" validate:"required"`
+	Points           TokenAmount `json:"points"`
+	AmountRedeemable TokenAmount `json:"amountRedeemable"`
+	Expiry           int8        `json:"expiry" validate:"required,min=1"`
+	Version          int         `json:"version" validate:"required,min=1"`
 }
 
 //RewardHandler handles types of rewards created by an admin
 type RewardHandler struct {
-	RewardCol     dbiface.CollectionAPI
-	UserRewardCol dbiface.CollectionAPI
+	RewardRepo     RewardRepo
+	UserRewardRepo UserRewardRepo
 }
 
-func insertReward(ctx context.Context, reward Reward, collection dbiface.CollectionAPI) (interface{}, *echo.HTTPError) {
-	reward.ID = primitive.NewObjectID()
+func insertReward(ctx context.Context, reward Reward, repo RewardRepo) (interface{}, *echo.HTTPError) {
 	reward.CreatedAt = time.Now()
-	insertID, err := collection.InsertOne(ctx, reward)
+	reward.UpdatedAt, reward.DeletedAt, reward.Version, reward.Versions = time.Time{}, time.Time{}, 1, nil
+	reward, err := repo.Create(ctx, reward)
 	if err != nil {
 		log.Errorf("Unable to insert to Database:%v", err)
 		return nil,
 			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
 	}
-	return insertID.InsertedID, nil
+	return reward.ID, nil
 }
 
 //CreateRewards create rewards on mongodb database
@@ -54,62 +117,170 @@ func (r *RewardHandler) CreateRewards(c echo.Context) error {
 		log.Errorf("Unable to validate the reward %+v %v", reward, err)
 		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
 	}
-	IDs, httpError := insertReward(context.Background(), reward, r.RewardCol)
+	if err := validateAmounts(reward.Points, reward.AmountRedeemable); err != nil {
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: err.Error()})
+	}
+	IDs, httpError := insertReward(context.Background(), reward, r.RewardRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
 	return c.JSON(http.StatusCreated, IDs)
 }
 
-func findRewards(ctx context.Context, q url.Values, collection dbiface.CollectionAPI) ([]Reward, *echo.HTTPError) {
-	var rewards []Reward
-	filter := make(map[string]interface{})
-	for k, v := range q {
-		filter[k] = v[0]
+//rewardSorts are the fields GET /rewards may sort on
+var rewardSorts = []string{"_id", "createdAt", "points", "expiry"}
+
+func rewardSortValue(reward Reward, field string) interface{} {
+	switch field {
+	case "createdAt":
+		return reward.CreatedAt
+	case "points":
+		return reward.Points
+	case "expiry":
+		return int64(reward.Expiry)
 	}
-	if filter["_id"] != nil {
-		docID, err := primitive.ObjectIDFromHex(filter["_id"].(string))
-		if err != nil {
-			log.Errorf("Unable to convert to Object ID : %v", err)
-			return rewards,
-				echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
-		}
-		filter["_id"] = docID
+	return reward.ID
+}
+
+//findRewards returns a page of the rewards matching q and the cursor of the next page, if any.
+//Archived rewards are listed instead of the others when archived is set
+func findRewards(ctx context.Context, q url.Values, archived bool, repo RewardRepo) ([]Reward, string, *echo.HTTPError) {
+	rewards, next := []Reward{}, ""
+	filter, err := parseFilter(q, rewardFields)
+	var page Page
+	if err == nil {
+		page, err = parsePage(q, rewardFields, rewardSorts)
+	}
+	if err == nil {
+		filter = append(filter, Condition{Field: "deletedAt", Op: OpExists, Value: archived})
+		rewards, err = repo.Find(ctx, filter, page.more())
+	}
+	if errors.Is(err, ErrInvalidFilter) {
+		log.Errorf("Unable to filter the rewards : %v", err)
+		return rewards, next,
+			echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: err.Error()})
 	}
-	cursor, err := collection.Find(ctx, bson.M(filter))
 	if err != nil {
 		log.Errorf("Unable to find the rewards : %v", err)
-		return rewards,
+		return rewards, next,
 			echo.NewHTTPError(http.StatusNotFound, errorMessage{Message: "unable to find the rewards"})
 	}
-	err = cursor.All(ctx, &rewards)
-	if err != nil {
-		log.Errorf("Unable to read the cursor : %v", err)
-		return rewards,
-			echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse retrieved rewards"})
+	if len(rewards) > page.Limit {
+		rewards = rewards[:page.Limit]
+		last := rewards[page.Limit-1]
+		next = page.next(rewardSortValue(last, page.SortField()), last.ID)
 	}
-	return rewards, nil
+	return rewards, next, nil
 }
 
-//GetRewards gets a list of rewards available
+//GetRewards gets a page of the rewards available, the Link header points at the next one.
+//Admins list the archived rewards with archived=true
 func (h *RewardHandler) GetRewards(c echo.Context) error {
-	rewards, httpError := findRewards(context.Background(), c.QueryParams(), h.RewardCol)
+	q := c.QueryParams()
+	archived := q.Get("archived") == "true"
+	if claims, ok := CurrentUser(c); archived && (!ok || !claims.IsAdmin) {
+		return c.JSON(http.StatusForbidden, errorMessage{Message: "only admins list archived rewards"})
+	}
+	q.Del("archived")
+	rewards, next, httpError := findRewards(context.Background(), q, archived, h.RewardRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
+	setNextPage(c, next)
 	return c.JSON(http.StatusOK, rewards)
 }
 
-func findReward(ctx context.Context, id string, collection dbiface.CollectionAPI) (Reward, *echo.HTTPError) {
-	var reward Reward
+//GetReward gets a reward, archived or not, with the terms of the version query parameter when given
+func (h *RewardHandler) GetReward(c echo.Context) error {
+	reward, httpError := findReward(context.Background(), c.Param("id"), h.RewardRepo)
+	if httpError != nil {
+		return c.JSON(httpError.Code, httpError.Message)
+	}
+	if s := c.QueryParam("version"); s != "" {
+		version, err := strconv.Atoi(s)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errorMessage{Message: "version is not a number"})
+		}
+		var ok bool
+		if reward, ok = reward.AtVersion(version); !ok {
+			return c.JSON(http.StatusNotFound, errorMessage{Message: "unable to find the reward version"})
+		}
+	}
+	return c.JSON(http.StatusOK, reward)
+}
+
+//UpdateReward replaces the terms of a reward as a new version, userRewards already granted keep
+//the terms of their version. The payload carries the version it was read at, 409 when it changed since
+func (h *RewardHandler) UpdateReward(c echo.Context) error {
+	var req rewardUpdate
+	c.Echo().Validator = &rewardValidator{validator: v}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind : %v", err)
+		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse request payload"})
+	}
+	if err := c.Validate(req); err != nil {
+		log.Errorf("Unable to validate the reward update %+v %v", req, err)
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
+	}
+	if err := validateAmounts(req.Points, req.AmountRedeemable); err != nil {
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: err.Error()})
+	}
+	ctx := context.Background()
+	reward, httpError := findReward(ctx, c.Param("id"), h.RewardRepo)
+	if httpError != nil {
+		return c.JSON(httpError.Code, httpError.Message)
+	}
+	reward.Type, reward.Points, reward.AmountRedeemable, reward.Expiry = req.Type, req.Points, req.AmountRedeemable, req.Expiry
+	reward.Version, reward.UpdatedAt = req.Version, time.Now()
+	reward, err := h.RewardRepo.Update(ctx, reward)
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, errorMessage{Message: "reward was changed or archived since that version"})
+	}
+	if err != nil {
+		log.Errorf("Unable to update reward %s : %v", c.Param("id"), err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to update the reward"})
+	}
+	return c.JSON(http.StatusOK, reward)
+}
+
+//ArchiveReward archives a reward, it is no longer listed nor granted but granted userRewards can still be claimed
+func (h *RewardHandler) ArchiveReward(c echo.Context) error {
+	return h.setArchived(c, true)
+}
+
+//RestoreReward brings an archived reward back
+func (h *RewardHandler) RestoreReward(c echo.Context) error {
+	return h.setArchived(c, false)
+}
+
+func (h *RewardHandler) setArchived(c echo.Context, archived bool) error {
+	ctx := context.Background()
+	reward, httpError := findReward(ctx, c.Param("id"), h.RewardRepo)
+	if httpError != nil {
+		return c.JSON(httpError.Code, httpError.Message)
+	}
+	var updated Reward
+	var err error
+	if archived {
+		updated, err = h.RewardRepo.Archive(ctx, reward.ID, time.Now())
+	} else {
+		updated, err = h.RewardRepo.Restore(ctx, reward.ID)
+	}
+	if err != nil {
+		log.Errorf("Unable to archive (%v) reward %s : %v", archived, reward.ID.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to update the reward"})
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+func findReward(ctx context.Context, id string, repo RewardRepo) (Reward, *echo.HTTPError) {
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		log.Errorf("Unable to convert to Object ID : %v", err)
-		return reward,
+		return Reward{},
 			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
 	}
-	res := collection.FindOne(ctx, bson.M{"_id": docID})
-	err = res.Decode(&reward)
+	reward, err := repo.FindByID(ctx, docID)
 	if err != nil {
 		log.Errorf("Unable to find the reward : %v", err)
 		return reward,
@@ -117,4 +288,3 @@ func findReward(ctx context.Context, id string, collection dbiface.CollectionAPI
 	}
 	return reward, nil
 }
-
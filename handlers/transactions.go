@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/Godtide/rating/chain"
+	"github.com/Godtide/rating/dbiface"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+)
+
+//Transaction records an on-chain payout sent for a UserReward
+type Transaction struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	UserRewardId primitive.ObjectID `json:"userReward_id" bson:"userReward_id"`
+	Wallet       string             `json:"wallet" bson:"wallet"`
+	Amount       string             `json:"amount" bson:"amount"` //token base units
+	Nonce        uint64             `json:"nonce" bson:"nonce"`
+	Gas          uint64             `json:"gas" bson:"gas"`
+	GasFeeCap    string             `json:"gasFeeCap,omitempty" bson:"gasFeeCap,omitempty"`
+	GasTipCap    string             `json:"gasTipCap,omitempty" bson:"gasTipCap,omitempty"`
+	GasUsed      uint64             `json:"gasUsed,omitempty" bson:"gasUsed,omitempty"`
+	TxHash       string             `json:"txHash,omitempty" bson:"txHash,omitempty"`
+	BlockNumber  uint64             `json:"blockNumber,omitempty" bson:"blockNumber,omitempty"`
+	BatchId      primitive.ObjectID `json:"batch_id,omitempty" bson:"batch_id,omitempty"`
+	BatchSize    int                `json:"batchSize,omitempty" bson:"batchSize,omitempty"`
+	Status       string             `json:"status" bson:"status"` //held, releasing, queued, sending, pending, confirmed, reverted, dropped
+	Attempt      int                `json:"attempt" bson:"attempt"`
+	Requeued     bool               `json:"requeued,omitempty" bson:"requeued,omitempty"`
+	Replaced     []string           `json:"replaced,omitempty" bson:"replaced,omitempty"` //earlier hashes of the nonce, dropped and sent again
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt    time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+const (
+	//TransactionPending sent and waiting to be mined
+	TransactionPending = "pending"
+	//TransactionConfirmed mined successfully
+	TransactionConfirmed = "confirmed"
+	//TransactionReverted mined but reverted
+	TransactionReverted = "reverted"
+	//TransactionDropped no longer known to the network
+	TransactionDropped = "dropped"
+)
+
+//TransactionHandler lets users and support follow claim payouts
+type TransactionHandler struct {
+	TransactionCol dbiface.CollectionAPI
+	UserRewardRepo UserRewardRepo
+}
+
+//TransactionWatcher polls receipts of pending transactions and re-queues failed ones
+type TransactionWatcher struct {
+	TransactionCol dbiface.CollectionAPI
+	UserRewardRepo UserRewardRepo
+	Transferer     chain.TokenTransferer
+	Batcher        *Batcher  //re-queued payouts go into the next batch when set
+	Treasury       *Treasury //re-queued payouts are held while the master wallet runs low when set
+	MaxAttempts    int
+	DropAfter      time.Duration
+}
+
+//sendTransfer transfers amount to wallet, the transaction is recorded in the ledger before it is sent
+//so the TransactionWatcher settles it whatever happens to the send
+func sendTransfer(ctx context.Context, transferer chain.TokenTransferer, userRewardID primitive.ObjectID, wallet string,
+	amount *big.Int, attempt int, collection dbiface.CollectionAPI) (Transaction, error) {
+	now := time.Now()
+	tx := Transaction{
+		ID:           primitive.NewObjectID(),
+		UserRewardId: userRewardID,
+		Wallet:       wallet,
+		Amount:       amount.String(),
+		Status:       TransactionPending,
+		Attempt:      attempt,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	recorded := false
+	_, err := transferer.Transfer(ctx, wallet, amount, func(ctx context.Context, sent chain.SentTx) error {
+		tx = withSent(tx, sent)
+		if recorded {
+			// sent again under a new nonce, the first one was taken
+			_, err := collection.UpdateOne(ctx, bson.M{"_id": tx.ID}, bson.M{"$set": sentFields(sent)})
+			return err
+		}
+		_, err := collection.InsertOne(ctx, tx)
+		recorded = err == nil
+		return err
+	})
+	if err != nil && recorded {
+		// the transfer may have reached the network, it is pending until the watcher sees its receipt or its nonce taken
+		log.Errorf("Transaction %s for userReward %s may not have been sent : %v", tx.TxHash, userRewardID.Hex(), err)
+		return tx, nil
+	}
+	return tx, err
+}
+
+//withSent sets the signed transaction sent on tx
+func withSent(tx Transaction, sent chain.SentTx) Transaction {
+	tx.TxHash, tx.Nonce, tx.Gas = sent.Hash, sent.Nonce, sent.Gas
+	if sent.GasFeeCap != nil {
+		tx.GasFeeCap = sent.GasFeeCap.String()
+	}
+	if sent.GasTipCap != nil {
+		tx.GasTipCap = sent.GasTipCap.String()
+	}
+	return tx
+}
+
+//sentFields are the ledger fields describing the signed transaction sent
+func sentFields(sent chain.SentTx) bson.M {
+	set := bson.M{
+		"txHash":    sent.Hash,
+		"nonce":     sent.Nonce,
+		"gas":       sent.Gas,
+		"updatedAt": time.Now(),
+	}
+	if sent.GasFeeCap != nil {
+		set["gasFeeCap"] = sent.GasFeeCap.String()
+	}
+	if sent.GasTipCap != nil {
+		set["gasTipCap"] = sent.GasTipCap.String()
+	}
+	return set
+}
+
+//parseAmount reads the base units recorded on a ledger entry
+func parseAmount(tx Transaction) (*big.Int, error) {
+	amount, ok := new(big.Int).SetString(tx.Amount, 10)
+	if !ok {
+		return nil, fmt.Errorf("transaction %s has an invalid amount %q", tx.ID.Hex(), tx.Amount)
+	}
+	return amount, nil
+}
+
+//parseWei reads a fee recorded on a ledger entry, nil when none was
+func parseWei(wei string) *big.Int {
+	fee, ok := new(big.Int).SetString(wei, 10)
+	if !ok {
+		return nil
+	}
+	return fee
+}
+
+var (
+	//transactionFields are the fields GET /reward/:id/transactions may filter on
+	transactionFields = fields{
+		"_id":           idField,
+		"userReward_id": idField,
+		"status":        textField,
+		"txHash":        textField,
+		"createdAt":     timeField,
+	}
+	transactionSorts = []string{"_id", "createdAt"}
+)
+
+func findTransactions(ctx context.Context, filter bson.M, collection dbiface.CollectionAPI) ([]Transaction, error) {
+	var transactions []Transaction
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return transactions, err
+	}
+	err = cursor.All(ctx, &transactions)
+	return transactions, err
+}
+
+//GetUserRewardTransactions lists the payout transactions of a UserReward
+func (h *TransactionHandler) GetUserRewardTransactions(c echo.Context) error {
+	ctx := context.Background()
+	userReward, httpError := findUserReward(ctx, c.Param("id"), h.UserRewardRepo)
+	if httpError != nil {
+		return c.JSON(httpError.Code, httpError.Message)
+	}
+	if claims, ok := CurrentUser(c); !ok || (claims.UserID != userReward.UserId.Hex() && !claims.IsAdmin) {
+		return c.JSON(http.StatusForbidden, errorMessage{Message: "not allowed to view this reward"})
+	}
+	q := c.QueryParams()
+	filter, err := parseFilter(q, transactionFields)
+	var page Page
+	if err == nil {
+		page, err = parsePage(q, transactionFields, transactionSorts)
+	}
+	transactions := []Transaction{}
+	if err == nil {
+		err = findAll(ctx, h.TransactionCol, append(filter, Eq("userReward_id", userReward.ID)), page.more(),
+			transactionFields, &transactions)
+	}
+	if errors.Is(err, ErrInvalidFilter) {
+		log.Errorf("Unable to filter the transactions : %v", err)
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: err.Error()})
+	}
+	if err != nil {
+		log.Errorf("Unable to find the transactions : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to find the transactions"})
+	}
+	if len(transactions) > page.Limit {
+		transactions = transactions[:page.Limit]
+		last := transactions[page.Limit-1]
+		value := interface{}(last.ID)
+		if page.SortField() == "createdAt" {
+			value = last.CreatedAt
+		}
+		setNextPage(c, page.next(value, last.ID))
+	}
+	return c.JSON(http.StatusOK, transactions)
+}
+
+//Run checks every pending transaction once, it returns the number of transactions that settled
+func (w *TransactionWatcher) Run(ctx context.Context) (int64, error) {
+	var settled int64
+	pending, err := findTransactions(ctx, bson.M{"status": TransactionPending}, w.TransactionCol)
+	if err != nil {
+		log.Errorf("Unable to find pending transactions : %v", err)
+		return 0, err
+	}
+	// transactions of a batch share one hash
+	receipts := make(map[string]chain.Receipt)
+	replaced := make(map[string]bool)
+	for _, tx := range pending {
+		receipt, hash, err := w.receipt(ctx, tx, receipts)
+		if err != nil {
+			log.Errorf("Unable to get receipt of %s : %v", tx.TxHash, err)
+			continue
+		}
+		switch receipt.Status {
+		case chain.TxConfirmed:
+			if !w.settle(ctx, tx, TransactionConfirmed, receipt, hash) {
+				continue
+			}
+			_, err = transitionUserReward(ctx, tx.UserRewardId, UserRewardClaiming, UserRewardRedeemed, "transfer confirmed",
+				hash, w.UserRewardRepo)
+			if err != nil {
+				log.Errorf("Unable to mark userReward %s as redeemed : %v", tx.UserRewardId.Hex(), err)
+			}
+		case chain.TxReverted:
+			if !w.settle(ctx, tx, TransactionReverted, receipt, hash) {
+				continue
+			}
+			w.requeue(ctx, tx)
+		case chain.TxNotFound:
+			if time.Since(tx.UpdatedAt) < w.DropAfter || !w.dropped(ctx, tx, pending, replaced) ||
+				!w.settle(ctx, tx, TransactionDropped, receipt, hash) {
+				continue
+			}
+			w.requeue(ctx, tx)
+		default:
+			continue
+		}
+		settled++
+	}
+	return settled, nil
+}
+
+//receipt looks up every hash sent under the nonce of tx and returns the receipt of the one mined, if any
+func (w *TransactionWatcher) receipt(ctx context.Context, tx Transaction, receipts map[string]chain.Receipt) (chain.Receipt, string, error) {
+	found := chain.Receipt{Status: chain.TxNotFound}
+	for _, hash := range append([]string{tx.TxHash}, tx.Replaced...) {
+		receipt, ok := receipts[hash]
+		if !ok {
+			var err error
+			if receipt, err = w.Transferer.Receipt(ctx, hash); err != nil {
+				return receipt, hash, err
+			}
+			receipts[hash] = receipt
+		}
+		switch receipt.Status {
+		case chain.TxConfirmed, chain.TxReverted:
+			return receipt, hash, nil
+		case chain.TxPending:
+			found = receipt
+		}
+	}
+	return found, tx.TxHash, nil
+}
+
+//dropped tells whether the payout of a transaction the network forgot can be sent again with a new nonce.
+//That is only once its nonce went to another transaction, until then the payout is sent again under
+//the same nonce with higher fees so the network mines one of the two at most
+func (w *TransactionWatcher) dropped(ctx context.Context, tx Transaction, pending []Transaction, replaced map[string]bool) bool {
+	used, err := w.Transferer.NonceUsed(ctx, tx.Nonce)
+	if err != nil {
+		log.Errorf("Unable to check nonce %d of %s : %v", tx.Nonce, tx.TxHash, err)
+		return false
+	}
+	if !used {
+		if !replaced[tx.TxHash] {
+			// a batch is replaced once for all of its payouts
+			replaced[tx.TxHash] = true
+			w.replace(ctx, tx, pending)
+		}
+		return false
+	}
+	// the transaction could have been mined right before the nonce was read
+	receipt, _, err := w.receipt(ctx, tx, make(map[string]chain.Receipt))
+	if err != nil {
+		log.Errorf("Unable to get receipt of %s : %v", tx.TxHash, err)
+		return false
+	}
+	return receipt.Status == chain.TxNotFound
+}
+
+//replace sends the payouts of a dropped transaction again under its nonce, the new hash is recorded before it is sent
+func (w *TransactionWatcher) replace(ctx context.Context, tx Transaction, pending []Transaction) {
+	previous := chain.SentTx{Hash: tx.TxHash, Nonce: tx.Nonce, Gas: tx.Gas, GasFeeCap: parseWei(tx.GasFeeCap), GasTipCap: parseWei(tx.GasTipCap)}
+	var recorded string
+	record := func(ctx context.Context, sent chain.SentTx) error {
+		set := sentFields(sent)
+		set["replaced"] = append(tx.Replaced, tx.TxHash)
+		_, err := w.TransactionCol.UpdateMany(ctx, bson.M{"txHash": tx.TxHash, "status": TransactionPending}, bson.M{"$set": set})
+		if err == nil {
+			recorded = sent.Hash
+		}
+		return err
+	}
+	batch := []Transaction{tx}
+	var err error
+	if tx.BatchId.IsZero() {
+		var amount *big.Int
+		if amount, err = parseAmount(tx); err == nil {
+			_, err = w.Transferer.Replace(ctx, previous, tx.Wallet, amount, record)
+		}
+	} else {
+		batch = batch[:0]
+		for _, other := range pending {
+			if other.TxHash == tx.TxHash {
+				batch = append(batch, other)
+			}
+		}
+		_, err = w.replaceBatch(ctx, previous, batch, record)
+	}
+	if err != nil {
+		// still pending under the nonce, the next run tries again
+		log.Errorf("Unable to replace dropped transaction %s : %v", tx.TxHash, err)
+	}
+	if recorded == "" {
+		return
+	}
+	for _, replaced := range batch {
+		if err = w.UserRewardRepo.SetTxHash(ctx, replaced.UserRewardId, recorded); err != nil {
+			log.Errorf("Unable to update userReward %s : %v", replaced.UserRewardId.Hex(), err)
+		}
+	}
+	log.Warnf("Dropped transaction %s replaced by %s with nonce %d", tx.TxHash, recorded, tx.Nonce)
+}
+
+func (w *TransactionWatcher) replaceBatch(ctx context.Context, previous chain.SentTx, batch []Transaction,
+	record chain.Record) (chain.SentTx, error) {
+	transferer, ok := w.Transferer.(chain.BatchTransferer)
+	if !ok {
+		return chain.SentTx{}, fmt.Errorf("transferer does not send batches")
+	}
+	items := make([]chain.BatchItem, len(batch))
+	for i, tx := range batch {
+		amount, err := parseAmount(tx)
+		if err != nil {
+			return chain.SentTx{}, err
+		}
+		items[i] = chain.BatchItem{To: tx.Wallet, Amount: amount}
+	}
+	return transferer.ReplaceBatch(ctx, previous, items, record)
+}
+
+//settle moves a pending transaction to its final status, it returns false if another run already did.
+//hash is the hash that was mined, when it is not the latest one sent for the nonce
+func (w *TransactionWatcher) settle(ctx context.Context, tx Transaction, status string, receipt chain.Receipt, hash string) bool {
+	set := bson.M{"status": status, "txHash": hash, "updatedAt": time.Now()}
+	if receipt.BlockNumber > 0 {
+		set["blockNumber"] = receipt.BlockNumber
+		set["gasUsed"] = receipt.GasUsed
+	}
+	res, err := w.TransactionCol.UpdateOne(ctx, bson.M{"_id": tx.ID, "status": TransactionPending}, bson.M{"$set": set})
+	if err != nil {
+		log.Errorf("Unable to update transaction %s : %v", tx.TxHash, err)
+		return false
+	}
+	return res.ModifiedCount == 1
+}
+
+//requeue sends a failed transfer again, or fails the UserReward once attempts are used up
+func (w *TransactionWatcher) requeue(ctx context.Context, tx Transaction) {
+	if tx.Attempt >= w.MaxAttempts {
+		log.Errorf("Transfer for userReward %s failed after %d attempts", tx.UserRewardId.Hex(), tx.Attempt)
+		_, err := transitionUserReward(ctx, tx.UserRewardId, UserRewardClaiming, UserRewardFailed, "transfer failed", "", w.UserRewardRepo)
+		if err != nil {
+			log.Errorf("Unable to mark userReward %s as failed : %v", tx.UserRewardId.Hex(), err)
+		}
+		return
+	}
+	amount, err := parseAmount(tx)
+	if err != nil {
+		log.Errorf("Unable to re-send transfer for userReward %s : %v", tx.UserRewardId.Hex(), err)
+		return
+	}
+	if w.Treasury.Paused() {
+		if _, err := w.Treasury.hold(ctx, tx.UserRewardId, tx.Wallet, amount, tx.Attempt+1); err != nil {
+			log.Errorf("Unable to hold transfer for userReward %s : %v", tx.UserRewardId.Hex(), err)
+			return
+		}
+		_, err := w.TransactionCol.UpdateOne(ctx, bson.M{"_id": tx.ID}, bson.M{"$set": bson.M{"requeued": true}})
+		if err != nil {
+			log.Errorf("Unable to update transaction %s : %v", tx.TxHash, err)
+		}
+		return
+	}
+	if w.Batcher != nil {
+		if _, err := w.Batcher.Enqueue(ctx, tx.UserRewardId, tx.Wallet, amount, tx.Attempt+1); err != nil {
+			log.Errorf("Unable to re-queue transfer for userReward %s : %v", tx.UserRewardId.Hex(), err)
+			return
+		}
+		_, err := w.TransactionCol.UpdateOne(ctx, bson.M{"_id": tx.ID}, bson.M{"$set": bson.M{"requeued": true}})
+		if err != nil {
+			log.Errorf("Unable to update transaction %s : %v", tx.TxHash, err)
+		}
+		return
+	}
+	next, err := sendTransfer(ctx, w.Transferer, tx.UserRewardId, tx.Wallet, amount, tx.Attempt+1, w.TransactionCol)
+	if err != nil {
+		// leave the old transaction un-requeued so support can see where it stopped
+		log.Errorf("Unable to re-send transfer for userReward %s : %v", tx.UserRewardId.Hex(), err)
+		reason := "transfer failed"
+		if errors.Is(err, chain.ErrFeesAboveCap) {
+			// failed rewards can be claimed again once fees come down
+			reason = "network fees above policy"
+		}
+		_, err = transitionUserReward(ctx, tx.UserRewardId, UserRewardClaiming, UserRewardFailed, reason, "", w.UserRewardRepo)
+		if err != nil {
+			log.Errorf("Unable to mark userReward %s as failed : %v", tx.UserRewardId.Hex(), err)
+		}
+		return
+	}
+	_, err = w.TransactionCol.UpdateOne(ctx, bson.M{"_id": tx.ID}, bson.M{"$set": bson.M{"requeued": true}})
+	if err != nil {
+		log.Errorf("Unable to update transaction %s : %v", tx.TxHash, err)
+	}
+	if err = w.UserRewardRepo.SetTxHash(ctx, tx.UserRewardId, next.TxHash); err != nil {
+		log.Errorf("Unable to update userReward %s : %v", tx.UserRewardId.Hex(), err)
+	}
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Godtide/rating/chain"
+	"github.com/Godtide/rating/dbiface"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	//TransactionHeld a payout parked while the treasury is paused, released once balances recover
+	TransactionHeld = "held"
+	//TransactionReleasing a held payout taken by a release, it becomes pending once its signed transfer is recorded
+	TransactionReleasing = "releasing"
+)
+
+//ledgerTimeout bounds the ledger writes around a send, they outlive the job that sent it
+const ledgerTimeout = 30 * time.Second
+
+//ledgerContext detaches the ledger writes of a send from ctx, a transfer that may have reached the
+//network is recorded even when the job running it times out
+func ledgerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), ledgerTimeout)
+}
+
+//TreasuryStatus is the last balance check of the master wallet
+type TreasuryStatus struct {
+	Account          string    `json:"account"`
+	TokenBalance     string    `json:"tokenBalance,omitempty"`  //base units
+	NativeBalance    string    `json:"nativeBalance,omitempty"` //wei
+	MinTokenBalance  string    `json:"minTokenBalance"`
+	MinNativeBalance string    `json:"minNativeBalance"`
+	Paused           bool      `json:"paused"`
+	Reason           string    `json:"reason,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	CheckedAt        time.Time `json:"checkedAt,omitempty"`
+	Held             int64     `json:"held"`
+}
+
+//Treasury watches the balances of the master wallet and holds payouts while they are too low to pay
+type Treasury struct {
+	Account          string
+	Balances         chain.BalanceReader
+	MinTokens        *big.Int //whole tokens
+	MinNativeBalance *big.Int //wei
+	TransactionCol   dbiface.CollectionAPI
+	UserRewardRepo   UserRewardRepo
+	Transferer       chain.TokenTransferer
+	Batcher          *Batcher //released payouts go into the next batch when set
+
+	mu     sync.RWMutex
+	status TreasuryStatus
+}
+
+//TreasuryHandler exposes the treasury to admins
+type TreasuryHandler struct {
+	Treasury *Treasury
+}
+
+//Paused reports whether the last check found balances below the thresholds,
+//nil treasuries and treasuries not checked yet never pause
+func (t *Treasury) Paused() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.status.Paused
+}
+
+//Status returns the last balance check
+func (t *Treasury) Status() TreasuryStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.status
+}
+
+//Run checks the balances once and releases held payouts when they are healthy again,
+//it returns the number of payouts released
+func (t *Treasury) Run(ctx context.Context) (int64, error) {
+	if err := t.recover(ctx); err != nil {
+		log.Errorf("Unable to recover releasing payouts : %v", err)
+	}
+	status, err := t.check(ctx)
+	held, cerr := t.TransactionCol.CountDocuments(ctx, bson.M{"status": TransactionHeld})
+	if cerr != nil {
+		log.Errorf("Unable to count held payouts : %v", cerr)
+	}
+	status.Held = held
+
+	t.mu.Lock()
+	if err != nil {
+		// keep the last known balances and pause state, a flaky node must not flip the breaker
+		t.status.Error = err.Error()
+		t.status.Held = held
+	} else {
+		if status.Paused != t.status.Paused {
+			log.Warnf("Treasury %s : paused=%t %s", status.Account, status.Paused, status.Reason)
+		}
+		t.status = status
+	}
+	paused := t.status.Paused
+	t.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if paused || held == 0 {
+		return 0, nil
+	}
+	return t.release(ctx)
+}
+
+func (t *Treasury) check(ctx context.Context) (TreasuryStatus, error) {
+	status := TreasuryStatus{
+		Account:          t.Account,
+		MinNativeBalance: t.MinNativeBalance.String(),
+		CheckedAt:        time.Now(),
+	}
+	decimals, err := t.Transferer.Decimals(ctx)
+	if err != nil {
+		return status, err
+	}
+	minToken := chain.TokenUnits(t.MinTokens, decimals)
+	status.MinTokenBalance = minToken.String()
+
+	token, err := t.Balances.TokenBalance(ctx, t.Account)
+	if err != nil {
+		return status, err
+	}
+	native, err := t.Balances.NativeBalance(ctx, t.Account)
+	if err != nil {
+		return status, err
+	}
+	status.TokenBalance = token.String()
+	status.NativeBalance = native.String()
+	switch {
+	case token.Cmp(minToken) < 0:
+		status.Paused, status.Reason = true, "token balance below threshold"
+	case native.Cmp(t.MinNativeBalance) < 0:
+		status.Paused, status.Reason = true, "native balance below threshold"
+	}
+	return status, nil
+}
+
+//hold parks a payout until the treasury is funded again, the UserReward stays claiming
+func (t *Treasury) hold(ctx context.Context, userRewardID primitive.ObjectID, wallet string, amount *big.Int, attempt int) (Transaction, error) {
+	now := time.Now()
+	tx := Transaction{
+		ID:           primitive.NewObjectID(),
+		UserRewardId: userRewardID,
+		Wallet:       wallet,
+		Amount:       amount.String(),
+		Status:       TransactionHeld,
+		Attempt:      attempt,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	_, err := t.TransactionCol.InsertOne(ctx, tx)
+	return tx, err
+}
+
+//release sends held payouts oldest first, or hands them to the batcher
+func (t *Treasury) release(ctx context.Context) (int64, error) {
+	if t.Batcher != nil {
+		res, err := t.TransactionCol.UpdateMany(ctx, bson.M{"status": TransactionHeld},
+			bson.M{"$set": bson.M{"status": TransactionQueued, "updatedAt": time.Now()}})
+		if err != nil {
+			return 0, err
+		}
+		go func() {
+			if _, err := t.Batcher.Run(context.Background()); err != nil {
+				log.Errorf("Unable to flush payout batch : %v", err)
+			}
+		}()
+		return res.ModifiedCount, nil
+	}
+
+	var held []Transaction
+	cursor, err := t.TransactionCol.Find(ctx, bson.M{"status": TransactionHeld}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return 0, err
+	}
+	if err = cursor.All(ctx, &held); err != nil {
+		return 0, err
+	}
+	var released int64
+	for _, tx := range held {
+		if err = t.releaseOne(ctx, tx); err != nil {
+			if errors.Is(err, chain.ErrFeesAboveCap) {
+				// the rest waits for cheaper gas
+				return released, nil
+			}
+			log.Errorf("Unable to release payout for userReward %s : %v", tx.UserRewardId.Hex(), err)
+			continue
+		}
+		released++
+	}
+	return released, nil
+}
+
+//recover holds again the payouts a release took but never recorded a transfer for, their release
+//ended before signing or failed to record it, so nothing reached the network
+func (t *Treasury) recover(ctx context.Context) error {
+	stale := bson.M{"status": TransactionReleasing, "updatedAt": bson.M{"$lt": time.Now().Add(-sendingTimeout)}}
+	res, err := t.TransactionCol.UpdateMany(ctx, stale, bson.M{"$set": bson.M{"status": TransactionHeld, "updatedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Warnf("%d held payouts were left releasing and are held again", res.ModifiedCount)
+	}
+	return nil
+}
+
+//releaseOne takes a held payout to releasing and sends it, the signed transfer is recorded as pending
+//before it is broadcast so the TransactionWatcher follows it whatever happens to the send
+func (t *Treasury) releaseOne(ctx context.Context, tx Transaction) error {
+	amount, err := parseAmount(tx)
+	if err != nil {
+		return err
+	}
+	res, err := t.TransactionCol.UpdateOne(ctx, bson.M{"_id": tx.ID, "status": TransactionHeld},
+		bson.M{"$set": bson.M{"status": TransactionReleasing, "updatedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		// released by another run
+		return nil
+	}
+
+	ledgerCtx, cancel := ledgerContext(ctx)
+	defer cancel()
+	recorded := false
+	sent, err := t.Transferer.Transfer(ctx, tx.Wallet, amount, func(_ context.Context, sent chain.SentTx) error {
+		set := sentFields(sent)
+		set["status"] = TransactionPending
+		_, err := t.TransactionCol.UpdateOne(ledgerCtx, bson.M{"_id": tx.ID}, bson.M{"$set": set})
+		recorded = recorded || err == nil
+		return err
+	})
+	if err != nil && recorded {
+		// the transfer may have reached the network, it is pending until the watcher sees its receipt or its nonce taken
+		log.Errorf("Released payout %s for userReward %s may not have been sent : %v", tx.ID.Hex(), tx.UserRewardId.Hex(), err)
+		return nil
+	}
+	if errors.Is(err, chain.ErrFeesAboveCap) {
+		_, uerr := t.TransactionCol.UpdateOne(ledgerCtx, bson.M{"_id": tx.ID, "status": TransactionReleasing},
+			bson.M{"$set": bson.M{"status": TransactionHeld, "updatedAt": time.Now()}})
+		if uerr != nil {
+			log.Errorf("Unable to hold transaction %s again : %v", tx.ID.Hex(), uerr)
+		}
+		return err
+	}
+	if err != nil {
+		_, uerr := t.TransactionCol.UpdateOne(ledgerCtx, bson.M{"_id": tx.ID, "status": TransactionReleasing},
+			bson.M{"$set": bson.M{"status": TransactionDropped, "updatedAt": time.Now()}})
+		if uerr != nil {
+			log.Errorf("Unable to update transaction %s : %v", tx.ID.Hex(), uerr)
+		}
+		_, uerr = transitionUserReward(ledgerCtx, tx.UserRewardId, UserRewardClaiming, UserRewardFailed, "transfer failed", "", t.UserRewardRepo)
+		if uerr != nil {
+			log.Errorf("Unable to mark userReward %s as failed : %v", tx.UserRewardId.Hex(), uerr)
+		}
+		return err
+	}
+	if err = t.UserRewardRepo.SetTxHash(ledgerCtx, tx.UserRewardId, sent.Hash); err != nil {
+		log.Errorf("Unable to update userReward %s : %v", tx.UserRewardId.Hex(), err)
+	}
+	return nil
+}
+
+//GetTreasury returns the balances of the master wallet and whether claims are paused
+func (h *TreasuryHandler) GetTreasury(c echo.Context) error {
+	if h.Treasury == nil {
+		return c.JSON(http.StatusNotFound, errorMessage{Message: "treasury monitoring is not configured"})
+	}
+	return c.JSON(http.StatusOK, h.Treasury.Status())
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"github.com/Godtide/rating/chain"
 	"github.com/Godtide/rating/dbiface"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/net/context"
 	"net/http"
@@ -14,105 +16,220 @@ import (
 
 //UserReward describes reward accrued to a user
 type UserReward struct {
-	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"validate:"omitempty"`
-	UserId    primitive.ObjectID `json:"user_id, omitempty" bson:"user_id, omitempty"`
-	RewardId  primitive.ObjectID `json:"user_id, omitempty" bson:"user_id, omitempty"`
-	status    string             `json:"status,omitempty" bson:"status" validate:"required"` //open, redeemed, expired
-	CreatedAt time.Time          `json:"createdAt" bson:"createdAt" validate:"required"`
-	expiresAt time.Time          `json:"expiresAt" bson:"expiresAt" validate:"required"` //expiry in days, gets deleted after expiry
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id" validate:"omitempty"`
+	UserId        primitive.ObjectID `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	RewardId      primitive.ObjectID `json:"reward_id,omitempty" bson:"reward_id,omitempty"`
+	RewardVersion int                `json:"rewardVersion" bson:"rewardVersion"` //version of the reward terms it was granted under and is paid out on
+	Status        string             `json:"status,omitempty" bson:"status"`     //open, claiming, redeemed, failed, expired
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt     time.Time          `json:"expiresAt" bson:"expiresAt"` //derived from Reward.Expiry, gets expired by the expiry job
+	TxHash        string             `json:"txHash,omitempty" bson:"txHash,omitempty"`
+	History       []StatusChange     `json:"history,omitempty" bson:"history,omitempty"`
+	GrantKey      string             `json:"grantKey,omitempty" bson:"grantKey,omitempty"` //set when a rating rule granted it, unique
+}
+
+//StatusChange is an audit entry recorded whenever a UserReward changes status
+type StatusChange struct {
+	From   string    `json:"from" bson:"from"`
+	To     string    `json:"to" bson:"to"`
+	At     time.Time `json:"at" bson:"at"`
+	Reason string    `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+const (
+	//UserRewardOpen a reward that can still be claimed
+	UserRewardOpen = "open"
+	//UserRewardClaiming a reward whose payout is in flight
+	UserRewardClaiming = "claiming"
+	//UserRewardRedeemed a reward that has been paid out
+	UserRewardRedeemed = "redeemed"
+	//UserRewardFailed a reward whose payout failed, it can be claimed again until it expires
+	UserRewardFailed = "failed"
+	//UserRewardExpired a reward that was not claimed before expiresAt
+	UserRewardExpired = "expired"
+)
+
+//claimRetryAfter is the Retry-After in seconds sent when a claim is refused over network fees
+const claimRetryAfter = "300"
+
+//userRewardTransitions lists the statuses a UserReward may move to from each status
+var userRewardTransitions = map[string][]string{
+	UserRewardOpen:     {UserRewardClaiming, UserRewardExpired},
+	UserRewardClaiming: {UserRewardRedeemed, UserRewardFailed},
+	UserRewardFailed:   {UserRewardClaiming, UserRewardExpired},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range userRewardTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//transitionUserReward atomically moves a UserReward from one status to another, storing txHash along when set,
+//it returns false when the document was no longer in the from status
+func transitionUserReward(ctx context.Context, id primitive.ObjectID, from, to, reason, txHash string, repo UserRewardRepo) (bool, error) {
+	if !canTransition(from, to) {
+		return false, fmt.Errorf("invalid userReward transition %s -> %s", from, to)
+	}
+	change := StatusChange{From: from, To: to, At: time.Now(), Reason: reason}
+	moved, err := repo.Transition(ctx, id, change, txHash)
+	if err != nil {
+		log.Errorf("Unable to move userReward %s from %s to %s : %v", id.Hex(), from, to, err)
+		return false, err
+	}
+	return moved, nil
+}
+
+//userRewardRequest is the client payload for creating a UserReward, everything else is derived server-side
+type userRewardRequest struct {
+	UserId   primitive.ObjectID `json:"user_id" validate:"required"`
+	RewardId primitive.ObjectID `json:"reward_id" validate:"required"`
 }
 
 //UserRewardHandler a user_reward handler
 type UserRewardHandler struct {
-	UserRewardCol dbiface.CollectionAPI
-	RewardCol     dbiface.CollectionAPI
-	WalletCol     dbiface.CollectionAPI
-	Wallet        Wallet
-	Apikey        string 
-	ContractAdrress string
+	UserRewardRepo UserRewardRepo
+	RewardRepo     RewardRepo
+	WalletRepo     WalletRepo
+	IdempotencyCol dbiface.CollectionAPI
+	TransactionCol dbiface.CollectionAPI
+	Transferer     chain.TokenTransferer
+	Batcher        *Batcher  //claims are paid out in batches when set
+	Treasury       *Treasury //claims are held while the master wallet runs low when set
 }
 
-func insertUserReward(ctx context.Context, userReward UserReward, collection dbiface.CollectionAPI) (interface{}, *echo.HTTPError) {
-	userReward.ID = primitive.NewObjectID()
+//openUserReward grants the current version of reward with userReward, it expires after the expiry of the reward
+func openUserReward(userReward UserReward, reward Reward) UserReward {
+	userReward.RewardId, userReward.RewardVersion = reward.ID, reward.Version
 	userReward.CreatedAt = time.Now()
+	userReward.ExpiresAt = userReward.CreatedAt.AddDate(0, 0, int(reward.Expiry))
+	userReward.Status = UserRewardOpen
+	return userReward
+}
 
-	insertID, err := collection.InsertOne(ctx, userReward)
+func insertUserReward(ctx context.Context, userReward UserReward, reward Reward, repo UserRewardRepo) (interface{}, *echo.HTTPError) {
+	userReward, err := repo.Create(ctx, openUserReward(userReward, reward))
 	if err != nil {
 		log.Errorf("Unable to insert to Database:%v", err)
 		return nil,
 			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
 	}
-	return insertID.InsertedID, nil
+	return userReward.ID, nil
 }
 
-//CreateRewards create rewards on mongodb 
+//CreateUserRewards grants a reward type to a user, expiry and status are derived from the Reward.
+//Only admins grant rewards, users are granted them by admins and rating rules
 func (r *UserRewardHandler) CreateUserRewards(c echo.Context) error {
-	var reward UserReward
-	c.Echo().Validator = &rewardValidator{validator: v}
-	if err := c.Bind(&reward); err != nil {
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	if !claims.IsAdmin {
+		log.Errorf("User %s is not allowed to grant rewards", claims.UserID)
+		return c.JSON(http.StatusForbidden, errorMessage{Message: "only admins grant rewards"})
+	}
+	var req userRewardRequest
+	c.Echo().Validator = &userRewardValidator{validator: v}
+	if err := c.Bind(&req); err != nil {
 		log.Errorf("Unable to bind : %v", err)
 		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse request payload"})
 	}
-	if err := c.Validate(reward); err != nil {
-		log.Errorf("Unable to validate the userReward %+v %v", reward, err)
+	if err := c.Validate(req); err != nil {
+		log.Errorf("Unable to validate the userReward %+v %v", req, err)
 		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
 	}
-	IDs, httpError := insertUserReward(context.Background(), reward, r.UserRewardCol)
+	reward, httpError := findReward(context.Background(), req.RewardId.Hex(), r.RewardRepo)
+	if httpError != nil {
+		log.Errorf("Unknown reward type %s", req.RewardId.Hex())
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unknown reward"})
+	}
+	if !reward.DeletedAt.IsZero() {
+		log.Errorf("Reward %s is archived", req.RewardId.Hex())
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "reward is archived"})
+	}
+	IDs, httpError := insertUserReward(context.Background(), UserReward{UserId: req.UserId}, reward, r.UserRewardRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
 	return c.JSON(http.StatusCreated, IDs)
 }
 
-func findUserRewards(ctx context.Context, q url.Values, collection dbiface.CollectionAPI) ([]UserReward, *echo.HTTPError) {
-	var userRewards []UserReward
-	filter := make(map[string]interface{})
-	for k, v := range q {
-		filter[k] = v[0]
+//userRewardSorts are the fields GET /reward may sort on
+var userRewardSorts = []string{"_id", "createdAt", "expiresAt"}
+
+func userRewardSortValue(userReward UserReward, field string) interface{} {
+	switch field {
+	case "createdAt":
+		return userReward.CreatedAt
+	case "expiresAt":
+		return userReward.ExpiresAt
 	}
-	if filter["_id"] != nil {
-		docID, err := primitive.ObjectIDFromHex(filter["_id"].(string))
-		if err != nil {
-			log.Errorf("Unable to convert to Object ID : %v", err)
-			return userRewards,
-				echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
-		}
-		filter["_id"] = docID
+	return userReward.ID
+}
+
+//findUserRewards returns a page of the userRewards matching q and the cursor of the next page, if any.
+//scope is added to the conditions of q
+func findUserRewards(ctx context.Context, q url.Values, scope Filter, repo UserRewardRepo) ([]UserReward, string, *echo.HTTPError) {
+	userRewards, next := []UserReward{}, ""
+	filter, err := parseFilter(q, userRewardFields)
+	var page Page
+	if err == nil {
+		page, err = parsePage(q, userRewardFields, userRewardSorts)
+	}
+	if err == nil {
+		userRewards, err = repo.Find(ctx, append(filter, scope...), page.more())
+	}
+	if errors.Is(err, ErrInvalidFilter) {
+		log.Errorf("Unable to filter the userRewards : %v", err)
+		return userRewards, next,
+			echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: err.Error()})
 	}
-	cursor, err := collection.Find(ctx, bson.M(filter))
 	if err != nil {
 		log.Errorf("Unable to find the userReward : %v", err)
-		return userRewards,
+		return userRewards, next,
 			echo.NewHTTPError(http.StatusNotFound, errorMessage{Message: "unable to find the userReward"})
 	}
-	err = cursor.All(ctx, &userRewards)
-	if err != nil {
-		log.Errorf("Unable to read the cursor : %v", err)
-		return userRewards,
-			echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse retrieved userRewards"})
+	if len(userRewards) > page.Limit {
+		userRewards = userRewards[:page.Limit]
+		last := userRewards[page.Limit-1]
+		next = page.next(userRewardSortValue(last, page.SortField()), last.ID)
 	}
-	return userRewards, nil
+	return userRewards, next, nil
 }
 
-//GetRewards gets a list of reward
+//GetUserRewards lists a page of userRewards, users other than admins only see their own
 func (r *UserRewardHandler) GetUserRewards(c echo.Context) error {
-	userRewards, httpError := findUserRewards(context.Background(), c.QueryParams(), r.UserRewardCol)
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	var scope Filter
+	if !claims.IsAdmin {
+		userID, err := primitive.ObjectIDFromHex(claims.UserID)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+		}
+		scope = Filter{Eq("user_id", userID)}
+	}
+	userRewards, next, httpError := findUserRewards(context.Background(), c.QueryParams(), scope, r.UserRewardRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
+	setNextPage(c, next)
 	return c.JSON(http.StatusOK, userRewards)
 }
 
-func findUserReward(ctx context.Context, id string, collection dbiface.CollectionAPI) (UserReward, *echo.HTTPError) {
-	var reward UserReward
+func findUserReward(ctx context.Context, id string, repo UserRewardRepo) (UserReward, *echo.HTTPError) {
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		log.Errorf("Unable to convert to Object ID : %v", err)
-		return reward,
+		return UserReward{},
 			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
 	}
-	res := collection.FindOne(ctx, bson.M{"_id": docID})
-	err = res.Decode(&reward)
+	reward, err := repo.FindByID(ctx, docID)
 	if err != nil {
 		log.Errorf("Unable to find the reward : %v", err)
 		return reward,
@@ -123,59 +240,151 @@ func findUserReward(ctx context.Context, id string, collection dbiface.Collectio
 
 //GetUserReward gets a single userReward
 func (r *UserRewardHandler) GetUserReward(c echo.Context) error {
-	reward, httpError := findUserReward(context.Background(), c.Param("id"), r.UserRewardCol)
+	reward, httpError := findUserReward(context.Background(), c.Param("id"), r.UserRewardRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
 	return c.JSON(http.StatusOK, reward)
 }
 
-//claim rewards
+//ClaimReward pays out a UserReward to the owner's wallet, retries carrying the same
+//Idempotency-Key header get the original response back instead of a second transfer
 func (r *UserRewardHandler) ClaimReward(c echo.Context) error {
-	var (
-		wallet Wallet
-		txHash string
-	)
-	userReward, httpError := findUserReward(context.Background(), c.Param("id"), r.UserRewardCol)
-	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	claim := func() (int, interface{}) {
+		code, body := r.claimReward(c.Param("id"), claims)
+		if code == http.StatusServiceUnavailable {
+			c.Response().Header().Set(echo.HeaderRetryAfter, claimRetryAfter)
+		}
+		return code, body
 	}
-	reward, httpError := findReward(context.Background(), userReward.RewardId.String(), r.RewardCol)
+	key := c.Request().Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		code, body := claim()
+		return c.JSON(code, body)
+	}
+	return withIdempotency(c, r.IdempotencyCol, claims.UserID, key, claim)
+}
+
+func (r *UserRewardHandler) claimReward(id string, claims *UserClaims) (int, interface{}) {
+	ctx := context.Background()
+	userReward, httpError := findUserReward(ctx, id, r.UserRewardRepo)
 	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+		return httpError.Code, httpError.Message
+	}
+	if claims.UserID != userReward.UserId.Hex() && !claims.IsAdmin {
+		log.Errorf("User is not allowed to claim userReward %s", userReward.ID.Hex())
+		return http.StatusForbidden, errorMessage{Message: "not allowed to claim this reward"}
+	}
+	switch userReward.Status {
+	case UserRewardRedeemed:
+		return http.StatusConflict, errorMessage{Message: "reward already redeemed"}
+	case UserRewardClaiming:
+		return http.StatusConflict, errorMessage{Message: "reward claim already in progress"}
+	}
+	moved, err := transitionUserReward(ctx, userReward.ID, userReward.Status, UserRewardClaiming, "claim requested", "", r.UserRewardRepo)
+	if err != nil || !moved {
+		log.Errorf("UserReward %s is %s and cannot be claimed", userReward.ID.Hex(), userReward.Status)
+		return http.StatusConflict, errorMessage{Message: "reward is no longer claimable"}
 	}
 
-	wallet, httpError = findWallet(context.Background(), userReward.UserId.String(), r.WalletCol)
+	fail := func(code int, reason string) (int, interface{}) {
+		if _, err := transitionUserReward(ctx, userReward.ID, UserRewardClaiming, UserRewardFailed, reason, "", r.UserRewardRepo); err != nil {
+			log.Errorf("Unable to mark userReward %s as failed : %v", userReward.ID.Hex(), err)
+		}
+		return code, errorMessage{Message: reason}
+	}
+	// paid out on the terms it was granted under, whatever the reward says now
+	reward, err := r.RewardRepo.FindVersion(ctx, userReward.RewardId, userReward.RewardVersion)
+	if err != nil {
+		log.Errorf("Unable to find version %d of reward %s : %v", userReward.RewardVersion, userReward.RewardId.Hex(), err)
+		return fail(http.StatusNotFound, "unable to find the reward")
+	}
+	wallet, httpError := findWallet(ctx, userReward.UserId.Hex(), r.WalletRepo)
 	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+		return fail(httpError.Code, "unable to find the wallet")
+	}
+	decimals, err := r.Transferer.Decimals(ctx)
+	if err != nil {
+		log.Errorf("Unable to read the token decimals : %v", err)
+		return fail(http.StatusBadGateway, "unable to transfer the reward")
+	}
+	redeemableAmount, err := reward.Points.Mul(reward.AmountRedeemable).BaseUnits(decimals)
+	if err != nil {
+		log.Errorf("Unable to pay out version %d of reward %s : %v", reward.Version, reward.ID.Hex(), err)
+		return fail(http.StatusUnprocessableEntity, "reward cannot be paid out in this token")
 	}
-	var redeemableAmount = reward.Points * reward.AmountRedeemable
-	txHash, _ = transferRewards(r.Wallet, wallet.PublicKey, string(redeemableAmount), r.ApiKey, r.ContractAdrress)
+	if redeemableAmount.Sign() <= 0 {
+		return fail(http.StatusUnprocessableEntity, "reward has nothing to redeem")
+	}
+	if r.Treasury.Paused() {
+		tx, err := r.Treasury.hold(ctx, userReward.ID, wallet.PublicKey, redeemableAmount, 1)
+		if err != nil {
+			log.Errorf("Unable to hold payout of userReward %s : %v", userReward.ID.Hex(), err)
+			return fail(http.StatusInternalServerError, "unable to queue the reward")
+		}
+		return http.StatusAccepted, tx
+	}
+	if r.Batcher != nil {
+		tx, err := r.Batcher.Enqueue(ctx, userReward.ID, wallet.PublicKey, redeemableAmount, 1)
+		if err != nil {
+			log.Errorf("Unable to queue payout of userReward %s : %v", userReward.ID.Hex(), err)
+			return fail(http.StatusInternalServerError, "unable to queue the reward")
+		}
+		return http.StatusAccepted, tx
+	}
+	tx, err := sendTransfer(ctx, r.Transferer, userReward.ID, wallet.PublicKey, redeemableAmount, 1, r.TransactionCol)
+	if err != nil {
+		log.Errorf("Unable to transfer userReward %s : %v", userReward.ID.Hex(), err)
+		if errors.Is(err, chain.ErrFeesAboveCap) {
+			return fail(http.StatusServiceUnavailable, "network fees are above policy, retry later")
+		}
+		return fail(http.StatusBadGateway, "unable to transfer the reward")
+	}
+	// the reward stays claiming until the TransactionWatcher sees the receipt
+	if err = r.UserRewardRepo.SetTxHash(ctx, userReward.ID, tx.TxHash); err != nil {
+		log.Errorf("Transfer %s sent but userReward %s was not updated : %v", tx.TxHash, userReward.ID.Hex(), err)
+	}
+	return http.StatusOK, tx.TxHash
+}
 
-	return c.JSON(http.StatusOK, txHash)
+//ExpireUserRewards moves every open or failed UserReward past its expiresAt to expired
+func ExpireUserRewards(ctx context.Context, repo UserRewardRepo) (int64, error) {
+	expired, err := repo.Expire(ctx, time.Now())
+	if err != nil {
+		log.Errorf("Unable to expire userRewards : %v", err)
+		return expired, err
+	}
+	if expired > 0 {
+		log.Infof("Expired %d userRewards", expired)
+	}
+	return expired, nil
 }
 
-func deleteUserReward(ctx context.Context, id string, collection dbiface.CollectionAPI) (int64, *echo.HTTPError) {
+func deleteUserReward(ctx context.Context, id string, repo UserRewardRepo) *echo.HTTPError {
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		log.Errorf("Unable convert to ObjectID : %v", err)
-		return 0,
-			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
+		return echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
+	}
+	err = repo.Delete(ctx, docID)
+	if errors.Is(err, ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, errorMessage{Message: "unable to find the userReward"})
 	}
-	res, err := collection.DeleteOne(ctx, bson.M{"_id": docID})
 	if err != nil {
 		log.Errorf("Unable to delete the userRewards : %v", err)
-		return 0,
-			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to delete the userRewards"})
+		return echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to delete the userRewards"})
 	}
-	return res.DeletedCount, nil
+	return nil
 }
 
-//DeleteUserReward gets a single UserReward
+//DeleteUserReward deletes a single UserReward
 func (r *UserRewardHandler) DeleteUserReward(c echo.Context) error {
-	delCount, httpError := deleteUserReward(context.Background(), c.Param("id"), h.Col)
-	if httpError != nil {
+	if httpError := deleteUserReward(context.Background(), c.Param("id"), r.UserRewardRepo); httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
-	return c.JSON(http.StatusOK, delCount)
+	return c.NoContent(http.StatusNoContent)
 }
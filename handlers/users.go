@@ -2,18 +2,17 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
 	"time"
 
 	"github.com/Godtide/rating/config"
-	"github.com/Godtide/rating/dbiface"
+	"github.com/Godtide/rating/keyvault"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -27,18 +26,48 @@ type User struct {
 
 //UsersHandler users handler
 type UsersHandler struct {
-	UserCol   dbiface.CollectionAPI
-	WalletCol dbiface.CollectionAPI
+	UserRepo   UserRepo
+	WalletRepo WalletRepo
+	Transactor Transactor //users and their wallets are stored atomically when set
+	Vault      keyvault.KeyVault
+	Wallets    WalletGenerator
 }
 
 type errorMessage struct {
 	Message string `json:"message"`
 }
 
+//UserClaims are the claims carried by an access token
+type UserClaims struct {
+	UserID  string `json:"user_id"`
+	IsAdmin bool   `json:"isadmin"`
+	jwt.StandardClaims
+}
+
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+const (
+	//ClaimsKey is the echo context key the auth middleware stores UserClaims under
+	ClaimsKey = "claims"
+)
+
 var (
-	prop config.Properties
+	prop config.TokenProperties
 )
 
+//ConfigureTokens sets the secret and lifetime access tokens are signed and parsed with, it fails on a
+//secret too short to sign with
+func ConfigureTokens(p config.TokenProperties) error {
+	if err := p.CheckJwtSecret(); err != nil {
+		return err
+	}
+	prop = p
+	return nil
+}
+
 func isCredValid(givenPwd, storedPwd string) bool {
 	if err := bcrypt.CompareHashAndPassword([]byte(storedPwd), []byte(givenPwd)); err != nil {
 		return false
@@ -46,24 +75,63 @@ func isCredValid(givenPwd, storedPwd string) bool {
 	return true
 }
 
-func insertUser(ctx context.Context, user User, collection dbiface.CollectionAPI) (User, *echo.HTTPError) {
-	var newUser User
-
-	res := collection.FindOne(ctx, bson.M{"username": user.Email})
-
-	err := res.Decode(&newUser)
+func (u User) createToken() (tokenResponse, error) {
+	expiresAt := time.Now().Add(time.Minute * time.Duration(prop.JwtTokenTTL)).Unix()
+	claims := UserClaims{
+		UserID:  u.ID.Hex(),
+		IsAdmin: u.IsAdmin,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   u.Email,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expiresAt,
+		},
+	}
+	at := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token, err := at.SignedString([]byte(prop.JwtTokenSecret))
+	if err != nil {
+		log.Errorf("Unable to generate the token :%v", err)
+		return tokenResponse{}, err
+	}
+	return tokenResponse{Token: token, ExpiresAt: expiresAt}, nil
+}
 
-	if err != nil && err != mongo.ErrNoDocuments {
-		log.Errorf("Unable to decode retrieved user: %v", err)
-		return newUser,
-			echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to decode retrieved user"})
+//ParseToken validates a signed access token and returns its claims
+func ParseToken(token string) (*UserClaims, error) {
+	claims := &UserClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return []byte(prop.JwtTokenSecret), nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if newUser.Email != "" {
+	if _, err := primitive.ObjectIDFromHex(claims.UserID); err != nil {
+		return nil, fmt.Errorf("invalid user id in token: %v", err)
+	}
+	return claims, nil
+}
 
+//CurrentUser returns the claims of the authenticated caller
+func CurrentUser(c echo.Context) (*UserClaims, bool) {
+	claims, ok := c.Get(ClaimsKey).(*UserClaims)
+	return claims, ok
+}
+
+//hashUser checks the username is free and replaces the password with its bcrypt hash
+func hashUser(ctx context.Context, user User, repo UserRepo) (User, *echo.HTTPError) {
+	_, err := repo.FindByUsername(ctx, user.Email)
+	if err == nil {
 		log.Errorf("User by %s already exists", user.Email)
-		return newUser,
+		return user,
 			echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: "User already exists"})
 	}
+	if !errors.Is(err, ErrNotFound) {
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return user,
+			echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to decode retrieved user"})
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 8)
 	if err != nil {
@@ -72,26 +140,87 @@ func insertUser(ctx context.Context, user User, collection dbiface.CollectionAPI
 			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to process the password"})
 	}
 	user.Password = string(hashedPassword)
+	return user, nil
+}
 
-	_, err = collection.InsertOne(ctx, user)
-
-	newRes := collection.FindOne(ctx, bson.M{"username": user.Email})
-	err = newRes.Decode(&newUser)
+//createUserError maps errors storing a new user to responses
+func createUserError(user User, err error) *echo.HTTPError {
+	if errors.Is(err, ErrConflict) {
+		// lost a race against a concurrent signup
+		log.Errorf("User by %s already exists", user.Email)
+		return echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: "User already exists"})
+	}
+	log.Errorf("Unable to insert the user :%+v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to create the user"})
+}
 
+func insertUser(ctx context.Context, user User, repo UserRepo) (User, *echo.HTTPError) {
+	user, httpError := hashUser(ctx, user, repo)
+	if httpError != nil {
+		return user, httpError
+	}
+	newUser, err := repo.Create(ctx, user)
 	if err != nil {
-		log.Errorf("Unable to insert the user :%+v", err)
-		return user,
-			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to create the user"})
+		return user, createUserError(user, err)
 	}
 	return newUser, nil
 }
 
-//CreateUser creates a user
-func (h *UsersHandler) CreateUser(c echo.Context) error {
-	var (
-		user    User
-		resUser User
-	)
+//storeUserWithWallet stores the user and its wallet in one transaction. Without a Transactor, or on a
+//standalone mongo that cannot run one, the user is deleted again when its wallet cannot be stored
+func (h *UsersHandler) storeUserWithWallet(ctx context.Context, user User, wallet Wallet) (User, Wallet, error) {
+	store := func(ctx context.Context) error {
+		var err error
+		if user, err = h.UserRepo.Create(ctx, user); err != nil {
+			return err
+		}
+		wallet.UserId = user.ID
+		wallet, err = h.WalletRepo.Create(ctx, wallet)
+		return err
+	}
+	if h.Transactor != nil {
+		err := h.Transactor.WithTransaction(ctx, store)
+		if err == nil {
+			return user, wallet, nil
+		}
+		if !errors.Is(err, ErrNoTransactions) {
+			return User{}, Wallet{}, err
+		}
+		log.Warnf("Storing user %s without a transaction : %v", user.Email, err)
+	}
+	if err := store(ctx); err != nil {
+		if !user.ID.IsZero() {
+			if derr := h.UserRepo.Delete(ctx, user.ID); derr != nil {
+				log.Errorf("User %s is left without a wallet, run cmd/provisionwallets : %v", user.ID.Hex(), derr)
+			}
+		}
+		return User{}, Wallet{}, err
+	}
+	return user, wallet, nil
+}
+
+func authenticateUser(ctx context.Context, reqUser User, repo UserRepo) (User, *echo.HTTPError) {
+	storedUser, err := repo.FindByUsername(ctx, reqUser.Email)
+	if errors.Is(err, ErrNotFound) {
+		log.Errorf("User %s does not exist.", reqUser.Email)
+		return storedUser,
+			echo.NewHTTPError(http.StatusUnauthorized, errorMessage{Message: "Credentials invalid"})
+	}
+	if err != nil {
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return storedUser,
+			echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to decode retrieved user"})
+	}
+	if !isCredValid(reqUser.Password, storedUser.Password) {
+		return storedUser,
+			echo.NewHTTPError(http.StatusUnauthorized, errorMessage{Message: "Credentials invalid"})
+	}
+	return User{ID: storedUser.ID, Email: storedUser.Email, IsAdmin: storedUser.IsAdmin}, nil
+}
+
+//AuthnUser authenticates a user and issues an access token
+func (h *UsersHandler) AuthnUser(c echo.Context) error {
+	var user User
 	c.Echo().Validator = &userValidator{validator: v}
 	if err := c.Bind(&user); err != nil {
 		log.Errorf("Unable to bind to user struct.")
@@ -103,16 +232,81 @@ func (h *UsersHandler) CreateUser(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest,
 			errorMessage{Message: "Unable to validate request body"})
 	}
-	resUser, httpError := insertUser(context.Background(), user, h.UserCol)
+	user, httpError := authenticateUser(context.Background(), user, h.UserRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
+	token, err := user.createToken()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError,
+			errorMessage{Message: "Unable to generate the token"})
+	}
+	return c.JSON(http.StatusOK, token)
+}
 
-	fullWallet, httpError := createUserWallet(context.Background(), resUser.ID, h.WalletCol)
+//SeedAdmin makes sure the configured admin account exists and holds the admin role
+func SeedAdmin(ctx context.Context, email, password string, repo UserRepo) error {
+	if email == "" {
+		return nil
+	}
+	storedUser, err := repo.FindByUsername(ctx, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("unable to look up admin user: %v", err)
+	}
+	if err == nil {
+		if storedUser.IsAdmin {
+			return nil
+		}
+		if err = repo.SetAdmin(ctx, storedUser.ID, true); err != nil {
+			return fmt.Errorf("unable to promote admin user: %v", err)
+		}
+		log.Infof("Promoted %s to admin", email)
+		return nil
+	}
+	if len(password) < 8 {
+		return fmt.Errorf("admin password must be at least 8 characters")
+	}
+	_, httpError := insertUser(ctx, User{Email: email, Password: password, IsAdmin: true}, repo)
+	if httpError != nil {
+		return fmt.Errorf("unable to create admin user: %v", httpError.Message)
+	}
+	log.Infof("Created admin user %s", email)
+	return nil
+}
 
+//CreateUser creates a user
+func (h *UsersHandler) CreateUser(c echo.Context) error {
+	var user User
+	c.Echo().Validator = &userValidator{validator: v}
+	if err := c.Bind(&user); err != nil {
+		log.Errorf("Unable to bind to user struct.")
+		return c.JSON(http.StatusUnprocessableEntity,
+			errorMessage{Message: "Unable to parse the request payload."})
+	}
+	if err := c.Validate(user); err != nil {
+		log.Errorf("Unable to validate the requested body.")
+		return c.JSON(http.StatusBadRequest,
+			errorMessage{Message: "Unable to validate request body"})
+	}
+	// admins are only ever provisioned through SeedAdmin
+	user.IsAdmin = false
+	ctx := context.Background()
+	user, httpError := hashUser(ctx, user, h.UserRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
-
-	return c.JSON(http.StatusCreated, fullWallet)
+	// generate and seal the key first, so a failure leaves nothing behind
+	wallet, err := sealedWallet(ctx, h.Wallets, h.Vault)
+	if err != nil {
+		log.Errorf("Unable to create wallet :%+v", err)
+		return c.JSON(http.StatusBadRequest,
+			errorMessage{Message: "error generating public and private keys public address "})
+	}
+	_, wallet, err = h.storeUserWithWallet(ctx, user, wallet)
+	if err != nil {
+		httpError = createUserError(user, err)
+		return c.JSON(httpError.Code, httpError.Message)
+	}
+	wallet.SealedKey = ""
+	return c.JSON(http.StatusCreated, wallet)
 }
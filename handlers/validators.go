@@ -30,3 +30,11 @@ type userRewardValidator struct {
 func (ur *userRewardValidator) Validate(i interface{}) error {
 	return ur.validator.Struct(i)
 }
+
+type ratingValidator struct {
+	validator *validator.Validate
+}
+
+func (r *ratingValidator) Validate(i interface{}) error {
+	return r.validator.Struct(i)
+}
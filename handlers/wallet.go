@@ -1,102 +1,120 @@
 package handlers
 
 import (
-	"crypto/ecdsa"
 	"fmt"
 	"github.com/Godtide/rating/dbiface"
-	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/common"
+	"github.com/Godtide/rating/keyvault"
 	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/sha3"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/net/context"
-	"math/big"
 	"net/http"
+	"time"
 )
 
 //Wallet describes a user wallet to manage keys
 type Wallet struct {
 	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	UserId     primitive.ObjectID `json:"user_id, omitempty" bson:"user_id, omitempty"`
-	PrivateKey string             `json:"private_key" bson:"private_key" validate:"required"`
+	UserId     primitive.ObjectID `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	PrivateKey string             `json:"-" bson:"-"` //only ever held in memory, persisted sealed in SealedKey
+	SealedKey  string             `json:"-" bson:"sealed_key,omitempty"`
+	LegacyKey  string             `json:"-" bson:"private_key,omitempty"` //plain key written by old releases, see RepairWallets
 	PublicKey  string             `json:"public_key" bson:"public_key" validate:"required"`
+	HDIndex    *uint32            `json:"-" bson:"hd_index,omitempty"` //derivation index under hdwallet.BasePath for HD wallets
+	External   bool               `json:"external,omitempty" bson:"external,omitempty"` //linked user owned address, we hold no key
+	LinkedAt   time.Time          `json:"linkedAt,omitempty" bson:"linkedAt,omitempty"`
+	Nonce      *uint64            `json:"-" bson:"nonce,omitempty"` //last nonce used, only tracked for the master wallet
 }
 
-type WalletHandler struct {
+//WalletNonceStore persists the master wallet nonce on its wallet document
+type WalletNonceStore struct {
 	WalletCol dbiface.CollectionAPI
 }
 
-func createUserWallet(ctx context.Context, userId primitive.ObjectID, collection dbiface.CollectionAPI) (interface{}, *echo.HTTPError) {
-	partWallet, err := createWallet()
+type WalletHandler struct {
+	WalletRepo   WalletRepo
+	ChallengeCol dbiface.CollectionAPI
+}
+
+//sealedWallet generates a custodial wallet and seals its private key with vault, it is not stored yet
+func sealedWallet(ctx context.Context, generator WalletGenerator, vault keyvault.KeyVault) (Wallet, error) {
+	generated, err := generator.Generate(ctx)
 	if err != nil {
-		log.Errorf("Unable to create wallet :%+v", err)
-		return partWallet,
-			echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: "error generating public and private keys public address "})
+		return Wallet{}, fmt.Errorf("unable to generate the wallet key: %v", err)
 	}
-
-	fullWallet, httpError := insertWallet(ctx, Wallet{
-		UserId:     userId,
-		PrivateKey: partWallet.PrivateKey,
-		PublicKey:  partWallet.PublicKey,
-	}, collection)
-
-	if httpError != nil {
-		return partWallet,
-			echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: "error creating wallet"})
+	raw, err := hexutil.Decode(generated.PrivateKey)
+	if err != nil {
+		return Wallet{}, fmt.Errorf("unable to decode the private key: %v", err)
 	}
-	return fullWallet, nil
+	sealed, err := vault.Encrypt(ctx, raw)
+	if err != nil {
+		return Wallet{}, fmt.Errorf("unable to seal the private key: %v", err)
+	}
+	return Wallet{PublicKey: generated.PublicKey, SealedKey: sealed, HDIndex: generated.HDIndex}, nil
 }
 
-func insertWallet(ctx context.Context, wallet Wallet, collection dbiface.CollectionAPI) (interface{}, *echo.HTTPError) {
-	var insertedId interface{}
-	insertedId, err := collection.InsertOne(ctx, wallet)
+//createUserWallet provisions a custodial wallet for the user, the returned wallet carries no key material
+func createUserWallet(ctx context.Context, userId primitive.ObjectID, generator WalletGenerator, vault keyvault.KeyVault,
+	repo WalletRepo) (Wallet, error) {
+	wallet, err := sealedWallet(ctx, generator, vault)
 	if err != nil {
-		log.Errorf("Unable to insert to Database:%v", err)
-		return nil,
-			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
+		return Wallet{}, err
 	}
-	return insertedId, nil
+	wallet.UserId = userId
+	if wallet, err = repo.Create(ctx, wallet); err != nil {
+		return Wallet{}, err
+	}
+	wallet.SealedKey = ""
+	return wallet, nil
 }
 
-func createWallet() (Wallet, error) {
-	privateKey, err := crypto.GenerateKey()
+//LastNonce returns the last nonce used by account, ok is false when none was recorded
+func (s *WalletNonceStore) LastNonce(ctx context.Context, account string) (uint64, bool, error) {
+	var wallet Wallet
+	err := s.WalletCol.FindOne(ctx, bson.M{"public_key": account}).Decode(&wallet)
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return 0, false, err
 	}
-	publicKey := privateKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		log.Fatal("error casting public key to ECDSA")
+	if wallet.Nonce == nil {
+		return 0, false, nil
 	}
-	address := crypto.PubkeyToAddress(*publicKeyECDSA).Hex()
+	return *wallet.Nonce, true, nil
+}
 
-	hash := sha3.NewLegacyKeccak256()
-	fmt.Println(hexutil.Encode(hash.Sum(nil)[12:]))
+//SaveNonce records nonce as used by account, the stored value never decreases
+func (s *WalletNonceStore) SaveNonce(ctx context.Context, account string, nonce uint64) error {
+	_, err := s.WalletCol.UpdateOne(ctx, bson.M{"public_key": account},
+		bson.M{"$max": bson.M{"nonce": nonce}}, options.Update().SetUpsert(true))
+	return err
+}
 
-	return Wallet{
-		PrivateKey: hexutil.Encode(hash.Sum(nil)[12:]),
-		PublicKey:  address,
-	}, nil
+//ResetNonce replaces the nonce recorded for account so the next one used is pending
+func (s *WalletNonceStore) ResetNonce(ctx context.Context, account string, pending uint64) error {
+	update := bson.M{"$unset": bson.M{"nonce": ""}}
+	if pending > 0 {
+		update = bson.M{"$set": bson.M{"nonce": pending - 1}}
+	}
+	_, err := s.WalletCol.UpdateOne(ctx, bson.M{"public_key": account}, update, options.Update().SetUpsert(true))
+	return err
 }
 
 //find user wallets
 
-func findWallet(ctx context.Context, userId string, collection dbiface.CollectionAPI) (Wallet, *echo.HTTPError) {
-	var wallet Wallet
+func findWallet(ctx context.Context, userId string, repo WalletRepo) (Wallet, *echo.HTTPError) {
 	docID, err := primitive.ObjectIDFromHex(userId)
 	if err != nil {
 		log.Errorf("Unable to convert to Object ID : %v", err)
-		return wallet,
+		return Wallet{},
 			echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "unable to convert to ObjectID"})
 	}
-	res := collection.FindOne(ctx, bson.M{"user_id": docID})
-	err = res.Decode(&wallet)
+	wallet, err := repo.FindByUser(ctx, docID)
 	if err != nil {
 		log.Errorf("Unable to find the wallet : %v", err)
 		return wallet,
@@ -105,89 +123,24 @@ func findWallet(ctx context.Context, userId string, collection dbiface.Collectio
 	return wallet, nil
 }
 
+//unsealWallet decrypts the private key of a wallet returned by findWallet
+func unsealWallet(ctx context.Context, wallet Wallet, vault keyvault.KeyVault) (Wallet, error) {
+	if wallet.SealedKey == "" {
+		return wallet, fmt.Errorf("wallet %s has no sealed key", wallet.PublicKey)
+	}
+	key, err := vault.Decrypt(ctx, wallet.SealedKey)
+	if err != nil {
+		return wallet, err
+	}
+	wallet.PrivateKey = hexutil.Encode(key)
+	return wallet, nil
+}
+
 //GetWallet gets a single wallet by userId
 func (h *WalletHandler) GetWallet(c echo.Context) error {
-	wallet, httpError := findWallet(context.Background(), c.Param("id"), h.WalletCol)
+	wallet, httpError := findWallet(context.Background(), c.Param("id"), h.WalletRepo)
 	if httpError != nil {
 		return c.JSON(httpError.Code, httpError.Message)
 	}
 	return c.JSON(http.StatusOK, wallet)
 }
-
-func transferRewards(wallet Wallet, userPublicKey string, rewardAmount string, key string, contractAddress string) (string, error) {
-
-	var provider string = "https://optimism-mainnet.infura.io/v3/"
-
-	client, err := ethclient.Dial(provider + key)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	privateKey, err := crypto.HexToECDSA(wallet.PrivateKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fromAddress := common.HexToAddress(wallet.PublicKey)
-
-	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	value := big.NewInt(0) // in wei (0 eth)
-	gasPrice, err := client.SuggestGasPrice(context.Background())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	toAddress := common.HexToAddress(userPublicKey)
-	tokenAddress := common.HexToAddress(contractAddress)
-
-	transferFnSignature := []byte("transfer(address,uint256)")
-	hash := sha3.NewLegacyKeccak256()
-	hash.Write(transferFnSignature)
-	methodID := hash.Sum(nil)[:4]
-	fmt.Println(hexutil.Encode(methodID)) 
-
-	paddedAddress := common.LeftPadBytes(toAddress.Bytes(), 32)
-	fmt.Println(hexutil.Encode(paddedAddress))
-
-	amount := new(big.Int)
-	amount.SetString(rewardAmount+"e18", 10) 
-	paddedAmount := common.LeftPadBytes(amount.Bytes(), 32)
-	fmt.Println(hexutil.Encode(paddedAmount))
-
-	var data []byte
-	data = append(data, methodID...)
-	data = append(data, paddedAddress...)
-	data = append(data, paddedAmount...)
-
-	gasLimit, err := client.EstimateGas(context.Background(), ethereum.CallMsg{
-		To:   &toAddress,
-		Data: data,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	tx := types.NewTransaction(nonce, tokenAddress, value, gasLimit, gasPrice, data)
-
-	chainID, err := client.NetworkID(context.Background())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), privateKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = client.SendTransaction(context.Background(), signedTx)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Printf("tx sent: %s", signedTx.Hash().Hex())
-
-	return signedTx.Hash().Hex(), nil
-
-}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Godtide/rating/dbiface"
+	"github.com/Godtide/rating/hdwallet"
+	"github.com/Godtide/rating/keyvault"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+//WalletGenerator creates the key pair of a new custodial wallet
+type WalletGenerator interface {
+	Generate(ctx context.Context) (Wallet, error)
+}
+
+//RandomWalletGenerator creates every wallet from an independent random key
+type RandomWalletGenerator struct{}
+
+//Generate creates a wallet from a fresh secp256k1 key
+func (RandomWalletGenerator) Generate(ctx context.Context) (Wallet, error) {
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return Wallet{}, fmt.Errorf("unable to generate key: %v", err)
+	}
+	wallet := Wallet{
+		PrivateKey: hexutil.Encode(crypto.FromECDSA(privateKey)),
+		PublicKey:  crypto.PubkeyToAddress(privateKey.PublicKey).Hex(),
+	}
+	return wallet, verifyWalletKey(wallet)
+}
+
+//HDWalletGenerator derives every wallet from one master seed at m/44'/60'/0'/0/<index>,
+//so backing up the seed is enough to recover all user wallets
+type HDWalletGenerator struct {
+	Vault      keyvault.KeyVault
+	SealedSeed string
+	CounterCol dbiface.CollectionAPI
+}
+
+const walletIndexCounter = "wallet_hd_index"
+
+//Generate derives the wallet at the next unused index
+func (g *HDWalletGenerator) Generate(ctx context.Context) (Wallet, error) {
+	seed, err := g.Vault.Decrypt(ctx, g.SealedSeed)
+	if err != nil {
+		return Wallet{}, fmt.Errorf("unable to open the wallet seed: %v", err)
+	}
+	defer func() {
+		for i := range seed {
+			seed[i] = 0
+		}
+	}()
+	for {
+		index, err := nextWalletIndex(ctx, g.CounterCol)
+		if err != nil {
+			return Wallet{}, err
+		}
+		privateKey, err := hdwallet.DeriveUserKey(seed, index)
+		if err == hdwallet.ErrInvalidChild {
+			log.Warnf("Skipping invalid wallet index %d", index)
+			continue
+		}
+		if err != nil {
+			return Wallet{}, err
+		}
+		wallet := Wallet{
+			PrivateKey: hexutil.Encode(crypto.FromECDSA(privateKey)),
+			PublicKey:  crypto.PubkeyToAddress(privateKey.PublicKey).Hex(),
+			HDIndex:    &index,
+		}
+		return wallet, verifyWalletKey(wallet)
+	}
+}
+
+//nextWalletIndex atomically reserves the next derivation index, starting at 0
+func nextWalletIndex(ctx context.Context, collection dbiface.CollectionAPI) (uint32, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": walletIndexCounter}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	if err != nil {
+		return 0, fmt.Errorf("unable to reserve a wallet index: %v", err)
+	}
+	if counter.Seq < 1 || counter.Seq > 0x80000000 {
+		return 0, fmt.Errorf("wallet index %d out of range", counter.Seq-1)
+	}
+	return uint32(counter.Seq - 1), nil
+}
+
+//verifyWalletKey checks that the private key of wallet derives its PublicKey address
+func verifyWalletKey(wallet Wallet) error {
+	raw, err := hexutil.Decode(wallet.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private key is not hex: %v", err)
+	}
+	privateKey, err := crypto.ToECDSA(raw)
+	if err != nil {
+		return fmt.Errorf("private key is invalid: %v", err)
+	}
+	if !common.IsHexAddress(wallet.PublicKey) {
+		return fmt.Errorf("public key %q is not an address", wallet.PublicKey)
+	}
+	if crypto.PubkeyToAddress(privateKey.PublicKey) != common.HexToAddress(wallet.PublicKey) {
+		return fmt.Errorf("private key does not belong to %s", wallet.PublicKey)
+	}
+	return nil
+}
+
+//RepairReport summarizes a RepairWallets run
+type RepairReport struct {
+	Checked     int64
+	Broken      int64
+	Regenerated int64
+}
+
+//RepairWallets finds user wallets whose key is missing or does not derive their address,
+//as written by releases that stored an empty keccak hash as the key, and gives them a new key.
+//The replaced address is kept in replaced_public_keys, funds sent to it cannot be recovered.
+func RepairWallets(ctx context.Context, generator WalletGenerator, vault keyvault.KeyVault, collection dbiface.CollectionAPI,
+	dryRun bool) (RepairReport, error) {
+	var report RepairReport
+	cursor, err := collection.Find(ctx, bson.M{"user_id": bson.M{"$exists": true}, "external": bson.M{"$ne": true}})
+	if err != nil {
+		return report, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var wallet Wallet
+		if err = cursor.Decode(&wallet); err != nil {
+			return report, err
+		}
+		report.Checked++
+		reason := brokenWalletReason(ctx, wallet, vault)
+		if reason == "" {
+			continue
+		}
+		report.Broken++
+		log.Warnf("Wallet %s of user %s is broken: %s", wallet.PublicKey, wallet.UserId.Hex(), reason)
+		if dryRun {
+			continue
+		}
+		if err = regenerateWallet(ctx, wallet, generator, vault, collection); err != nil {
+			return report, err
+		}
+		report.Regenerated++
+	}
+	return report, cursor.Err()
+}
+
+func brokenWalletReason(ctx context.Context, wallet Wallet, vault keyvault.KeyVault) string {
+	if wallet.SealedKey == "" {
+		if wallet.LegacyKey != "" {
+			return "private key stored in plain text"
+		}
+		return "no private key"
+	}
+	unsealed, err := unsealWallet(ctx, wallet, vault)
+	if err != nil {
+		return err.Error()
+	}
+	if err = verifyWalletKey(unsealed); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func regenerateWallet(ctx context.Context, wallet Wallet, generator WalletGenerator, vault keyvault.KeyVault, collection dbiface.CollectionAPI) error {
+	fresh, err := generator.Generate(ctx)
+	if err != nil {
+		return err
+	}
+	raw, err := hexutil.Decode(fresh.PrivateKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := vault.Encrypt(ctx, raw)
+	if err != nil {
+		return err
+	}
+	set := bson.M{"public_key": fresh.PublicKey, "sealed_key": sealed}
+	if fresh.HDIndex != nil {
+		set["hd_index"] = *fresh.HDIndex
+	}
+	update := bson.M{
+		"$set":   set,
+		"$unset": bson.M{"private_key": ""},
+		"$push":  bson.M{"replaced_public_keys": wallet.PublicKey},
+	}
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": wallet.ID}, update)
+	if err != nil {
+		return fmt.Errorf("unable to update wallet %s: %v", wallet.ID.Hex(), err)
+	}
+	log.Infof("Regenerated wallet of user %s: %s -> %s", wallet.UserId.Hex(), wallet.PublicKey, fresh.PublicKey)
+	return nil
+}
+
+//provisionBatch is the number of users ProvisionWallets loads at once
+const provisionBatch = 500
+
+//ProvisionReport summarizes a ProvisionWallets run
+type ProvisionReport struct {
+	Checked     int64
+	Missing     int64
+	Provisioned int64
+}
+
+//ProvisionWallets gives a custodial wallet to every user that has none, as left behind by signups
+//whose wallet failed to store before users and wallets were created together
+func ProvisionWallets(ctx context.Context, users UserRepo, wallets WalletRepo, generator WalletGenerator, vault keyvault.KeyVault,
+	dryRun bool) (ProvisionReport, error) {
+	var report ProvisionReport
+	page := Page{Limit: provisionBatch}
+	for {
+		batch, err := users.Find(ctx, Filter{}, page)
+		if err != nil {
+			return report, err
+		}
+		for _, user := range batch {
+			report.Checked++
+			_, err = wallets.FindByUser(ctx, user.ID)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return report, err
+			}
+			report.Missing++
+			log.Warnf("User %s has no wallet", user.ID.Hex())
+			if dryRun {
+				continue
+			}
+			wallet, err := createUserWallet(ctx, user.ID, generator, vault, wallets)
+			if err != nil {
+				return report, fmt.Errorf("unable to provision a wallet for user %s: %v", user.ID.Hex(), err)
+			}
+			log.Infof("Provisioned wallet %s for user %s", wallet.PublicKey, user.ID.Hex())
+			report.Provisioned++
+		}
+		if len(batch) < page.Limit {
+			return report, nil
+		}
+		last := batch[len(batch)-1].ID
+		page.After = &Cursor{Value: last, ID: last}
+	}
+}
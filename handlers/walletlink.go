@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/context"
+)
+
+const (
+	challengeTTL = 10 * time.Minute
+	//challengeNonceSize is the number of random bytes in a challenge nonce
+	challengeNonceSize = 32
+)
+
+//linkChallenge is a one time message a user signs to prove they own an address
+type linkChallenge struct {
+	Nonce     string             `json:"nonce" bson:"_id"`
+	UserId    primitive.ObjectID `json:"-" bson:"user_id"`
+	Address   string             `json:"address" bson:"address"`
+	Message   string             `json:"message" bson:"message"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+type challengeRequest struct {
+	Address string `json:"address" validate:"required,eth_addr"`
+}
+
+type linkRequest struct {
+	Address   string `json:"address" validate:"required,eth_addr"`
+	Nonce     string `json:"nonce" validate:"required"`
+	Signature string `json:"signature" validate:"required"`
+}
+
+//newChallengeNonce returns challengeNonceSize bytes from crypto/rand, hex encoded
+func newChallengeNonce() (string, error) {
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+func challengeMessage(userID, address, nonce string) string {
+	return fmt.Sprintf("Link wallet %s to rating account %s\nNonce: %s", address, userID, nonce)
+}
+
+//recoverSigner returns the address that produced an EIP-191 personal_sign signature over message
+func recoverSigner(message, signature string) (common.Address, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("signature is not hex: %v", err)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("signature must be %d bytes", crypto.SignatureLength)
+	}
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(accounts.TextHash([]byte(message)), sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("unable to recover signer: %v", err)
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+//CreateLinkChallenge issues a nonce the caller signs with personal_sign to link their own address
+func (h *WalletHandler) CreateLinkChallenge(c echo.Context) error {
+	var req challengeRequest
+	c.Echo().Validator = &userValidator{validator: v}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind : %v", err)
+		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse request payload"})
+	}
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
+	}
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+	address := common.HexToAddress(req.Address).Hex()
+	nonce, err := newChallengeNonce()
+	if err != nil {
+		log.Errorf("Unable to generate a challenge nonce : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to create the challenge"})
+	}
+	challenge := linkChallenge{
+		Nonce:     nonce,
+		UserId:    userID,
+		Address:   address,
+		Message:   challengeMessage(claims.UserID, address, nonce),
+		ExpiresAt: time.Now().Add(challengeTTL),
+	}
+	if _, err := h.ChallengeCol.InsertOne(context.Background(), challenge); err != nil {
+		log.Errorf("Unable to insert to Database:%v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to insert to database"})
+	}
+	return c.JSON(http.StatusCreated, challenge)
+}
+
+//LinkWallet verifies the signed challenge and makes the address the caller's payout wallet
+func (h *WalletHandler) LinkWallet(c echo.Context) error {
+	var (
+		req       linkRequest
+		challenge linkChallenge
+	)
+	ctx := context.Background()
+	c.Echo().Validator = &userValidator{validator: v}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind : %v", err)
+		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "unable to parse request payload"})
+	}
+	if err := c.Validate(req); err != nil {
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unable to validate request payload"})
+	}
+	claims, ok := CurrentUser(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "not authenticated"})
+	}
+	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+	address := common.HexToAddress(req.Address)
+
+	// a challenge can only be answered once
+	err := h.ChallengeCol.FindOneAndDelete(ctx, bson.M{"_id": req.Nonce, "user_id": userID}).Decode(&challenge)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Errorf("Unable to read the challenge : %v", err)
+		}
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "unknown or used challenge"})
+	}
+	if time.Now().After(challenge.ExpiresAt) || challenge.Address != address.Hex() {
+		return c.JSON(http.StatusBadRequest, errorMessage{Message: "challenge expired or issued for another address"})
+	}
+	signer, err := recoverSigner(challenge.Message, req.Signature)
+	if err != nil || signer != address {
+		log.Errorf("Signature for %s does not match : %v", address.Hex(), err)
+		return c.JSON(http.StatusUnauthorized, errorMessage{Message: "signature does not match the address"})
+	}
+
+	wallet, err := h.WalletRepo.LinkExternal(ctx, userID, address.Hex(), time.Now())
+	if errors.Is(err, ErrConflict) {
+		return c.JSON(http.StatusConflict, errorMessage{Message: "address is linked to another account"})
+	}
+	if err != nil {
+		log.Errorf("Unable to link the wallet : %v", err)
+		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "unable to link the wallet"})
+	}
+	return c.JSON(http.StatusOK, wallet)
+}
@@ -0,0 +1,106 @@
+package hdwallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+//BasePath is the BIP-44 ethereum account path user wallets are derived under, m/44'/60'/0'/0/<index>
+const BasePath = "m/44'/60'/0'/0"
+
+//MinSeedLen and MaxSeedLen bound the master seed as required by BIP-32
+const (
+	MinSeedLen = 16
+	MaxSeedLen = 64
+)
+
+var (
+	curveOrder = crypto.S256().Params().N
+	//ErrInvalidChild is returned in the astronomically unlikely case BIP-32 rejects a derived key
+	ErrInvalidChild = errors.New("derived key is invalid, use the next index")
+)
+
+type extendedKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+func newMaster(seed []byte) (extendedKey, error) {
+	if len(seed) < MinSeedLen || len(seed) > MaxSeedLen {
+		return extendedKey{}, fmt.Errorf("seed must be between %d and %d bytes", MinSeedLen, MaxSeedLen)
+	}
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	k := new(big.Int).SetBytes(sum[:32])
+	if k.Sign() == 0 || k.Cmp(curveOrder) >= 0 {
+		return extendedKey{}, ErrInvalidChild
+	}
+	return extendedKey{key: sum[:32], chainCode: sum[32:]}, nil
+}
+
+//child implements BIP-32 private parent key to private child key derivation
+func (k extendedKey) child(index uint32) (extendedKey, error) {
+	var data []byte
+	if index >= 0x80000000 {
+		data = append([]byte{0}, k.key...)
+	} else {
+		privateKey, err := crypto.ToECDSA(k.key)
+		if err != nil {
+			return extendedKey{}, err
+		}
+		data = crypto.CompressPubkey(&privateKey.PublicKey)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(curveOrder) >= 0 {
+		return extendedKey{}, ErrInvalidChild
+	}
+	childKey := il.Add(il, new(big.Int).SetBytes(k.key))
+	childKey.Mod(childKey, curveOrder)
+	if childKey.Sign() == 0 {
+		return extendedKey{}, ErrInvalidChild
+	}
+	return extendedKey{key: common.LeftPadBytes(childKey.Bytes(), 32), chainCode: sum[32:]}, nil
+}
+
+//DeriveKey derives the private key at path, e.g. m/44'/60'/0'/0/7, from a BIP-32 seed
+func DeriveKey(seed []byte, path string) (*ecdsa.PrivateKey, error) {
+	derivationPath, err := accounts.ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newMaster(seed)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range derivationPath {
+		if key, err = key.child(index); err != nil {
+			return nil, err
+		}
+	}
+	return crypto.ToECDSA(key.key)
+}
+
+//UserPath is the derivation path of the user wallet at index
+func UserPath(index uint32) string {
+	return fmt.Sprintf("%s/%d", BasePath, index)
+}
+
+//DeriveUserKey derives the private key of the user wallet at index
+func DeriveUserKey(seed []byte, index uint32) (*ecdsa.PrivateKey, error) {
+	return DeriveKey(seed, UserPath(index))
+}
@@ -0,0 +1,140 @@
+package hdwallet
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ripemd160"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Check(payload []byte) string {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	data := append(append([]byte(nil), payload...), second[:4]...)
+
+	n := new(big.Int).SetBytes(data)
+	radix, mod := big.NewInt(58), new(big.Int)
+	var encoded []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		encoded = append([]byte{base58Alphabet[mod.Int64()]}, encoded...)
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append([]byte{base58Alphabet[0]}, encoded...)
+	}
+	return string(encoded)
+}
+
+func fingerprint(t *testing.T, k extendedKey) []byte {
+	privateKey, err := crypto.ToECDSA(k.key)
+	require.NoError(t, err)
+	sha := sha256.Sum256(crypto.CompressPubkey(&privateKey.PublicKey))
+	h := ripemd160.New()
+	h.Write(sha[:])
+	return h.Sum(nil)[:4]
+}
+
+//xprv derives path from seed and serializes the key as BIP-32 does for mainnet private keys
+func xprv(t *testing.T, seed, path string) string {
+	raw, err := hex.DecodeString(seed)
+	require.NoError(t, err)
+	key, err := newMaster(raw)
+	require.NoError(t, err)
+	parent, index := make([]byte, 4), uint32(0)
+	derivationPath := accounts.DerivationPath{}
+	if path != "m" {
+		derivationPath, err = accounts.ParseDerivationPath(path)
+		require.NoError(t, err)
+	}
+	for _, index = range derivationPath {
+		parent = fingerprint(t, key)
+		key, err = key.child(index)
+		require.NoError(t, err)
+	}
+	payload := []byte{0x04, 0x88, 0xad, 0xe4, byte(len(derivationPath))}
+	payload = append(payload, parent...)
+	payload = binary.BigEndian.AppendUint32(payload, index)
+	payload = append(payload, key.chainCode...)
+	payload = append(append(payload, 0), key.key...)
+	return base58Check(payload)
+}
+
+//TestBIP32Vectors checks the test vectors of BIP-32
+func TestBIP32Vectors(t *testing.T) {
+	vectors := []struct {
+		seed string
+		path string
+		xprv string
+	}{
+		// vector 1
+		{"000102030405060708090a0b0c0d0e0f", "m",
+			"xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"},
+		{"000102030405060708090a0b0c0d0e0f", "m/0'",
+			"xprv9uHRZZhk6KAJC1avXpDAp4MDc3sQKNxDiPvvkX8Br5ngLNv1TxvUxt4cV1rGL5hj6KCesnDYUhd7oWgT11eZG7XnxHrnYeSvkzY7d2bhkJ7"},
+		{"000102030405060708090a0b0c0d0e0f", "m/0'/1",
+			"xprv9wTYmMFdV23N2TdNG573QoEsfRrWKQgWeibmLntzniatZvR9BmLnvSxqu53Kw1UmYPxLgboyZQaXwTCg8MSY3H2EU4pWcQDnRnrVA1xe8fs"},
+		{"000102030405060708090a0b0c0d0e0f", "m/0'/1/2'",
+			"xprv9z4pot5VBttmtdRTWfWQmoH1taj2axGVzFqSb8C9xaxKymcFzXBDptWmT7FwuEzG3ryjH4ktypQSAewRiNMjANTtpgP4mLTj34bhnZX7UiM"},
+		{"000102030405060708090a0b0c0d0e0f", "m/0'/1/2'/2",
+			"xprvA2JDeKCSNNZky6uBCviVfJSKyQ1mDYahRjijr5idH2WwLsEd4Hsb2Tyh8RfQMuPh7f7RtyzTtdrbdqqsunu5Mm3wDvUAKRHSC34sJ7in334"},
+		{"000102030405060708090a0b0c0d0e0f", "m/0'/1/2'/2/1000000000",
+			"xprvA41z7zogVVwxVSgdKUHDy1SKmdb533PjDz7J6N6mV6uS3ze1ai8FHa8kmHScGpWmj4WggLyQjgPie1rFSruoUihUZREPSL39UNdE3BBDu76"},
+		// vector 2
+		{vector2Seed, "m",
+			"xprv9s21ZrQH143K31xYSDQpPDxsXRTUcvj2iNHm5NUtrGiGG5e2DtALGdso3pGz6ssrdK4PFmM8NSpSBHNqPqm55Qn3LqFtT2emdEXVYsCzC2U"},
+		{vector2Seed, "m/0",
+			"xprv9vHkqa6EV4sPZHYqZznhT2NPtPCjKuDKGY38FBWLvgaDx45zo9WQRUT3dKYnjwih2yJD9mkrocEZXo1ex8G81dwSM1fwqWpWkeS3v86pgKt"},
+		{vector2Seed, "m/0/2147483647'",
+			"xprv9wSp6B7kry3Vj9m1zSnLvN3xH8RdsPP1Mh7fAaR7aRLcQMKTR2vidYEeEg2mUCTAwCd6vnxVrcjfy2kRgVsFawNzmjuHc2YmYRmagcEPdU9"},
+		{vector2Seed, "m/0/2147483647'/1",
+			"xprv9zFnWC6h2cLgpmSA46vutJzBcfJ8yaJGg8cX1e5StJh45BBciYTRXSd25UEPVuesF9yog62tGAQtHjXajPPdbRCHuWS6T8XA2ECKADdw4Ef"},
+		{vector2Seed, "m/0/2147483647'/1/2147483646'",
+			"xprvA1RpRA33e1JQ7ifknakTFpgNXPmW2YvmhqLQYMmrj4xJXXWYpDPS3xz7iAxn8L39njGVyuoseXzU6rcxFLJ8HFsTjSyQbLYnMpCqE2VbFWc"},
+		{vector2Seed, "m/0/2147483647'/1/2147483646'/2",
+			"xprvA2nrNbFZABcdryreWet9Ea4LvTJcGsqrMzxHx98MMrotbir7yrKCEXw7nadnHM8Dq38EGfSh6dqA9QWTyefMLEcBYJUuekgW4BYPJcr9E7j"},
+		// vector 3, leading zeros of derived keys are kept
+		{vector3Seed, "m",
+			"xprv9s21ZrQH143K25QhxbucbDDuQ4naNntJRi4KUfWT7xo4EKsHt2QJDu7KXp1A3u7Bi1j8ph3EGsZ9Xvz9dGuVrtHHs7pXeTzjuxBrCmmhgC6"},
+		{vector3Seed, "m/0'",
+			"xprv9uPDJpEQgRQfDcW7BkF7eTya6RPxXeJCqCJGHuCJ4GiRVLzkTXBAJMu2qaMWPrS7AANYqdq6vcBcBUdJCVVFceUvJFjaPdGZ2y9WACViL4L"},
+	}
+	for _, v := range vectors {
+		assert.Equal(t, v.xprv, xprv(t, v.seed, v.path), v.path)
+	}
+}
+
+const (
+	vector2Seed = "fffcf9f6f3f0edeae7e4e1dedbd8d5d2cfccc9c6c3c0bdbab7b4b1aeaba8a5a29f9c999693908d8a8784817e7b7875726f6c696663605d5a5754514e4b484542"
+	vector3Seed = "4b381541583be4423346c643850da4b320e46a87ae3d2a4e6da11eba819cd4acba45d239319ac14f863b8d5ab5a0d0c64d2e8a1e7d1457df2e5a3c51c73235be"
+)
+
+//TestBIP44Addresses checks the ethereum accounts wallets derive from the BIP-39 mnemonic "abandon ... about"
+func TestBIP44Addresses(t *testing.T) {
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	seed := pbkdf2.Key([]byte(mnemonic), []byte("mnemonic"), 2048, 64, sha512.New)
+
+	addresses := []string{
+		"0x9858EfFD232B4033E47d90003D41EC34EcaEda94",
+		"0x6Fac4D18c912343BF86fa7049364Dd4E424Ab9C0",
+		"0xb6716976A3ebe8D39aCEB04372f22Ff8e6802D7A",
+	}
+	for i, address := range addresses {
+		key, err := DeriveUserKey(seed, uint32(i))
+		require.NoError(t, err)
+		assert.Equal(t, address, crypto.PubkeyToAddress(key.PublicKey).Hex(), UserPath(uint32(i)))
+	}
+}
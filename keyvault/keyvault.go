@@ -0,0 +1,138 @@
+package keyvault
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//KeyVault seals secrets such as wallet private keys before they are stored
+type KeyVault interface {
+	Encrypt(ctx context.Context, plaintext []byte) (string, error)
+	Decrypt(ctx context.Context, sealed string) ([]byte, error)
+}
+
+//KeyWrapper encrypts the per-secret data keys, it is the only part that sees the master key
+type KeyWrapper interface {
+	//KeyID identifies the master key a data key was wrapped with
+	KeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+const (
+	envelopeVersion = "v1"
+	dataKeySize     = 32
+)
+
+//ErrMalformed is returned for sealed values that were not produced by an EnvelopeVault
+var ErrMalformed = errors.New("malformed sealed value")
+
+//EnvelopeVault encrypts every secret with a fresh AES-256-GCM data key and stores the
+//data key wrapped by a KeyWrapper next to the ciphertext
+type EnvelopeVault struct {
+	wrapper KeyWrapper
+}
+
+//NewEnvelopeVault creates a vault wrapping its data keys with wrapper
+func NewEnvelopeVault(wrapper KeyWrapper) *EnvelopeVault {
+	return &EnvelopeVault{wrapper: wrapper}
+}
+
+//Encrypt seals plaintext as v1:<key id>:<wrapped data key>:<nonce and ciphertext>, each part base64 encoded
+func (v *EnvelopeVault) Encrypt(ctx context.Context, plaintext []byte) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", fmt.Errorf("unable to generate data key: %v", err)
+	}
+	defer zero(dataKey)
+	ciphertext, err := seal(dataKey, plaintext)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := v.wrapper.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("unable to wrap data key: %v", err)
+	}
+	return strings.Join([]string{
+		envelopeVersion,
+		base64.RawStdEncoding.EncodeToString([]byte(v.wrapper.KeyID())),
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+//Decrypt opens a value sealed by Encrypt
+func (v *EnvelopeVault) Decrypt(ctx context.Context, sealed string) ([]byte, error) {
+	parts := strings.Split(sealed, ":")
+	if len(parts) != 4 || parts[0] != envelopeVersion {
+		return nil, ErrMalformed
+	}
+	keyID, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	dataKey, err := v.wrapper.UnwrapKey(ctx, string(keyID), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %v", err)
+	}
+	defer zero(dataKey)
+	return open(dataKey, ciphertext)
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//zero wipes key material once it is no longer needed
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,42 @@
+package keyvault
+
+import (
+	"context"
+	"fmt"
+)
+
+//KMSClient is the part of a key management service used to wrap data keys, it matches the
+//Encrypt/Decrypt operations of AWS KMS, GCP Cloud KMS and Vault transit
+type KMSClient interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+//KMSKeyWrapper wraps data keys with a master key that never leaves the KMS
+type KMSKeyWrapper struct {
+	client KMSClient
+	keyID  string
+}
+
+//NewKMSKeyWrapper wraps data keys with the KMS key keyID
+func NewKMSKeyWrapper(client KMSClient, keyID string) *KMSKeyWrapper {
+	return &KMSKeyWrapper{client: client, keyID: keyID}
+}
+
+//KeyID is the KMS key id or alias
+func (w *KMSKeyWrapper) KeyID() string {
+	return w.keyID
+}
+
+//WrapKey has the KMS encrypt dataKey
+func (w *KMSKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return w.client.Encrypt(ctx, w.keyID, dataKey)
+}
+
+//UnwrapKey has the KMS decrypt a wrapped data key
+func (w *KMSKeyWrapper) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("missing kms key id")
+	}
+	return w.client.Decrypt(ctx, keyID, wrapped)
+}
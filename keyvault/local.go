@@ -0,0 +1,82 @@
+package keyvault
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//LocalKeyWrapper wraps data keys with a master key read from a file, meant for dev and tests
+type LocalKeyWrapper struct {
+	id  string
+	key []byte
+}
+
+//NewLocalKeyWrapper creates a wrapper from a 32 byte master key
+func NewLocalKeyWrapper(masterKey []byte) (*LocalKeyWrapper, error) {
+	if len(masterKey) != dataKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", dataKeySize, len(masterKey))
+	}
+	sum := sha256.Sum256(masterKey)
+	return &LocalKeyWrapper{id: "local-" + hex.EncodeToString(sum[:4]), key: masterKey}, nil
+}
+
+//LoadLocalKeyWrapper reads a hex encoded master key from path, see GenerateLocalMasterKey
+func LoadLocalKeyWrapper(path string) (*LocalKeyWrapper, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("master key file %s does not exist, create it with sealkey -new-master-key", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read master key file: %v", err)
+	}
+	masterKey, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("master key file must contain a hex encoded key: %v", err)
+	}
+	return NewLocalKeyWrapper(masterKey)
+}
+
+//GenerateLocalMasterKey writes a new random master key to path, it never overwrites an existing file
+//as every value sealed with the old key would be lost
+func GenerateLocalMasterKey(path string) (*LocalKeyWrapper, error) {
+	masterKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, masterKey); err != nil {
+		return nil, fmt.Errorf("unable to generate master key: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create master key file: %v", err)
+	}
+	if _, err = f.WriteString(hex.EncodeToString(masterKey) + "\n"); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to write master key file: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write master key file: %v", err)
+	}
+	return NewLocalKeyWrapper(masterKey)
+}
+
+//KeyID identifies the master key by a fingerprint
+func (w *LocalKeyWrapper) KeyID() string {
+	return w.id
+}
+
+//WrapKey encrypts dataKey with the master key
+func (w *LocalKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return seal(w.key, dataKey)
+}
+
+//UnwrapKey decrypts a data key wrapped by this master key
+func (w *LocalKeyWrapper) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != w.id {
+		return nil, fmt.Errorf("data key was wrapped with %s, not %s", keyID, w.id)
+	}
+	return open(w.key, wrapped)
+}
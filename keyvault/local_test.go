@@ -0,0 +1,101 @@
+package keyvault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestVault(t *testing.T, fill byte) *EnvelopeVault {
+	wrapper, err := NewLocalKeyWrapper(bytes.Repeat([]byte{fill}, dataKeySize))
+	require.NoError(t, err)
+	return NewEnvelopeVault(wrapper)
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	vault := newTestVault(t, 7)
+	secret := []byte("private key material")
+
+	sealed, err := vault.Encrypt(ctx, secret)
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, string(secret))
+	again, err := vault.Encrypt(ctx, secret)
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "every secret gets a fresh data key and nonce")
+
+	opened, err := vault.Decrypt(ctx, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, secret, opened)
+}
+
+func TestOpenRejectsTamperedCiphertext(t *testing.T) {
+	ctx := context.Background()
+	vault := newTestVault(t, 7)
+	sealed, err := vault.Encrypt(ctx, []byte("private key material"))
+	require.NoError(t, err)
+
+	// flip a byte of the ciphertext and of the wrapped data key
+	parts := strings.Split(sealed, ":")
+	for _, i := range []int{2, 3} {
+		tampered := append([]string(nil), parts...)
+		last := []byte(tampered[i])
+		if last[len(last)-2] == 'A' {
+			last[len(last)-2] = 'B'
+		} else {
+			last[len(last)-2] = 'A'
+		}
+		tampered[i] = string(last)
+		_, err = vault.Decrypt(ctx, strings.Join(tampered, ":"))
+		assert.Error(t, err, "part %d", i)
+	}
+
+	_, err = vault.Decrypt(ctx, "v1:not:a:sealed value")
+	assert.True(t, errors.Is(err, ErrMalformed), "got %v", err)
+	_, err = vault.Decrypt(ctx, strings.Join(parts[:3], ":"))
+	assert.True(t, errors.Is(err, ErrMalformed), "got %v", err)
+}
+
+func TestOpenRejectsWrongMasterKey(t *testing.T) {
+	ctx := context.Background()
+	sealed, err := newTestVault(t, 7).Encrypt(ctx, []byte("private key material"))
+	require.NoError(t, err)
+
+	_, err = newTestVault(t, 8).Decrypt(ctx, sealed)
+	assert.Error(t, err)
+
+	// a wrapper claiming the key id of another master key still cannot unwrap its data keys
+	impostor, err := NewLocalKeyWrapper(bytes.Repeat([]byte{8}, dataKeySize))
+	require.NoError(t, err)
+	impostor.id = newTestVault(t, 7).wrapper.KeyID()
+	_, err = NewEnvelopeVault(impostor).Decrypt(ctx, sealed)
+	assert.Error(t, err)
+}
+
+func TestLocalMasterKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+
+	_, err := LoadLocalKeyWrapper(path)
+	assert.Error(t, err, "a missing master key is not created on load")
+	_, statErr := os.Stat(path)
+	assert.True(t, os.IsNotExist(statErr))
+
+	generated, err := GenerateLocalMasterKey(path)
+	require.NoError(t, err)
+	loaded, err := LoadLocalKeyWrapper(path)
+	require.NoError(t, err)
+	assert.Equal(t, generated.KeyID(), loaded.KeyID())
+
+	_, err = GenerateLocalMasterKey(path)
+	assert.Error(t, err, "an existing master key is never replaced")
+	loaded, err = LoadLocalKeyWrapper(path)
+	require.NoError(t, err)
+	assert.Equal(t, generated.KeyID(), loaded.KeyID())
+}
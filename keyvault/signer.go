@@ -0,0 +1,53 @@
+package keyvault
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+//SealedSigner signs transactions with a private key sealed by a KeyVault, the key is only
+//decrypted for the duration of each signature
+type SealedSigner struct {
+	vault   KeyVault
+	sealed  string
+	address common.Address
+}
+
+//NewSealedSigner opens sealed once to check it holds a valid private key
+func NewSealedSigner(ctx context.Context, vault KeyVault, sealed string) (*SealedSigner, error) {
+	raw, err := vault.Decrypt(ctx, sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(raw)
+	key, err := crypto.ToECDSA(raw)
+	if err != nil {
+		return nil, fmt.Errorf("sealed value is not a private key: %v", err)
+	}
+	return &SealedSigner{vault: vault, sealed: sealed, address: crypto.PubkeyToAddress(key.PublicKey)}, nil
+}
+
+//Address is the account the sealed key belongs to
+func (s *SealedSigner) Address() common.Address {
+	return s.address
+}
+
+//SignTx decrypts the key, signs tx for chainID and wipes the key again
+func (s *SealedSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	raw, err := s.vault.Decrypt(ctx, s.sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(raw)
+	key, err := crypto.ToECDSA(raw)
+	if err != nil {
+		return nil, err
+	}
+	defer key.D.SetInt64(0)
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
+}
@@ -3,15 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/Godtide/rating/chain"
 	"github.com/Godtide/rating/config"
 	"github.com/Godtide/rating/handlers"
+	"github.com/Godtide/rating/keyvault"
+	"github.com/Godtide/rating/scheduler"
+	"github.com/Godtide/rating/sqlstore"
 	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 	"github.com/labstack/gommon/random"
@@ -31,6 +38,13 @@ var (
 	usersCol      *mongo.Collection
 	userRewardCol *mongo.Collection
 	walletCol     *mongo.Collection
+	idemCol       *mongo.Collection
+	txCol         *mongo.Collection
+	counterCol    *mongo.Collection
+	challengeCol  *mongo.Collection
+	ratingCol     *mongo.Collection
+	scoreCol      *mongo.Collection
+	ruleCol       *mongo.Collection
 	cfg           config.Properties
 )
 
@@ -38,18 +52,75 @@ func init() {
 	if err := cleanenv.ReadEnv(&cfg); err != nil {
 		log.Fatalf("Configuration cannot be read : %v", err)
 	}
-	ctx := context.Background()
+	var tokens config.TokenProperties
+	if err := cleanenv.ReadEnv(&tokens); err != nil {
+		log.Fatalf("Configuration cannot be read : %v", err)
+	}
+	if err := handlers.ConfigureTokens(tokens); err != nil {
+		log.Fatalf("Configuration is invalid : %v", err)
+	}
+}
+
+//connectMongo opens the Mongo collections and creates their indexes. The ledger, that is transactions,
+//idempotency keys, link challenges, HD index counters and the nonces of the master wallet, lives in Mongo
+//whatever STORAGE_DRIVER says, the collections STORAGE_DRIVER moves to SQL are only indexed with mongo
+func connectMongo(ctx context.Context) error {
+	var err error
 	connectURI := fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)
-	c, err := mongo.Connect(ctx, options.Client().ApplyURI(connectURI))
+	c, err = mongo.Connect(ctx, options.Client().ApplyURI(connectURI))
 	if err != nil {
-		log.Fatalf("Unable to connect to database : %v", err)
+		return err
 	}
 	db = c.Database(cfg.DBName)
 	usersCol = db.Collection(cfg.UsersCollection)
 	walletCol = db.Collection(cfg.WalletCollection)
 	userRewardCol = db.Collection(cfg.UsersRewardCollection)
 	rewardCol = db.Collection(cfg.RewardCollection)
+	idemCol = db.Collection(cfg.IdempotencyCollection)
+	txCol = db.Collection(cfg.TransactionCollection)
+	counterCol = db.Collection(cfg.CounterCollection)
+	challengeCol = db.Collection(cfg.ChallengeCollection)
+	ratingCol = db.Collection(cfg.RatingCollection)
+	scoreCol = db.Collection(cfg.ScoreCollection)
+	ruleCol = db.Collection(cfg.RatingRuleCollection)
+
+	idemTTL := int32((24 * time.Hour).Seconds())
+	idemIndex := mongo.IndexModel{
+		Keys:    bson.M{"createdAt": 1},
+		Options: &options.IndexOptions{ExpireAfterSeconds: &idemTTL},
+	}
+	_, err = idemCol.Indexes().CreateOne(ctx, idemIndex)
+	if err != nil {
+		return err
+	}
+	_, err = txCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"status": 1}},
+		{Keys: bson.D{{Key: "userReward_id", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "userReward_id", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	expireNow := int32(0)
+	challengeIndex := mongo.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: &options.IndexOptions{ExpireAfterSeconds: &expireNow},
+	}
+	_, err = challengeCol.Indexes().CreateOne(ctx, challengeIndex)
+	if err != nil {
+		return err
+	}
+	if cfg.StorageDriver != "mongo" {
+		log.Infof("STORAGE_DRIVER=%s, the payout ledger stays in Mongo database %s", cfg.StorageDriver, cfg.DBName)
+		return nil
+	}
+	return indexMongoRepositories(ctx)
+}
 
+//indexMongoRepositories creates the indexes of the users, rewards, user rewards, wallets and ratings
+//collections and migrates their documents, when STORAGE_DRIVER=mongo
+func indexMongoRepositories(ctx context.Context) error {
+	var err error
 	isUserIndexUnique := true
 	indexModel := mongo.IndexModel{
 		Keys: bson.M{"username": 1},
@@ -59,8 +130,127 @@ func init() {
 	}
 	_, err = usersCol.Indexes().CreateOne(ctx, indexModel)
 	if err != nil {
-		log.Fatalf("Unable to create an index : %+v", err)
+		return err
+	}
+	expiryIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "expiresAt", Value: 1}},
+	}
+	_, err = userRewardCol.Indexes().CreateOne(ctx, expiryIndex)
+	if err != nil {
+		return err
+	}
+	// listings are ordered by a sort field then _id
+	_, err = userRewardCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "expiresAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = rewardCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "points", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expiry", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// a rating rule grants a user once
+	grantIndex := mongo.IndexModel{
+		Keys: bson.M{"grantKey": 1},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"grantKey": bson.M{"$exists": true}}),
+	}
+	if _, err = userRewardCol.Indexes().CreateOne(ctx, grantIndex); err != nil {
+		return err
+	}
+	_, err = ratingCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"key": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// rewards and userRewards stored before rewards were versioned are at version 1
+	if _, err = rewardCol.UpdateMany(ctx, bson.M{"version": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"version": 1}}); err != nil {
+		return fmt.Errorf("unable to version the rewards: %v", err)
+	}
+	_, err = userRewardCol.UpdateMany(ctx, bson.M{"rewardVersion": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"rewardVersion": 1}})
+	if err != nil {
+		return fmt.Errorf("unable to version the userRewards: %v", err)
+	}
+	// points and amounts stored as integers before they were decimals, in the terms of every version too
+	decimalAmounts := func(prefix string) bson.M {
+		return bson.M{
+			"points":           bson.M{"$toDecimal": prefix + "points"},
+			"amountRedeemable": bson.M{"$toDecimal": prefix + "amountRedeemable"},
+		}
+	}
+	_, err = rewardCol.UpdateMany(ctx, bson.M{"points": bson.M{"$not": bson.M{"$type": "decimal"}}}, mongo.Pipeline{
+		{{Key: "$set", Value: decimalAmounts("$")}},
+		{{Key: "$set", Value: bson.M{"versions": bson.M{"$map": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$versions", bson.A{}}},
+			"in":    bson.M{"$mergeObjects": bson.A{"$$this", decimalAmounts("$$this.")}},
+		}}}}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to convert the reward amounts: %v", err)
+	}
+	// rewards stored before deletedAt was omitted while unset have it at the zero time
+	if err = (&handlers.MongoRewardRepo{Col: rewardCol}).UnsetZeroDeletedAt(ctx); err != nil {
+		return fmt.Errorf("unable to unarchive the rewards: %v", err)
 	}
+	// rules stored before their minimum average was exact, and scores kept before rules went by system ratings alone
+	_, err = ruleCol.UpdateMany(ctx, bson.M{"minAverage": bson.M{"$exists": true}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"minAverageHundredths": bson.M{"$toLong": bson.M{"$round": bson.A{
+			bson.M{"$multiply": bson.A{"$minAverage", 100}}, 0}}}}}},
+		{{Key: "$unset", Value: "minAverage"}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to convert the rating rules: %v", err)
+	}
+	unsummed, err := scoreCol.CountDocuments(ctx, bson.M{"systemCount": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	if unsummed > 0 {
+		cursor, err := ratingCol.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"source": handlers.RatingBySystem}}},
+			{{Key: "$group", Value: bson.M{"_id": "$user_id", "systemCount": bson.M{"$sum": 1}, "systemTotal": bson.M{"$sum": "$value"}}}},
+			{{Key: "$merge", Value: bson.M{"into": cfg.ScoreCollection, "whenMatched": "merge", "whenNotMatched": "discard"}}},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to sum up the system ratings: %v", err)
+		}
+		cursor.Close(ctx)
+		_, err = scoreCol.UpdateMany(ctx, bson.M{"systemCount": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"systemCount": 0, "systemTotal": 0}})
+		if err != nil {
+			return fmt.Errorf("unable to sum up the system ratings: %v", err)
+		}
+	}
+	hdIndex := mongo.IndexModel{
+		Keys: bson.M{"hd_index": 1},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"hd_index": bson.M{"$exists": true}}),
+	}
+	_, err = walletCol.Indexes().CreateOne(ctx, hdIndex)
+	if err != nil {
+		return err
+	}
+	// an address is the external wallet of one user at most, linking checks it before writing
+	externalIndex := mongo.IndexModel{
+		Keys: bson.M{"public_key": 1},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"external": true}),
+	}
+	if _, err = walletCol.Indexes().CreateOne(ctx, externalIndex); err != nil {
+		return err
+	}
+	return nil
 }
 
 func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
@@ -80,6 +270,221 @@ func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		hToken := c.Request().Header.Get(echo.HeaderAuthorization)
+		parts := strings.SplitN(hToken, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			log.Errorf("Missing or malformed authorization header")
+			return echo.NewHTTPError(http.StatusUnauthorized, "Missing or malformed token")
+		}
+		claims, err := handlers.ParseToken(parts[1])
+		if err != nil {
+			log.Errorf("Unable to parse token : %v", err)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired token")
+		}
+		c.Set(handlers.ClaimsKey, claims)
+		return next(c)
+	}
+}
+
+func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, ok := handlers.CurrentUser(c)
+		if !ok || !claims.IsAdmin {
+			log.Errorf("User is not authorized to access %s", c.Request().URL.Path)
+			return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+		}
+		return next(c)
+	}
+}
+
+//repositories are the stores of users, rewards, user rewards, wallets and ratings
+type repositories struct {
+	users       handlers.UserRepo
+	rewards     handlers.RewardRepo
+	userRewards handlers.UserRewardRepo
+	wallets     handlers.WalletRepo
+	ratings     handlers.RatingRepo
+	ratingRules handlers.RatingRuleRepo
+	transactor  handlers.Transactor
+}
+
+//newRepositories opens the storage selected by STORAGE_DRIVER, SQL schemas are migrated first
+func newRepositories(ctx context.Context) (repositories, error) {
+	switch cfg.StorageDriver {
+	case "mongo":
+		return repositories{
+			users:       &handlers.MongoUserRepo{Col: usersCol},
+			rewards:     &handlers.MongoRewardRepo{Col: rewardCol},
+			userRewards: &handlers.MongoUserRewardRepo{Col: userRewardCol},
+			wallets:     &handlers.MongoWalletRepo{Col: walletCol},
+			ratings:     &handlers.MongoRatingRepo{Col: ratingCol, ScoreCol: scoreCol},
+			ratingRules: &handlers.MongoRatingRuleRepo{Col: ruleCol},
+			transactor:  &handlers.MongoTransactor{Client: c},
+		}, nil
+	case sqlstore.Postgres, sqlstore.SQLite:
+		dsn := cfg.PostgresURL
+		if cfg.StorageDriver == sqlstore.SQLite {
+			log.Warnf("Using the embedded SQLite database %s, meant for local runs only", cfg.SQLitePath)
+			dsn = cfg.SQLitePath
+		}
+		sqlDB, err := sqlstore.Open(cfg.StorageDriver, dsn)
+		if err != nil {
+			return repositories{}, err
+		}
+		if _, err = sqlDB.Migrate(ctx); err != nil {
+			sqlDB.Close()
+			return repositories{}, err
+		}
+		return repositories{
+			users:       &sqlstore.UserRepo{DB: sqlDB},
+			rewards:     &sqlstore.RewardRepo{DB: sqlDB},
+			userRewards: &sqlstore.UserRewardRepo{DB: sqlDB},
+			wallets:     &sqlstore.WalletRepo{DB: sqlDB},
+			ratings:     &sqlstore.RatingRepo{DB: sqlDB},
+			ratingRules: &sqlstore.RatingRuleRepo{DB: sqlDB},
+			transactor:  sqlDB,
+		}, nil
+	}
+	return repositories{}, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+}
+
+func newKeyVault() (keyvault.KeyVault, error) {
+	switch cfg.KeyVaultBackend {
+	case "local":
+		wrapper, err := keyvault.LoadLocalKeyWrapper(cfg.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return keyvault.NewEnvelopeVault(wrapper), nil
+	}
+	// a KMS backed vault is keyvault.NewEnvelopeVault(keyvault.NewKMSKeyWrapper(client, keyID))
+	// with client adapting the provider's SDK to keyvault.KMSClient
+	return nil, fmt.Errorf("unknown key vault %q", cfg.KeyVaultBackend)
+}
+
+func newWalletGenerator(ctx context.Context, vault keyvault.KeyVault) (handlers.WalletGenerator, error) {
+	if cfg.WalletSeedSealed == "" {
+		log.Warnf("WALLET_SEED_SEALED is not set, user wallets get random keys that cannot be recovered from a seed")
+		return handlers.RandomWalletGenerator{}, nil
+	}
+	if _, err := vault.Decrypt(ctx, cfg.WalletSeedSealed); err != nil {
+		return nil, fmt.Errorf("unable to open the wallet seed: %v", err)
+	}
+	return &handlers.HDWalletGenerator{Vault: vault, SealedSeed: cfg.WalletSeedSealed, CounterCol: counterCol}, nil
+}
+
+func newMasterSigner(ctx context.Context, vault keyvault.KeyVault) (chain.Signer, error) {
+	if cfg.MasterSealedKey != "" {
+		return keyvault.NewSealedSigner(ctx, vault, cfg.MasterSealedKey)
+	}
+	log.Warnf("MASTER_SEALED_KEY is not set, signing with the plain MASTER_PRIVATE_KEY")
+	return chain.NewKeySigner(cfg.MasterPrivateKey)
+}
+
+//newGasPolicy parses the gas caps from the config, empty values are not enforced
+func newGasPolicy() (chain.GasPolicy, error) {
+	var policy chain.GasPolicy
+	caps := []struct {
+		name  string
+		value string
+		dst   **big.Int
+	}{
+		{"GAS_MAX_FEE_WEI", cfg.GasMaxFeeWei, &policy.MaxFeePerGas},
+		{"GAS_MAX_PRIORITY_FEE_WEI", cfg.GasMaxPriorityFeeWei, &policy.MaxPriorityFeePerGas},
+		{"GAS_MAX_COST_PER_CLAIM_WEI", cfg.GasMaxCostPerClaimWei, &policy.MaxGasCostPerClaim},
+	}
+	for _, c := range caps {
+		if c.value == "" {
+			continue
+		}
+		v, err := parseAmount(c.name, c.value)
+		if err != nil {
+			return policy, err
+		}
+		*c.dst = v
+	}
+	return policy, nil
+}
+
+//parseAmount parses a non negative integer amount from the config
+func parseAmount(name, value string) (*big.Int, error) {
+	v, ok := new(big.Int).SetString(value, 10)
+	if !ok || v.Sign() < 0 {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return v, nil
+}
+
+//newTreasury monitors the master wallet, it returns nil when MASTER_PUBLIC_KEY is not set
+func newTreasury(transferer chain.TokenTransferer, batcher *handlers.Batcher, userRewards handlers.UserRewardRepo) (*handlers.Treasury, error) {
+	if cfg.MasterPublicKey == "" {
+		log.Warnf("MASTER_PUBLIC_KEY is not set, treasury balances are not monitored")
+		return nil, nil
+	}
+	balances, ok := transferer.(chain.BalanceReader)
+	if !ok {
+		return nil, fmt.Errorf("transfer backend %s cannot read balances", cfg.TransferBackend)
+	}
+	// the treasury watches and pays out of one wallet, the one the master signer sends from
+	if sender, ok := transferer.(chain.Sender); ok && !strings.EqualFold(cfg.MasterPublicKey, sender.Account().Hex()) {
+		return nil, fmt.Errorf("MASTER_PUBLIC_KEY %s is not the address %s of the master signer", cfg.MasterPublicKey, sender.Account().Hex())
+	}
+	minTokens, err := parseAmount("TREASURY_MIN_TOKENS", cfg.TreasuryMinTokens)
+	if err != nil {
+		return nil, err
+	}
+	minNative, err := parseAmount("TREASURY_MIN_NATIVE_WEI", cfg.TreasuryMinNativeWei)
+	if err != nil {
+		return nil, err
+	}
+	return &handlers.Treasury{
+		Account:          cfg.MasterPublicKey,
+		Balances:         balances,
+		MinTokens:        minTokens,
+		MinNativeBalance: minNative,
+		TransactionCol:   txCol,
+		UserRewardRepo:   userRewards,
+		Transferer:       transferer,
+		Batcher:          batcher,
+	}, nil
+}
+
+func newTransferer(ctx context.Context, vault keyvault.KeyVault) (chain.TokenTransferer, error) {
+	switch cfg.TransferBackend {
+	case "fake":
+		log.Warnf("Using the in-memory fake transferer, no tokens will be sent")
+		return chain.NewFakeTransferer(), nil
+	case "eth":
+		rpcURL := cfg.RPCURL
+		if rpcURL == "" {
+			rpcURL = "https://optimism-mainnet.infura.io/v3/" + cfg.ApiKey
+		}
+		signer, err := newMasterSigner(ctx, vault)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := newGasPolicy()
+		if err != nil {
+			return nil, err
+		}
+		nonces := &handlers.WalletNonceStore{WalletCol: walletCol}
+		t, err := chain.DialEthTransferer(ctx, rpcURL, cfg.ChainID, signer, cfg.ContractAdrress, nonces)
+		if err != nil {
+			return nil, err
+		}
+		t.SetGasPolicy(policy)
+		if cfg.BatchPayouts {
+			if err = t.EnableBatching(cfg.BatchContract); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown transfer backend %q", cfg.TransferBackend)
+}
+
 func main() {
 	e := echo.New()
 	e.Logger.SetLevel(log.DEBUG)
@@ -91,22 +496,142 @@ func main() {
 			`${status} ${error} ${latency_human}` + "\n",
 	}))
 
-	uh := &handlers.UsersHandler{UserCol: usersCol, WalletCol: walletCol}
+	if err := connectMongo(context.Background()); err != nil {
+		log.Fatalf("Unable to set up the database : %v", err)
+	}
+	vault, err := newKeyVault()
+	if err != nil {
+		log.Fatalf("Unable to set up the key vault : %v", err)
+	}
+	wallets, err := newWalletGenerator(context.Background(), vault)
+	if err != nil {
+		log.Fatalf("Unable to set up wallet generation : %v", err)
+	}
+	transferer, err := newTransferer(context.Background(), vault)
+	if err != nil {
+		log.Fatalf("Unable to set up token transfers : %v", err)
+	}
+
+	var batcher *handlers.Batcher
+	if cfg.BatchPayouts {
+		batchTransferer, ok := transferer.(chain.BatchTransferer)
+		if !ok {
+			log.Fatalf("Transfer backend %s does not support batching", cfg.TransferBackend)
+		}
+		batcher = &handlers.Batcher{
+			TransactionCol: txCol,
+			Transferer:     batchTransferer,
+			MaxSize:        cfg.BatchMaxSize,
+			MaxWait:        time.Duration(cfg.BatchMaxWaitSeconds) * time.Second,
+		}
+	}
+
+	repos, err := newRepositories(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to set up %s storage : %v", cfg.StorageDriver, err)
+	}
+	userRepo, rewardRepo, userRewardRepo, walletRepo := repos.users, repos.rewards, repos.userRewards, repos.wallets
+	if err = handlers.SeedAdmin(context.Background(), cfg.AdminEmail, cfg.AdminPassword, userRepo); err != nil {
+		log.Fatalf("Unable to seed the admin user : %v", err)
+	}
+
+	treasury, err := newTreasury(transferer, batcher, userRewardRepo)
+	if err != nil {
+		log.Fatalf("Unable to set up the treasury : %v", err)
+	}
+	if treasury != nil {
+		// know whether to hold claims before serving the first one
+		if _, err = treasury.Run(context.Background()); err != nil {
+			log.Errorf("Unable to check the treasury : %v", err)
+		}
+	}
+
+	uh := &handlers.UsersHandler{
+		UserRepo:   userRepo,
+		WalletRepo: walletRepo,
+		Transactor: repos.transactor,
+		Vault:      vault,
+		Wallets:    wallets,
+	}
 	us := &handlers.UserRewardHandler{
-		UserRewardCol: userRewardCol,
-	    RewardCol: rewardCol,
-	    WalletCol: walletCol,
-		Wallet: handlers.Wallet{PrivateKey: cfg.MasterPrivateKey, PublicKey: cfg.MasterPublicKey},
-		Apikey : cfg.ApiKey,
-	    ContractAdrress : cfg.ContractAdrress,
+		UserRewardRepo: userRewardRepo,
+		RewardRepo:     rewardRepo,
+		WalletRepo:     walletRepo,
+		IdempotencyCol: idemCol,
+		TransactionCol: txCol,
+		Transferer:     transferer,
+		Batcher:        batcher,
+		Treasury:       treasury,
+	}
+	wh := &handlers.WalletHandler{WalletRepo: walletRepo, ChallengeCol: challengeCol}
+	ar := &handlers.RewardHandler{UserRewardRepo: userRewardRepo, RewardRepo: rewardRepo}
+	rh := &handlers.RatingHandler{
+		RatingRepo:     repos.ratings,
+		RuleRepo:       repos.ratingRules,
+		UserRepo:       userRepo,
+		RewardRepo:     rewardRepo,
+		UserRewardRepo: userRewardRepo,
 	}
-	ar := &handlers.RewardHandler{UserRewardCol: userRewardCol, RewardCol: rewardCol}
+
+	sched := scheduler.New()
+	err = sched.Add("expire-user-rewards", cfg.ExpiryJobSchedule, time.Minute, func(ctx context.Context) (int64, error) {
+		return handlers.ExpireUserRewards(ctx, userRewardRepo)
+	})
+	if err != nil {
+		log.Fatalf("Unable to schedule the expiry job : %v", err)
+	}
+	watcher := &handlers.TransactionWatcher{
+		TransactionCol: txCol,
+		UserRewardRepo: userRewardRepo,
+		Transferer:     transferer,
+		Batcher:        batcher,
+		Treasury:       treasury,
+		MaxAttempts:    cfg.TxMaxAttempts,
+		DropAfter:      time.Duration(cfg.TxDropAfterMinutes) * time.Minute,
+	}
+	if err = sched.Add("watch-transactions", cfg.TxWatchSchedule, time.Minute, watcher.Run); err != nil {
+		log.Fatalf("Unable to schedule the transaction watcher : %v", err)
+	}
+	if batcher != nil {
+		if err = sched.Add("flush-payout-batches", "@every 10s", time.Minute, batcher.Run); err != nil {
+			log.Fatalf("Unable to schedule the batch flush : %v", err)
+		}
+	}
+	if treasury != nil {
+		if err = sched.Add("check-treasury", cfg.TreasurySchedule, time.Minute, treasury.Run); err != nil {
+			log.Fatalf("Unable to schedule the treasury check : %v", err)
+		}
+	}
+	sched.Start()
+	defer sched.Stop()
+	jh := &handlers.JobsHandler{Scheduler: sched}
+	th := &handlers.TransactionHandler{TransactionCol: txCol, UserRewardRepo: userRewardRepo}
+	trh := &handlers.TreasuryHandler{Treasury: treasury}
 
 	e.POST("/users", uh.CreateUser)
-	e.POST("/admin/reward", ar.CreateRewards)
-	e.POST("/reward/create", us.CreateUserRewards)
-	e.POST("/reward/claim", us.ClaimReward)
-	e.GET("/rewards", h.GetRewards)
+	e.POST("/login", uh.AuthnUser)
+	e.POST("/reward/create", us.CreateUserRewards, authMiddleware, adminMiddleware)
+	e.POST("/reward/claim/:id", us.ClaimReward, authMiddleware)
+	e.GET("/reward/:id/transactions", th.GetUserRewardTransactions, authMiddleware)
+	e.GET("/rewards", ar.GetRewards, authMiddleware)
+	e.GET("/rewards/:id", ar.GetReward, authMiddleware)
+	e.GET("/reward", us.GetUserRewards, authMiddleware)
+	e.POST("/wallet/challenge", wh.CreateLinkChallenge, authMiddleware)
+	e.POST("/wallet/link", wh.LinkWallet, authMiddleware)
+	e.POST("/ratings", rh.CreateRating, authMiddleware)
+	e.GET("/ratings", rh.GetRatings, authMiddleware)
+	e.GET("/users/:id/score", rh.GetScore, authMiddleware)
+
+	adm := e.Group("/admin", authMiddleware, adminMiddleware)
+	adm.POST("/reward", ar.CreateRewards)
+	adm.PUT("/reward/:id", ar.UpdateReward)
+	adm.DELETE("/reward/:id", ar.ArchiveReward)
+	adm.POST("/reward/:id/restore", ar.RestoreReward)
+	adm.POST("/rating-rules", rh.CreateRatingRule)
+	adm.GET("/rating-rules", rh.GetRatingRules)
+	adm.DELETE("/rating-rules/:id", rh.DeleteRatingRule)
+	adm.GET("/jobs", jh.GetJobs)
+	adm.GET("/treasury", trh.GetTreasury)
 
 	e.Logger.Infof("Listening on %s:%s", cfg.Host, cfg.Port)
 	e.Logger.Fatal(e.Start(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)))
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/robfig/cron/v3"
+)
+
+//JobFunc is a unit of background work, it returns the number of documents it affected
+type JobFunc func(ctx context.Context) (int64, error)
+
+//Status describes the last execution of a scheduled job
+type Status struct {
+	Name         string    `json:"name"`
+	Spec         string    `json:"spec"`
+	Runs         int64     `json:"runs"`
+	Running      bool      `json:"running"`
+	LastRun      time.Time `json:"lastRun,omitempty"`
+	LastDuration string    `json:"lastDuration,omitempty"`
+	LastAffected int64     `json:"lastAffected"`
+	LastError    string    `json:"lastError,omitempty"`
+	NextRun      time.Time `json:"nextRun,omitempty"`
+}
+
+type job struct {
+	entryID cron.EntryID
+	status  Status
+}
+
+//Scheduler runs jobs on cron specs and keeps track of their last run
+type Scheduler struct {
+	cron *cron.Cron
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+//New creates a stopped scheduler
+func New() *Scheduler {
+	return &Scheduler{
+		cron: cron.New(cron.WithChain(cron.Recover(cron.DefaultLogger))),
+		jobs: make(map[string]*job),
+	}
+}
+
+//Add registers fn under name to run on spec, e.g. "@every 5m"
+func (s *Scheduler) Add(name, spec string, timeout time.Duration, fn JobFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := &job{status: Status{Name: name, Spec: spec}}
+	id, err := s.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).Then(cron.FuncJob(func() {
+		s.run(j, timeout, fn)
+	})))
+	if err != nil {
+		return err
+	}
+	j.entryID = id
+	s.jobs[name] = j
+	return nil
+}
+
+func (s *Scheduler) run(j *job, timeout time.Duration, fn JobFunc) {
+	s.mu.Lock()
+	j.status.Running = true
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	affected, err := fn(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start).String()
+	j.status.LastAffected = affected
+	j.status.LastError = ""
+	if err != nil {
+		log.Errorf("Job %s failed : %v", j.status.Name, err)
+		j.status.LastError = err.Error()
+	}
+}
+
+//Start runs the scheduler in its own goroutine
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+//Stop stops scheduling new runs and waits for running jobs to finish
+func (s *Scheduler) Stop() {
+	<-s.cron.Stop().Done()
+}
+
+//Statuses returns the status of every registered job sorted by name
+func (s *Scheduler) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st := j.status
+		st.NextRun = s.cron.Entry(j.entryID).Next
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
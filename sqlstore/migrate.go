@@ -0,0 +1,97 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"golang.org/x/net/context"
+)
+
+//migrations holds a directory of numbered .sql files per driver, applied in order and never edited once released
+//
+//go:embed migrations
+var migrations embed.FS
+
+//migrationLock is the postgres advisory lock that keeps instances starting together from migrating twice
+const migrationLock = 0x7261746e67
+
+type migration struct {
+	version int
+	name    string
+}
+
+func (db *DB) migrations() ([]migration, error) {
+	dir := path.Join("migrations", db.Driver)
+	entries, err := migrations.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []migration
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || !strings.HasSuffix(e.Name(), ".sql") {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", e.Name())
+		}
+		list = append(list, migration{version: version, name: path.Join(dir, e.Name())})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	return list, nil
+}
+
+//Migrate applies the migrations not applied yet, each in its own transaction, and returns how many ran
+func (db *DB) Migrate(ctx context.Context) (int, error) {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER   PRIMARY KEY,
+	applied_at TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create schema_migrations: %v", err)
+	}
+	list, err := db.migrations()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, m := range list {
+		ran := false
+		err = db.inTx(ctx, func(tx *sql.Tx) error {
+			if db.Driver == Postgres {
+				if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+					return err
+				}
+			}
+			var n int
+			err := tx.QueryRowContext(ctx, db.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), m.version).Scan(&n)
+			if err != nil || n > 0 {
+				return err
+			}
+			script, err := migrations.ReadFile(m.name)
+			if err != nil {
+				return err
+			}
+			if _, err = tx.ExecContext(ctx, string(script)); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, db.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"),
+				m.version, time.Now().UTC())
+			ran = err == nil
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %s failed: %v", m.name, err)
+		}
+		if ran {
+			log.Infof("Applied migration %s", m.name)
+			applied++
+		}
+	}
+	return applied, nil
+}
@@ -0,0 +1,51 @@
+CREATE TABLE users (
+	id       CHAR(24) PRIMARY KEY,
+	username TEXT     NOT NULL UNIQUE,
+	password TEXT     NOT NULL,
+	is_admin BOOLEAN  NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE rewards (
+	id                CHAR(24)    PRIMARY KEY,
+	type              TEXT        NOT NULL,
+	points            SMALLINT    NOT NULL,
+	amount_redeemable SMALLINT    NOT NULL,
+	expiry            SMALLINT    NOT NULL,
+	created_at        TIMESTAMPTZ NOT NULL,
+	updated_at        TIMESTAMPTZ,
+	deleted_at        TIMESTAMPTZ
+);
+
+CREATE TABLE user_rewards (
+	id         CHAR(24)    PRIMARY KEY,
+	user_id    CHAR(24)    NOT NULL REFERENCES users (id),
+	reward_id  CHAR(24)    NOT NULL REFERENCES rewards (id),
+	status     TEXT        NOT NULL,
+	tx_hash    TEXT        NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX user_rewards_status_expires_at ON user_rewards (status, expires_at);
+CREATE INDEX user_rewards_user_id ON user_rewards (user_id);
+
+CREATE TABLE user_reward_history (
+	id             BIGSERIAL   PRIMARY KEY,
+	user_reward_id CHAR(24)    NOT NULL REFERENCES user_rewards (id) ON DELETE CASCADE,
+	from_status    TEXT        NOT NULL,
+	to_status      TEXT        NOT NULL,
+	at             TIMESTAMPTZ NOT NULL,
+	reason         TEXT        NOT NULL DEFAULT ''
+);
+CREATE INDEX user_reward_history_user_reward_id ON user_reward_history (user_reward_id, id);
+
+CREATE TABLE wallets (
+	id         CHAR(24)    PRIMARY KEY,
+	user_id    CHAR(24)    NOT NULL REFERENCES users (id),
+	public_key TEXT        NOT NULL UNIQUE,
+	sealed_key TEXT        NOT NULL DEFAULT '',
+	hd_index   BIGINT      UNIQUE,
+	external   BOOLEAN     NOT NULL DEFAULT FALSE,
+	linked_at  TIMESTAMPTZ
+);
+-- a user links at most one external wallet
+CREATE UNIQUE INDEX wallets_external_user_id ON wallets (user_id) WHERE external;
@@ -0,0 +1,9 @@
+-- points and amounts are exact decimals of up to 16 digits and 18 decimals, see handlers.TokenAmount
+DROP INDEX rewards_points;
+ALTER TABLE rewards
+	ALTER COLUMN points TYPE NUMERIC(34, 18) USING points,
+	ALTER COLUMN amount_redeemable TYPE NUMERIC(34, 18) USING amount_redeemable;
+CREATE INDEX rewards_points ON rewards (points, id);
+ALTER TABLE reward_versions
+	ALTER COLUMN points TYPE NUMERIC(34, 18) USING points,
+	ALTER COLUMN amount_redeemable TYPE NUMERIC(34, 18) USING amount_redeemable;
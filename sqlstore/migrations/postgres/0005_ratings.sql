@@ -0,0 +1,34 @@
+-- ratings of users, rating_key is unique so a user rates another once and an event rates a user once
+CREATE TABLE ratings (
+	id         CHAR(24)    PRIMARY KEY,
+	user_id    CHAR(24)    NOT NULL REFERENCES users (id),
+	rater_id   CHAR(24)    REFERENCES users (id),
+	source     TEXT        NOT NULL,
+	event      TEXT        NOT NULL DEFAULT '',
+	value      SMALLINT    NOT NULL,
+	comment    TEXT        NOT NULL DEFAULT '',
+	rating_key TEXT        NOT NULL UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX ratings_user_id ON ratings (user_id, id);
+CREATE INDEX ratings_user_id_created_at ON ratings (user_id, created_at, id);
+
+-- the sum of the ratings of each rated user, updated with every rating
+CREATE TABLE rating_scores (
+	user_id    CHAR(24)    PRIMARY KEY REFERENCES users (id),
+	count      BIGINT      NOT NULL,
+	total      BIGINT      NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE rating_rules (
+	id          CHAR(24)         PRIMARY KEY,
+	reward_type TEXT             NOT NULL,
+	min_count   BIGINT           NOT NULL,
+	min_average DOUBLE PRECISION NOT NULL,
+	created_at  TIMESTAMPTZ      NOT NULL
+);
+
+-- a rating rule grants a user once, user rewards granted otherwise leave it NULL
+ALTER TABLE user_rewards ADD COLUMN grant_key TEXT;
+CREATE UNIQUE INDEX user_rewards_grant_key ON user_rewards (grant_key);
@@ -0,0 +1,11 @@
+-- rating rules go by the ratings on system events alone, scores sum them up apart
+ALTER TABLE rating_scores ADD COLUMN system_count BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE rating_scores ADD COLUMN system_total BIGINT NOT NULL DEFAULT 0;
+UPDATE rating_scores SET
+	system_count = (SELECT COUNT(*) FROM ratings WHERE ratings.user_id = rating_scores.user_id AND ratings.source = 'system'),
+	system_total = (SELECT COALESCE(SUM(value), 0) FROM ratings WHERE ratings.user_id = rating_scores.user_id AND ratings.source = 'system');
+
+-- the minimum average of a rule is exact, in hundredths
+ALTER TABLE rating_rules ADD COLUMN min_average_hundredths BIGINT NOT NULL DEFAULT 0;
+UPDATE rating_rules SET min_average_hundredths = CAST(ROUND(CAST(min_average * 100 AS NUMERIC)) AS BIGINT);
+ALTER TABLE rating_rules DROP COLUMN min_average;
@@ -0,0 +1,9 @@
+-- listings are ordered by a sort field then id, see sqlstore.list
+CREATE INDEX rewards_created_at ON rewards (created_at, id);
+CREATE INDEX rewards_points ON rewards (points, id);
+CREATE INDEX rewards_expiry ON rewards (expiry, id);
+DROP INDEX user_rewards_user_id;
+CREATE INDEX user_rewards_user_id ON user_rewards (user_id, id);
+CREATE INDEX user_rewards_user_id_created_at ON user_rewards (user_id, created_at, id);
+CREATE INDEX user_rewards_user_id_expires_at ON user_rewards (user_id, expires_at, id);
+CREATE INDEX user_rewards_created_at ON user_rewards (created_at, id);
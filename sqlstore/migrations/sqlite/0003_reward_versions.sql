@@ -0,0 +1,13 @@
+ALTER TABLE rewards ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE user_rewards ADD COLUMN reward_version INTEGER NOT NULL DEFAULT 1;
+
+-- the terms of earlier versions of a reward, the current ones stay on rewards
+CREATE TABLE reward_versions (
+	reward_id         CHAR(24)    NOT NULL REFERENCES rewards (id),
+	version           INTEGER     NOT NULL,
+	points            SMALLINT    NOT NULL,
+	amount_redeemable SMALLINT    NOT NULL,
+	expiry            SMALLINT    NOT NULL,
+	since             TIMESTAMP   NOT NULL,
+	PRIMARY KEY (reward_id, version)
+);
@@ -0,0 +1,18 @@
+-- points and amounts are exact decimals kept as text, they are compared as numbers, see sqlstore.compared
+DROP INDEX rewards_points;
+ALTER TABLE rewards ADD COLUMN points_decimal TEXT NOT NULL DEFAULT '0';
+ALTER TABLE rewards ADD COLUMN amount_redeemable_decimal TEXT NOT NULL DEFAULT '0';
+UPDATE rewards SET points_decimal = CAST(points AS TEXT), amount_redeemable_decimal = CAST(amount_redeemable AS TEXT);
+ALTER TABLE rewards DROP COLUMN points;
+ALTER TABLE rewards DROP COLUMN amount_redeemable;
+ALTER TABLE rewards RENAME COLUMN points_decimal TO points;
+ALTER TABLE rewards RENAME COLUMN amount_redeemable_decimal TO amount_redeemable;
+CREATE INDEX rewards_points ON rewards (CAST(points AS REAL), id);
+
+ALTER TABLE reward_versions ADD COLUMN points_decimal TEXT NOT NULL DEFAULT '0';
+ALTER TABLE reward_versions ADD COLUMN amount_redeemable_decimal TEXT NOT NULL DEFAULT '0';
+UPDATE reward_versions SET points_decimal = CAST(points AS TEXT), amount_redeemable_decimal = CAST(amount_redeemable AS TEXT);
+ALTER TABLE reward_versions DROP COLUMN points;
+ALTER TABLE reward_versions DROP COLUMN amount_redeemable;
+ALTER TABLE reward_versions RENAME COLUMN points_decimal TO points;
+ALTER TABLE reward_versions RENAME COLUMN amount_redeemable_decimal TO amount_redeemable;
@@ -0,0 +1,10 @@
+-- amounts are compared and ordered by a zero padded text key, exact unlike REAL, see handlers.TokenAmount.SortKey
+ALTER TABLE rewards ADD COLUMN points_key TEXT NOT NULL DEFAULT '';
+ALTER TABLE rewards ADD COLUMN amount_redeemable_key TEXT NOT NULL DEFAULT '';
+UPDATE rewards SET
+	points_key = printf('%016d', CAST(CASE WHEN instr(points, '.') > 0 THEN substr(points, 1, instr(points, '.') - 1) ELSE points END AS INTEGER))
+		|| '.' || substr(CASE WHEN instr(points, '.') > 0 THEN substr(points, instr(points, '.') + 1) ELSE '' END || '000000000000000000', 1, 18),
+	amount_redeemable_key = printf('%016d', CAST(CASE WHEN instr(amount_redeemable, '.') > 0 THEN substr(amount_redeemable, 1, instr(amount_redeemable, '.') - 1) ELSE amount_redeemable END AS INTEGER))
+		|| '.' || substr(CASE WHEN instr(amount_redeemable, '.') > 0 THEN substr(amount_redeemable, instr(amount_redeemable, '.') + 1) ELSE '' END || '000000000000000000', 1, 18);
+DROP INDEX rewards_points;
+CREATE INDEX rewards_points ON rewards (points_key, id);
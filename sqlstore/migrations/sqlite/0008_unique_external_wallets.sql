@@ -0,0 +1,2 @@
+-- an address is the external wallet of one user at most, linking checks it before writing
+CREATE UNIQUE INDEX wallets_external_public_key ON wallets (public_key) WHERE external;
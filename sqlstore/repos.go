@@ -0,0 +1,715 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Godtide/rating/handlers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+)
+
+//UserRepo is a handlers.UserRepo on the users table
+type UserRepo struct {
+	DB *DB
+}
+
+//RewardRepo is a handlers.RewardRepo on the rewards table
+type RewardRepo struct {
+	DB *DB
+}
+
+//UserRewardRepo is a handlers.UserRewardRepo on the user_rewards table, history is kept in user_reward_history
+type UserRewardRepo struct {
+	DB *DB
+}
+
+//WalletRepo is a handlers.WalletRepo on the wallets table
+type WalletRepo struct {
+	DB *DB
+}
+
+//RatingRepo is a handlers.RatingRepo on the ratings table, scores are kept in rating_scores
+type RatingRepo struct {
+	DB *DB
+}
+
+//RatingRuleRepo is a handlers.RatingRuleRepo on the rating_rules table
+type RatingRuleRepo struct {
+	DB *DB
+}
+
+//rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const userColumns = "id, username, password, is_admin"
+
+func scanUser(row rowScanner) (handlers.User, error) {
+	var user handlers.User
+	err := row.Scan(objectID{&user.ID}, &user.Email, &user.Password, &user.IsAdmin)
+	return user, sqlError(err)
+}
+
+//Create inserts the user with a new id
+func (r *UserRepo) Create(ctx context.Context, user handlers.User) (handlers.User, error) {
+	user.ID = primitive.NewObjectID()
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?)"),
+		user.ID.Hex(), user.Email, user.Password, user.IsAdmin)
+	if err != nil {
+		return handlers.User{}, sqlError(err)
+	}
+	return user, nil
+}
+
+//FindByID returns the user with id
+func (r *UserRepo) FindByID(ctx context.Context, id primitive.ObjectID) (handlers.User, error) {
+	return scanUser(r.DB.conn(ctx).QueryRowContext(ctx, r.DB.rebind("SELECT "+userColumns+" FROM users WHERE id = ?"), id.Hex()))
+}
+
+//FindByUsername returns the user registered under username
+func (r *UserRepo) FindByUsername(ctx context.Context, username string) (handlers.User, error) {
+	return scanUser(r.DB.conn(ctx).QueryRowContext(ctx, r.DB.rebind("SELECT "+userColumns+" FROM users WHERE username = ?"), username))
+}
+
+//userFilters are the user fields users may be looked up by
+var userFilters = map[string]string{
+	"_id":      "id",
+	"username": "username",
+}
+
+//Find returns the users matching filter in the order and range of page
+func (r *UserRepo) Find(ctx context.Context, filter handlers.Filter, page handlers.Page) ([]handlers.User, error) {
+	users := []handlers.User{}
+	cond, args, err := r.DB.list(filter, page, userFilters)
+	if err != nil {
+		return users, err
+	}
+	rows, err := r.DB.conn(ctx).QueryContext(ctx, r.DB.rebind("SELECT "+userColumns+" FROM users"+cond), args...)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+//SetAdmin grants or revokes the admin role
+func (r *UserRepo) SetAdmin(ctx context.Context, id primitive.ObjectID, admin bool) error {
+	res, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("UPDATE users SET is_admin = ? WHERE id = ?"), admin, id.Hex())
+	if err != nil {
+		return sqlError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return handlers.ErrNotFound
+	}
+	return nil
+}
+
+//Delete removes the user with id
+func (r *UserRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("DELETE FROM users WHERE id = ?"), id.Hex())
+	if err != nil {
+		return sqlError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return handlers.ErrNotFound
+	}
+	return nil
+}
+
+const rewardColumns = "id, type, points, amount_redeemable, expiry, created_at, updated_at, deleted_at, version"
+
+//rewardFilters are the reward fields GET /rewards may filter on
+var rewardFilters = map[string]string{
+	"_id":              "id",
+	"type":             "type",
+	"points":           "points",
+	"amountRedeemable": "amount_redeemable",
+	"expiry":           "expiry",
+	"createdAt":        "created_at",
+	"updatedAt":        "updated_at",
+	"deletedAt":        "deleted_at",
+}
+
+//rewardAmounts are the amounts of reward by column
+func rewardAmounts(reward handlers.Reward) []columnAmount {
+	return []columnAmount{{"points", reward.Points}, {"amount_redeemable", reward.AmountRedeemable}}
+}
+
+func scanReward(row rowScanner) (handlers.Reward, error) {
+	var (
+		reward           handlers.Reward
+		updated, deleted sql.NullTime
+	)
+	err := row.Scan(objectID{&reward.ID}, &reward.Type, &reward.Points, &reward.AmountRedeemable, &reward.Expiry,
+		&reward.CreatedAt, &updated, &deleted, &reward.Version)
+	reward.UpdatedAt, reward.DeletedAt = updated.Time, deleted.Time
+	return reward, sqlError(err)
+}
+
+//Create inserts the reward with a new id
+func (r *RewardRepo) Create(ctx context.Context, reward handlers.Reward) (handlers.Reward, error) {
+	reward.ID = primitive.NewObjectID()
+	cols := strings.Split(rewardColumns, ", ")
+	args := []interface{}{reward.ID.Hex(), reward.Type, reward.Points, reward.AmountRedeemable, reward.Expiry,
+		reward.CreatedAt.UTC(), nullTime(reward.UpdatedAt), nullTime(reward.DeletedAt), reward.Version}
+	keyCols, keyArgs := r.DB.amountKeys(rewardAmounts(reward)...)
+	cols, args = append(cols, keyCols...), append(args, keyArgs...)
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("INSERT INTO rewards ("+strings.Join(cols, ", ")+") VALUES (?"+
+		strings.Repeat(", ?", len(cols)-1)+")"), args...)
+	if err != nil {
+		return handlers.Reward{}, sqlError(err)
+	}
+	return reward, nil
+}
+
+//FindByID returns the reward with id
+func (r *RewardRepo) FindByID(ctx context.Context, id primitive.ObjectID) (handlers.Reward, error) {
+	return scanReward(r.DB.conn(ctx).QueryRowContext(ctx, r.DB.rebind("SELECT "+rewardColumns+" FROM rewards WHERE id = ?"), id.Hex()))
+}
+
+//FindVersion returns the reward with the terms of version, earlier terms are read from reward_versions
+func (r *RewardRepo) FindVersion(ctx context.Context, id primitive.ObjectID, version int) (handlers.Reward, error) {
+	reward, err := r.FindByID(ctx, id)
+	if err != nil || reward.Version == version {
+		return reward, err
+	}
+	terms := handlers.RewardTerms{Version: version}
+	err = r.DB.conn(ctx).QueryRowContext(ctx,
+		r.DB.rebind("SELECT points, amount_redeemable, expiry, since FROM reward_versions WHERE reward_id = ? AND version = ?"),
+		id.Hex(), version).Scan(&terms.Points, &terms.AmountRedeemable, &terms.Expiry, &terms.Since)
+	if err != nil {
+		return handlers.Reward{}, sqlError(err)
+	}
+	reward.Versions = []handlers.RewardTerms{terms}
+	reward, _ = reward.AtVersion(version)
+	reward.Versions = nil
+	return reward, nil
+}
+
+//Update keeps the current terms in reward_versions and replaces them if the reward is still unarchived at reward.Version
+func (r *RewardRepo) Update(ctx context.Context, reward handlers.Reward) (handlers.Reward, error) {
+	err := r.DB.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := scanReward(tx.QueryRowContext(ctx, r.DB.rebind("SELECT "+rewardColumns+" FROM rewards WHERE id = ?"), reward.ID.Hex()))
+		if err != nil {
+			return err
+		}
+		if current.Version != reward.Version || !current.DeletedAt.IsZero() {
+			return handlers.ErrConflict
+		}
+		terms := current.Terms()
+		// a concurrent update of the same version collides on the primary key
+		_, err = tx.ExecContext(ctx, r.DB.rebind("INSERT INTO reward_versions (reward_id, version, points, amount_redeemable, expiry, since) "+
+			"VALUES (?, ?, ?, ?, ?, ?)"), reward.ID.Hex(), terms.Version, terms.Points, terms.AmountRedeemable, terms.Expiry, terms.Since.UTC())
+		if err != nil {
+			return err
+		}
+		set := "type = ?, points = ?, amount_redeemable = ?, expiry = ?, updated_at = ?, version = version + 1"
+		args := []interface{}{reward.Type, reward.Points, reward.AmountRedeemable, reward.Expiry, reward.UpdatedAt.UTC()}
+		keyCols, keyArgs := r.DB.amountKeys(rewardAmounts(reward)...)
+		for _, col := range keyCols {
+			set += ", " + col + " = ?"
+		}
+		args = append(append(args, keyArgs...), reward.ID.Hex(), reward.Version)
+		res, err := tx.ExecContext(ctx, r.DB.rebind("UPDATE rewards SET "+set+" WHERE id = ? AND version = ? AND deleted_at IS NULL"), args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return handlers.ErrConflict
+		}
+		return nil
+	})
+	if errors.Is(sqlError(err), handlers.ErrConflict) {
+		return handlers.Reward{}, handlers.ErrConflict
+	}
+	if err != nil {
+		return handlers.Reward{}, sqlError(err)
+	}
+	return r.FindByID(ctx, reward.ID)
+}
+
+//Archive sets deleted_at unless it is set already
+func (r *RewardRepo) Archive(ctx context.Context, id primitive.ObjectID, at time.Time) (handlers.Reward, error) {
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("UPDATE rewards SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"),
+		at.UTC(), id.Hex())
+	if err != nil {
+		return handlers.Reward{}, sqlError(err)
+	}
+	return r.FindByID(ctx, id)
+}
+
+//Restore clears deleted_at
+func (r *RewardRepo) Restore(ctx context.Context, id primitive.ObjectID) (handlers.Reward, error) {
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("UPDATE rewards SET deleted_at = NULL WHERE id = ?"), id.Hex())
+	if err != nil {
+		return handlers.Reward{}, sqlError(err)
+	}
+	return r.FindByID(ctx, id)
+}
+
+//Find returns the rewards matching filter in the order and range of page
+func (r *RewardRepo) Find(ctx context.Context, filter handlers.Filter, page handlers.Page) ([]handlers.Reward, error) {
+	rewards := []handlers.Reward{}
+	cond, args, err := r.DB.list(filter, page, rewardFilters)
+	if err != nil {
+		return rewards, err
+	}
+	rows, err := r.DB.conn(ctx).QueryContext(ctx, r.DB.rebind("SELECT "+rewardColumns+" FROM rewards"+cond), args...)
+	if err != nil {
+		return rewards, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		reward, err := scanReward(rows)
+		if err != nil {
+			return rewards, err
+		}
+		rewards = append(rewards, reward)
+	}
+	return rewards, rows.Err()
+}
+
+const userRewardColumns = "id, user_id, reward_id, reward_version, status, tx_hash, created_at, expires_at, grant_key"
+
+//userRewardFilters are the userReward fields listings may filter on
+var userRewardFilters = map[string]string{
+	"_id":       "id",
+	"user_id":   "user_id",
+	"reward_id": "reward_id",
+	"status":    "status",
+	"txHash":    "tx_hash",
+	"createdAt": "created_at",
+	"expiresAt": "expires_at",
+}
+
+func scanUserReward(row rowScanner) (handlers.UserReward, error) {
+	var (
+		userReward handlers.UserReward
+		grantKey   sql.NullString
+	)
+	err := row.Scan(objectID{&userReward.ID}, objectID{&userReward.UserId}, objectID{&userReward.RewardId}, &userReward.RewardVersion,
+		&userReward.Status, &userReward.TxHash, &userReward.CreatedAt, &userReward.ExpiresAt, &grantKey)
+	userReward.GrantKey = grantKey.String
+	return userReward, sqlError(err)
+}
+
+//loadHistory fills in the history of userRewards, oldest change first
+func (r *UserRewardRepo) loadHistory(ctx context.Context, userRewards []handlers.UserReward) error {
+	if len(userRewards) == 0 {
+		return nil
+	}
+	index := make(map[string]int, len(userRewards))
+	args := make([]interface{}, len(userRewards))
+	for i, userReward := range userRewards {
+		index[userReward.ID.Hex()] = i
+		args[i] = userReward.ID.Hex()
+	}
+	query := "SELECT user_reward_id, from_status, to_status, at, reason FROM user_reward_history WHERE user_reward_id IN (" +
+		strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ") + ") ORDER BY id"
+	rows, err := r.DB.conn(ctx).QueryContext(ctx, r.DB.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id     string
+			change handlers.StatusChange
+		)
+		if err = rows.Scan(&id, &change.From, &change.To, &change.At, &change.Reason); err != nil {
+			return err
+		}
+		i := index[strings.TrimSpace(id)]
+		userRewards[i].History = append(userRewards[i].History, change)
+	}
+	return rows.Err()
+}
+
+func addHistory(ctx context.Context, db *DB, tx *sql.Tx, id string, change handlers.StatusChange) error {
+	_, err := tx.ExecContext(ctx, db.rebind("INSERT INTO user_reward_history (user_reward_id, from_status, to_status, at, reason) VALUES (?, ?, ?, ?, ?)"),
+		id, change.From, change.To, change.At.UTC(), change.Reason)
+	return err
+}
+
+//Create inserts the userReward with a new id
+func (r *UserRewardRepo) Create(ctx context.Context, userReward handlers.UserReward) (handlers.UserReward, error) {
+	userReward.ID = primitive.NewObjectID()
+	err := r.DB.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, r.DB.rebind("INSERT INTO user_rewards ("+userRewardColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			userReward.ID.Hex(), userReward.UserId.Hex(), userReward.RewardId.Hex(), userReward.RewardVersion, userReward.Status, userReward.TxHash,
+			userReward.CreatedAt.UTC(), userReward.ExpiresAt.UTC(), nullString(userReward.GrantKey))
+		if err != nil {
+			return err
+		}
+		for _, change := range userReward.History {
+			if err = addHistory(ctx, r.DB, tx, userReward.ID.Hex(), change); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return handlers.UserReward{}, sqlError(err)
+	}
+	return userReward, nil
+}
+
+//FindByID returns the userReward with id
+func (r *UserRewardRepo) FindByID(ctx context.Context, id primitive.ObjectID) (handlers.UserReward, error) {
+	userReward, err := scanUserReward(r.DB.conn(ctx).QueryRowContext(ctx,
+		r.DB.rebind("SELECT "+userRewardColumns+" FROM user_rewards WHERE id = ?"), id.Hex()))
+	if err != nil {
+		return userReward, err
+	}
+	userRewards := []handlers.UserReward{userReward}
+	err = r.loadHistory(ctx, userRewards)
+	return userRewards[0], err
+}
+
+//Find returns the userRewards matching filter in the order and range of page
+func (r *UserRewardRepo) Find(ctx context.Context, filter handlers.Filter, page handlers.Page) ([]handlers.UserReward, error) {
+	userRewards := []handlers.UserReward{}
+	cond, args, err := r.DB.list(filter, page, userRewardFilters)
+	if err != nil {
+		return userRewards, err
+	}
+	rows, err := r.DB.conn(ctx).QueryContext(ctx, r.DB.rebind("SELECT "+userRewardColumns+" FROM user_rewards"+cond), args...)
+	if err != nil {
+		return userRewards, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		userReward, err := scanUserReward(rows)
+		if err != nil {
+			return userRewards, err
+		}
+		userRewards = append(userRewards, userReward)
+	}
+	if err = rows.Err(); err != nil {
+		return userRewards, err
+	}
+	rows.Close()
+	return userRewards, r.loadHistory(ctx, userRewards)
+}
+
+//Transition atomically moves the userReward, claims also require it to be unexpired
+func (r *UserRewardRepo) Transition(ctx context.Context, id primitive.ObjectID, change handlers.StatusChange, txHash string) (bool, error) {
+	query := "UPDATE user_rewards SET status = ?"
+	args := []interface{}{change.To}
+	if txHash != "" {
+		query += ", tx_hash = ?"
+		args = append(args, txHash)
+	}
+	query += " WHERE id = ? AND status = ?"
+	args = append(args, id.Hex(), change.From)
+	if change.To == handlers.UserRewardClaiming {
+		query += " AND expires_at > ?"
+		args = append(args, change.At.UTC())
+	}
+	moved := false
+	err := r.DB.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, r.DB.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return err
+		}
+		moved = true
+		return addHistory(ctx, r.DB, tx, id.Hex(), change)
+	})
+	if err != nil {
+		return false, sqlError(err)
+	}
+	return moved, nil
+}
+
+//SetTxHash records the transaction currently paying out the userReward
+func (r *UserRewardRepo) SetTxHash(ctx context.Context, id primitive.ObjectID, txHash string) error {
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("UPDATE user_rewards SET tx_hash = ? WHERE id = ?"), txHash, id.Hex())
+	return sqlError(err)
+}
+
+//Expire moves open and failed userRewards past their expiresAt to expired
+func (r *UserRewardRepo) Expire(ctx context.Context, now time.Time) (int64, error) {
+	var expired int64
+	for _, from := range []string{handlers.UserRewardOpen, handlers.UserRewardFailed} {
+		change := handlers.StatusChange{
+			From:   from,
+			To:     handlers.UserRewardExpired,
+			At:     now,
+			Reason: "expired by scheduler",
+		}
+		err := r.DB.inTx(ctx, func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx, r.DB.rebind("UPDATE user_rewards SET status = ? WHERE status = ? AND expires_at <= ? RETURNING id"),
+				handlers.UserRewardExpired, from, now.UTC())
+			if err != nil {
+				return err
+			}
+			var ids []string
+			for rows.Next() {
+				var id string
+				if err = rows.Scan(&id); err != nil {
+					rows.Close()
+					return err
+				}
+				ids = append(ids, strings.TrimSpace(id))
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if err = addHistory(ctx, r.DB, tx, id, change); err != nil {
+					return err
+				}
+			}
+			expired += int64(len(ids))
+			return nil
+		})
+		if err != nil {
+			return expired, sqlError(err)
+		}
+	}
+	return expired, nil
+}
+
+//Delete removes the userReward with id along with its history
+func (r *UserRewardRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("DELETE FROM user_rewards WHERE id = ?"), id.Hex())
+	if err != nil {
+		return sqlError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return handlers.ErrNotFound
+	}
+	return nil
+}
+
+const walletColumns = "id, user_id, public_key, sealed_key, hd_index, external, linked_at"
+
+func scanWallet(row rowScanner) (handlers.Wallet, error) {
+	var (
+		wallet   handlers.Wallet
+		hdIndex  sql.NullInt64
+		linkedAt sql.NullTime
+	)
+	err := row.Scan(objectID{&wallet.ID}, objectID{&wallet.UserId}, &wallet.PublicKey, &wallet.SealedKey,
+		&hdIndex, &wallet.External, &linkedAt)
+	if hdIndex.Valid {
+		index := uint32(hdIndex.Int64)
+		wallet.HDIndex = &index
+	}
+	wallet.LinkedAt = linkedAt.Time
+	return wallet, sqlError(err)
+}
+
+//Create inserts the wallet with a new id
+func (r *WalletRepo) Create(ctx context.Context, wallet handlers.Wallet) (handlers.Wallet, error) {
+	wallet.ID = primitive.NewObjectID()
+	var hdIndex interface{}
+	if wallet.HDIndex != nil {
+		hdIndex = int64(*wallet.HDIndex)
+	}
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("INSERT INTO wallets ("+walletColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		wallet.ID.Hex(), wallet.UserId.Hex(), wallet.PublicKey, wallet.SealedKey, hdIndex, wallet.External, nullTime(wallet.LinkedAt))
+	if err != nil {
+		return handlers.Wallet{}, sqlError(err)
+	}
+	return wallet, nil
+}
+
+//FindByUser returns the external wallet of the user if one is linked, else the custodial one
+func (r *WalletRepo) FindByUser(ctx context.Context, userID primitive.ObjectID) (handlers.Wallet, error) {
+	return scanWallet(r.DB.conn(ctx).QueryRowContext(ctx,
+		r.DB.rebind("SELECT "+walletColumns+" FROM wallets WHERE user_id = ? ORDER BY external DESC LIMIT 1"), userID.Hex()))
+}
+
+//LinkExternal records address as the external wallet of the user, replacing the one linked before
+func (r *WalletRepo) LinkExternal(ctx context.Context, userID primitive.ObjectID, address string, at time.Time) (handlers.Wallet, error) {
+	wallet := handlers.Wallet{UserId: userID, PublicKey: address, External: true, LinkedAt: at}
+	err := r.DB.inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRowContext(ctx, r.DB.rebind("SELECT COUNT(*) FROM wallets WHERE public_key = ? AND user_id <> ?"),
+			address, userID.Hex()).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return handlers.ErrConflict
+		}
+		res, err := tx.ExecContext(ctx, r.DB.rebind("UPDATE wallets SET public_key = ?, linked_at = ? WHERE user_id = ? AND external = ?"),
+			address, at.UTC(), userID.Hex(), true)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, r.DB.rebind("INSERT INTO wallets ("+walletColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)"),
+			primitive.NewObjectID().Hex(), userID.Hex(), address, "", nil, true, at.UTC())
+		return err
+	})
+	if err != nil {
+		return handlers.Wallet{}, sqlError(err)
+	}
+	return wallet, nil
+}
+
+const ratingColumns = "id, user_id, rater_id, source, event, value, comment, rating_key, created_at"
+
+//ratingFilters are the rating fields listings may filter on
+var ratingFilters = map[string]string{
+	"_id":       "id",
+	"user_id":   "user_id",
+	"rater_id":  "rater_id",
+	"source":    "source",
+	"event":     "event",
+	"value":     "value",
+	"createdAt": "created_at",
+}
+
+func scanRating(row rowScanner) (handlers.Rating, error) {
+	var rating handlers.Rating
+	err := row.Scan(objectID{&rating.ID}, objectID{&rating.UserId}, objectID{&rating.RaterId}, &rating.Source, &rating.Event,
+		&rating.Value, &rating.Comment, &rating.Key, &rating.CreatedAt)
+	return rating, sqlError(err)
+}
+
+//Create inserts the rating with a new id and adds it to the score of the rated user in one transaction
+func (r *RatingRepo) Create(ctx context.Context, rating handlers.Rating) (handlers.Rating, handlers.Score, error) {
+	rating.ID = primitive.NewObjectID()
+	var score handlers.Score
+	err := r.DB.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, r.DB.rebind("INSERT INTO ratings ("+ratingColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			rating.ID.Hex(), rating.UserId.Hex(), nullID(rating.RaterId), rating.Source, rating.Event, rating.Value, rating.Comment,
+			rating.Key, rating.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+		systemCount, systemTotal := 0, 0
+		if rating.Source == handlers.RatingBySystem {
+			systemCount, systemTotal = 1, rating.Value
+		}
+		_, err = tx.ExecContext(ctx, r.DB.rebind("INSERT INTO rating_scores (user_id, count, total, system_count, system_total, updated_at) "+
+			"VALUES (?, 1, ?, ?, ?, ?) ON CONFLICT (user_id) DO UPDATE SET count = rating_scores.count + 1, "+
+			"total = rating_scores.total + excluded.total, system_count = rating_scores.system_count + excluded.system_count, "+
+			"system_total = rating_scores.system_total + excluded.system_total, updated_at = excluded.updated_at"),
+			rating.UserId.Hex(), rating.Value, systemCount, systemTotal, rating.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+		score, err = scanScore(tx.QueryRowContext(ctx, r.DB.rebind("SELECT "+scoreColumns+" FROM rating_scores WHERE user_id = ?"),
+			rating.UserId.Hex()))
+		return err
+	})
+	if err != nil {
+		return handlers.Rating{}, handlers.Score{}, sqlError(err)
+	}
+	return rating, score, nil
+}
+
+//Find returns the ratings matching filter in the order and range of page
+func (r *RatingRepo) Find(ctx context.Context, filter handlers.Filter, page handlers.Page) ([]handlers.Rating, error) {
+	ratings := []handlers.Rating{}
+	cond, args, err := r.DB.list(filter, page, ratingFilters)
+	if err != nil {
+		return ratings, err
+	}
+	rows, err := r.DB.conn(ctx).QueryContext(ctx, r.DB.rebind("SELECT "+ratingColumns+" FROM ratings"+cond), args...)
+	if err != nil {
+		return ratings, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rating, err := scanRating(rows)
+		if err != nil {
+			return ratings, err
+		}
+		ratings = append(ratings, rating)
+	}
+	return ratings, rows.Err()
+}
+
+const scoreColumns = "user_id, count, total, system_count, system_total, updated_at"
+
+func scanScore(row rowScanner) (handlers.Score, error) {
+	var score handlers.Score
+	err := row.Scan(objectID{&score.UserId}, &score.Count, &score.Total, &score.SystemCount, &score.SystemTotal, &score.UpdatedAt)
+	return score, err
+}
+
+//Score returns the score of the user, the zero Score when nobody rated them
+func (r *RatingRepo) Score(ctx context.Context, userID primitive.ObjectID) (handlers.Score, error) {
+	score, err := scanScore(r.DB.conn(ctx).QueryRowContext(ctx,
+		r.DB.rebind("SELECT "+scoreColumns+" FROM rating_scores WHERE user_id = ?"), userID.Hex()))
+	if err == sql.ErrNoRows {
+		return handlers.Score{UserId: userID}, nil
+	}
+	return score, sqlError(err)
+}
+
+const ratingRuleColumns = "id, reward_type, min_count, min_average_hundredths, created_at"
+
+//ratingRuleFilters are the rating rule fields listings may filter on
+var ratingRuleFilters = map[string]string{
+	"_id":        "id",
+	"rewardType": "reward_type",
+	"createdAt":  "created_at",
+}
+
+//Create inserts the rule with a new id
+func (r *RatingRuleRepo) Create(ctx context.Context, rule handlers.RatingRule) (handlers.RatingRule, error) {
+	rule.ID = primitive.NewObjectID()
+	_, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("INSERT INTO rating_rules ("+ratingRuleColumns+") VALUES (?, ?, ?, ?, ?)"),
+		rule.ID.Hex(), rule.RewardType, rule.MinCount, rule.MinAverage, rule.CreatedAt.UTC())
+	if err != nil {
+		return handlers.RatingRule{}, sqlError(err)
+	}
+	return rule, nil
+}
+
+//Find returns the rules matching filter in the order and range of page
+func (r *RatingRuleRepo) Find(ctx context.Context, filter handlers.Filter, page handlers.Page) ([]handlers.RatingRule, error) {
+	rules := []handlers.RatingRule{}
+	cond, args, err := r.DB.list(filter, page, ratingRuleFilters)
+	if err != nil {
+		return rules, err
+	}
+	rows, err := r.DB.conn(ctx).QueryContext(ctx, r.DB.rebind("SELECT "+ratingRuleColumns+" FROM rating_rules"+cond), args...)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rule handlers.RatingRule
+		if err = rows.Scan(objectID{&rule.ID}, &rule.RewardType, &rule.MinCount, &rule.MinAverage, &rule.CreatedAt); err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+//Delete removes the rule with id
+func (r *RatingRuleRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.DB.conn(ctx).ExecContext(ctx, r.DB.rebind("DELETE FROM rating_rules WHERE id = ?"), id.Hex())
+	if err != nil {
+		return sqlError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return handlers.ErrNotFound
+	}
+	return nil
+}
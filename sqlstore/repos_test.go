@@ -0,0 +1,494 @@
+package sqlstore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Godtide/rating/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+)
+
+func openTestDB(t *testing.T) *DB {
+	db, err := Open(SQLite, filepath.Join(t.TempDir(), "rating.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	applied, err := db.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 8, applied)
+	return db
+}
+
+func amount(t *testing.T, s string) handlers.TokenAmount {
+	a, err := handlers.ParseTokenAmount(s)
+	require.NoError(t, err)
+	return a
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	applied, err := db.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+}
+
+func TestRebind(t *testing.T) {
+	db := &DB{Driver: Postgres}
+	assert.Equal(t, "SELECT a FROM t WHERE b = $1 AND c = $2", db.rebind("SELECT a FROM t WHERE b = ? AND c = ?"))
+	db.Driver = SQLite
+	assert.Equal(t, "SELECT a FROM t WHERE b = ?", db.rebind("SELECT a FROM t WHERE b = ?"))
+}
+
+func TestUserRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := &UserRepo{DB: openTestDB(t)}
+
+	user, err := repo.Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	require.NoError(t, err)
+	_, err = repo.Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	assert.True(t, errors.Is(err, handlers.ErrConflict), "%v", err)
+
+	found, err := repo.FindByUsername(ctx, "ada@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, user, found)
+	_, err = repo.FindByID(ctx, primitive.NewObjectID())
+	assert.Equal(t, handlers.ErrNotFound, err)
+
+	require.NoError(t, repo.SetAdmin(ctx, user.ID, true))
+	found, err = repo.FindByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.True(t, found.IsAdmin)
+	assert.Equal(t, handlers.ErrNotFound, repo.SetAdmin(ctx, primitive.NewObjectID(), true))
+}
+
+func TestRewardRepoFind(t *testing.T) {
+	ctx := context.Background()
+	repo := &RewardRepo{DB: openTestDB(t)}
+	now := time.Now().Truncate(time.Millisecond)
+	high, err := repo.Create(ctx, handlers.Reward{Type: "high", Points: amount(t, "10"), AmountRedeemable: amount(t, "0.25"), Expiry: 7, CreatedAt: now})
+	require.NoError(t, err)
+	_, err = repo.Create(ctx, handlers.Reward{Type: "low", Points: amount(t, "9.5"), AmountRedeemable: amount(t, "1"), Expiry: 7, CreatedAt: now})
+	require.NoError(t, err)
+
+	rewards, err := repo.Find(ctx, handlers.Filter{}, handlers.Page{})
+	require.NoError(t, err)
+	assert.Len(t, rewards, 2)
+
+	rewards, err = repo.Find(ctx, handlers.Filter{handlers.Eq("points", amount(t, "10")), handlers.Eq("type", "high")}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, rewards, 1)
+	assert.Equal(t, high.ID, rewards[0].ID)
+	assert.Equal(t, "0.25", rewards[0].AmountRedeemable.String())
+	assert.True(t, now.Equal(rewards[0].CreatedAt))
+	assert.True(t, rewards[0].DeletedAt.IsZero())
+
+	rewards, err = repo.Find(ctx, handlers.Filter{
+		{Field: "points", Op: handlers.OpGt, Value: amount(t, "9.75")},
+		{Field: "createdAt", Op: handlers.OpGte, Value: now},
+		{Field: "createdAt", Op: handlers.OpLt, Value: now.Add(time.Second)},
+		{Field: "type", Op: handlers.OpIn, Value: []interface{}{"high", "medium"}},
+	}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, rewards, 1)
+	assert.Equal(t, high.ID, rewards[0].ID)
+	rewards, err = repo.Find(ctx, handlers.Filter{{Field: "createdAt", Op: handlers.OpGt, Value: now}}, handlers.Page{})
+	require.NoError(t, err)
+	assert.Empty(t, rewards)
+
+	for _, filter := range []handlers.Filter{{handlers.Eq("password", "x")}, {{Field: "points", Op: "like", Value: amount(t, "1")}}} {
+		_, err = repo.Find(ctx, filter, handlers.Page{})
+		assert.True(t, errors.Is(err, handlers.ErrInvalidFilter), "%v", filter)
+	}
+}
+
+func TestRewardRepoPages(t *testing.T) {
+	ctx := context.Background()
+	repo := &RewardRepo{DB: openTestDB(t)}
+	for _, points := range []string{"3", "1", "10", "3", "1"} {
+		_, err := repo.Create(ctx, handlers.Reward{Type: "high", Points: amount(t, points), AmountRedeemable: amount(t, "1"), Expiry: 7,
+			CreatedAt: time.Now()})
+		require.NoError(t, err)
+	}
+
+	var seen []string
+	page := handlers.Page{Limit: 2, Sort: "points", Desc: true}
+	for {
+		rewards, err := repo.Find(ctx, handlers.Filter{}, page)
+		require.NoError(t, err)
+		for _, reward := range rewards {
+			seen = append(seen, reward.Points.String())
+		}
+		if len(rewards) < page.Limit {
+			break
+		}
+		last := rewards[len(rewards)-1]
+		page.After = &handlers.Cursor{Value: last.Points, ID: last.ID}
+	}
+	assert.Equal(t, []string{"10", "3", "3", "1", "1"}, seen, "amounts are ordered as numbers")
+
+	_, err := repo.Find(ctx, handlers.Filter{}, handlers.Page{Sort: "password"})
+	assert.True(t, errors.Is(err, handlers.ErrInvalidFilter), "%v", err)
+}
+
+func TestRewardRepoComparesAmountsExactly(t *testing.T) {
+	ctx := context.Background()
+	repo := &RewardRepo{DB: openTestDB(t)}
+	// equal as float64
+	points := []string{"1234567890123456.000000000000000002", "1234567890123456.000000000000000001", "1234567890123456"}
+	for _, p := range points {
+		_, err := repo.Create(ctx, handlers.Reward{Type: "high", Points: amount(t, p), AmountRedeemable: amount(t, "1"), Expiry: 7,
+			CreatedAt: time.Now()})
+		require.NoError(t, err)
+	}
+
+	rewards, err := repo.Find(ctx, handlers.Filter{handlers.Eq("points", amount(t, points[1]))}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, rewards, 1)
+	assert.Equal(t, points[1], rewards[0].Points.String())
+
+	rewards, err = repo.Find(ctx, handlers.Filter{{Field: "points", Op: handlers.OpGt, Value: amount(t, points[2])}},
+		handlers.Page{Sort: "points"})
+	require.NoError(t, err)
+	require.Len(t, rewards, 2)
+	assert.Equal(t, points[1], rewards[0].Points.String())
+	assert.Equal(t, points[0], rewards[1].Points.String())
+}
+
+//openTestDBWithout opens a database migrated but for version, applyMigration runs it later
+func openTestDBWithout(t *testing.T, version int) *DB {
+	ctx := context.Background()
+	db, err := Open(SQLite, filepath.Join(t.TempDir(), "rating.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.ExecContext(ctx, "CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", version, time.Now())
+	require.NoError(t, err)
+	_, err = db.Migrate(ctx)
+	require.NoError(t, err)
+	return db
+}
+
+func applyMigration(t *testing.T, db *DB, version int) {
+	ctx := context.Background()
+	_, err := db.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", version)
+	require.NoError(t, err)
+	applied, err := db.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, applied)
+}
+
+func TestMigrateKeysStoredAmounts(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDBWithout(t, 6)
+	var err error
+	stored := map[string]string{"12.5": "0.000000000000000001", "1234567890123456": "7"}
+	for points, amountRedeemable := range stored {
+		_, err = db.ExecContext(ctx, "INSERT INTO rewards (id, type, points, amount_redeemable, expiry, created_at, version) "+
+			"VALUES (?, 'high', ?, ?, 7, ?, 1)", primitive.NewObjectID().Hex(), points, amountRedeemable, time.Now())
+		require.NoError(t, err)
+	}
+
+	applyMigration(t, db, 6)
+	rows, err := db.QueryContext(ctx, "SELECT points, amount_redeemable, points_key, amount_redeemable_key FROM rewards")
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			points, amountRedeemable handlers.TokenAmount
+			pointsKey, amountKey     string
+		)
+		require.NoError(t, rows.Scan(&points, &amountRedeemable, &pointsKey, &amountKey))
+		assert.Equal(t, points.SortKey(), pointsKey)
+		assert.Equal(t, amountRedeemable.SortKey(), amountKey)
+	}
+	require.NoError(t, rows.Err())
+}
+
+func TestRewardRepoVersions(t *testing.T) {
+	ctx := context.Background()
+	repo := &RewardRepo{DB: openTestDB(t)}
+	created := time.Now().Truncate(time.Millisecond)
+	reward, err := repo.Create(ctx, handlers.Reward{Type: "high", Points: amount(t, "2"), AmountRedeemable: amount(t, "3"), Expiry: 7,
+		CreatedAt: created, Version: 1})
+	require.NoError(t, err)
+
+	reward.Points, reward.UpdatedAt = amount(t, "5.5"), created.Add(time.Hour)
+	updated, err := repo.Update(ctx, reward)
+	require.NoError(t, err)
+	assert.Equal(t, 2, updated.Version)
+	assert.Equal(t, "5.5", updated.Points.String())
+	_, err = repo.Update(ctx, reward)
+	assert.Equal(t, handlers.ErrConflict, err)
+
+	first, err := repo.FindVersion(ctx, reward.ID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, first.Version)
+	assert.Equal(t, "2", first.Points.String())
+	second, err := repo.FindVersion(ctx, reward.ID, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "5.5", second.Points.String())
+	_, err = repo.FindVersion(ctx, reward.ID, 3)
+	assert.Equal(t, handlers.ErrNotFound, err)
+
+	archived, err := repo.Archive(ctx, reward.ID, created)
+	require.NoError(t, err)
+	assert.True(t, created.Equal(archived.DeletedAt))
+	archived, err = repo.Archive(ctx, reward.ID, created.Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, created.Equal(archived.DeletedAt), "archiving twice keeps the first time")
+	updated.Points = amount(t, "9")
+	_, err = repo.Update(ctx, updated)
+	assert.Equal(t, handlers.ErrConflict, err)
+	unarchived := handlers.Filter{{Field: "deletedAt", Op: handlers.OpExists, Value: false}}
+	rewards, err := repo.Find(ctx, unarchived, handlers.Page{})
+	require.NoError(t, err)
+	assert.Empty(t, rewards)
+
+	restored, err := repo.Restore(ctx, reward.ID)
+	require.NoError(t, err)
+	assert.True(t, restored.DeletedAt.IsZero())
+	rewards, err = repo.Find(ctx, unarchived, handlers.Page{})
+	require.NoError(t, err)
+	assert.Len(t, rewards, 1)
+}
+
+func TestUserRewardRepoTransitions(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	user, err := (&UserRepo{DB: db}).Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	require.NoError(t, err)
+	reward, err := (&RewardRepo{DB: db}).Create(ctx, handlers.Reward{Type: "high", Points: amount(t, "1"), AmountRedeemable: amount(t, "1"), Expiry: 1,
+		CreatedAt: time.Now()})
+	require.NoError(t, err)
+	repo := &UserRewardRepo{DB: db}
+
+	now := time.Now()
+	open, err := repo.Create(ctx, handlers.UserReward{UserId: user.ID, RewardId: reward.ID, Status: handlers.UserRewardOpen,
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	require.NoError(t, err)
+	stale, err := repo.Create(ctx, handlers.UserReward{UserId: user.ID, RewardId: reward.ID, Status: handlers.UserRewardOpen,
+		CreatedAt: now, ExpiresAt: now.Add(-time.Second)})
+	require.NoError(t, err)
+
+	claim := handlers.StatusChange{From: handlers.UserRewardOpen, To: handlers.UserRewardClaiming, At: now}
+	moved, err := repo.Transition(ctx, stale.ID, claim, "")
+	require.NoError(t, err)
+	assert.False(t, moved, "expired rewards cannot be claimed")
+	moved, err = repo.Transition(ctx, open.ID, claim, "0xabc")
+	require.NoError(t, err)
+	assert.True(t, moved)
+	moved, err = repo.Transition(ctx, open.ID, claim, "")
+	require.NoError(t, err)
+	assert.False(t, moved)
+
+	found, err := repo.FindByID(ctx, open.ID)
+	require.NoError(t, err)
+	assert.Equal(t, handlers.UserRewardClaiming, found.Status)
+	assert.Equal(t, "0xabc", found.TxHash)
+	require.Len(t, found.History, 1)
+	assert.Equal(t, handlers.UserRewardClaiming, found.History[0].To)
+
+	expired, err := repo.Expire(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), expired)
+	userRewards, err := repo.Find(ctx, handlers.Filter{handlers.Eq("status", handlers.UserRewardExpired), handlers.Eq("user_id", user.ID)}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, userRewards, 1)
+	assert.Equal(t, stale.ID, userRewards[0].ID)
+	require.Len(t, userRewards[0].History, 1)
+	assert.Equal(t, "expired by scheduler", userRewards[0].History[0].Reason)
+
+	require.NoError(t, repo.Delete(ctx, stale.ID))
+	assert.Equal(t, handlers.ErrNotFound, repo.Delete(ctx, stale.ID))
+}
+
+func TestWalletRepoLinkExternal(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := &UserRepo{DB: db}
+	ada, err := users.Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	require.NoError(t, err)
+	bob, err := users.Create(ctx, handlers.User{Email: "bob@example.com", Password: "hash"})
+	require.NoError(t, err)
+	repo := &WalletRepo{DB: db}
+
+	index := uint32(4)
+	custodial, err := repo.Create(ctx, handlers.Wallet{UserId: ada.ID, PublicKey: "0x01", SealedKey: "sealed", HDIndex: &index})
+	require.NoError(t, err)
+	found, err := repo.FindByUser(ctx, ada.ID)
+	require.NoError(t, err)
+	assert.Equal(t, custodial.ID, found.ID)
+	require.NotNil(t, found.HDIndex)
+	assert.Equal(t, index, *found.HDIndex)
+
+	_, err = repo.LinkExternal(ctx, ada.ID, "0x02", time.Now())
+	require.NoError(t, err)
+	_, err = repo.LinkExternal(ctx, ada.ID, "0x03", time.Now())
+	require.NoError(t, err)
+	found, err = repo.FindByUser(ctx, ada.ID)
+	require.NoError(t, err)
+	assert.True(t, found.External)
+	assert.Equal(t, "0x03", found.PublicKey)
+
+	_, err = repo.LinkExternal(ctx, bob.ID, "0x03", time.Now())
+	assert.Equal(t, handlers.ErrConflict, err)
+	_, err = repo.FindByUser(ctx, bob.ID)
+	assert.Equal(t, handlers.ErrNotFound, err)
+
+	// a link racing past the check is refused by the index
+	_, err = db.ExecContext(ctx, "INSERT INTO wallets ("+walletColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		primitive.NewObjectID().Hex(), bob.ID.Hex(), "0x03", "", nil, true, time.Now())
+	assert.True(t, errors.Is(sqlError(err), handlers.ErrConflict), "%v", err)
+}
+
+func TestWithTransactionRollsBack(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := &UserRepo{DB: db}
+	wallets := &WalletRepo{DB: db}
+
+	err := db.WithTransaction(ctx, func(ctx context.Context) error {
+		user, err := users.Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+		if err != nil {
+			return err
+		}
+		// no such user, the foreign key fails the wallet
+		_, err = wallets.Create(ctx, handlers.Wallet{UserId: primitive.NewObjectID(), PublicKey: user.ID.Hex()})
+		return err
+	})
+	require.Error(t, err)
+	_, err = users.FindByUsername(ctx, "ada@example.com")
+	assert.Equal(t, handlers.ErrNotFound, err)
+
+	err = db.WithTransaction(ctx, func(ctx context.Context) error {
+		user, err := users.Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+		if err != nil {
+			return err
+		}
+		_, err = wallets.Create(ctx, handlers.Wallet{UserId: user.ID, PublicKey: "0x01"})
+		return err
+	})
+	require.NoError(t, err)
+	found, err := users.Find(ctx, handlers.Filter{handlers.Eq("username", "ada@example.com")}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, handlers.ErrNotFound, users.Delete(ctx, primitive.NewObjectID()))
+}
+
+func TestRatingRepo(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := &UserRepo{DB: db}
+	ada, err := users.Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	require.NoError(t, err)
+	bob, err := users.Create(ctx, handlers.User{Email: "bob@example.com", Password: "hash"})
+	require.NoError(t, err)
+	repo := &RatingRepo{DB: db}
+
+	score, err := repo.Score(ctx, ada.ID)
+	require.NoError(t, err)
+	assert.Equal(t, handlers.Score{UserId: ada.ID}, score)
+
+	now := time.Now().Truncate(time.Millisecond)
+	byBob := handlers.Rating{UserId: ada.ID, RaterId: bob.ID, Source: handlers.RatingByUser, Value: 5, Key: "user:bob:ada", CreatedAt: now}
+	rating, score, err := repo.Create(ctx, byBob)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), score.Count)
+	assert.Equal(t, int64(5), score.Total)
+	assert.Equal(t, int64(0), score.SystemCount)
+	_, _, err = repo.Create(ctx, byBob)
+	assert.True(t, errors.Is(err, handlers.ErrConflict), "%v", err)
+	_, score, err = repo.Create(ctx, handlers.Rating{UserId: ada.ID, Source: handlers.RatingBySystem, Event: "order-1", Value: 2,
+		Key: "system:order-1:ada", CreatedAt: now.Add(time.Second)})
+	require.NoError(t, err)
+	assert.Equal(t, ada.ID, score.UserId)
+	assert.Equal(t, int64(2), score.Count)
+	assert.Equal(t, int64(7), score.Total)
+	assert.Equal(t, int64(1), score.SystemCount)
+	assert.Equal(t, int64(2), score.SystemTotal)
+	assert.True(t, now.Add(time.Second).Equal(score.UpdatedAt))
+	stored, err := repo.Score(ctx, ada.ID)
+	require.NoError(t, err)
+	assert.Equal(t, score, stored)
+
+	ratings, err := repo.Find(ctx, handlers.Filter{handlers.Eq("rater_id", bob.ID)}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, ratings, 1)
+	assert.Equal(t, rating.ID, ratings[0].ID)
+	ratings, err = repo.Find(ctx, handlers.Filter{handlers.Eq("source", handlers.RatingBySystem)}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, ratings, 1)
+	assert.True(t, ratings[0].RaterId.IsZero())
+	assert.Equal(t, "order-1", ratings[0].Event)
+
+	rules := &RatingRuleRepo{DB: db}
+	rule, err := rules.Create(ctx, handlers.RatingRule{RewardType: "high", MinCount: 2, MinAverage: 350, CreatedAt: now})
+	require.NoError(t, err)
+	found, err := rules.Find(ctx, handlers.Filter{}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, handlers.RatingAverage(350), found[0].MinAverage)
+	require.NoError(t, rules.Delete(ctx, rule.ID))
+	assert.Equal(t, handlers.ErrNotFound, rules.Delete(ctx, rule.ID))
+}
+
+func TestMigrateMakesRatingRulesExact(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDBWithout(t, 7)
+	ada, err := (&UserRepo{DB: db}).Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	require.NoError(t, err)
+	bob, err := (&UserRepo{DB: db}).Create(ctx, handlers.User{Email: "bob@example.com", Password: "hash"})
+	require.NoError(t, err)
+	now := time.Now().UTC()
+	_, err = db.ExecContext(ctx, "INSERT INTO ratings ("+ratingColumns+") VALUES (?, ?, NULL, 'system', 'order-1', 4, '', 'k1', ?), "+
+		"(?, ?, ?, 'user', '', 5, '', 'k2', ?)", primitive.NewObjectID().Hex(), ada.ID.Hex(), now,
+		primitive.NewObjectID().Hex(), ada.ID.Hex(), bob.ID.Hex(), now)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO rating_scores (user_id, count, total, updated_at) VALUES (?, 2, 9, ?)", ada.ID.Hex(), now)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "INSERT INTO rating_rules (id, reward_type, min_count, min_average, created_at) VALUES (?, 'high', 1, 4.35, ?)",
+		primitive.NewObjectID().Hex(), now)
+	require.NoError(t, err)
+
+	applyMigration(t, db, 7)
+	score, err := (&RatingRepo{DB: db}).Score(ctx, ada.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), score.Count)
+	assert.Equal(t, int64(1), score.SystemCount)
+	assert.Equal(t, int64(4), score.SystemTotal)
+	rules, err := (&RatingRuleRepo{DB: db}).Find(ctx, handlers.Filter{}, handlers.Page{})
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, handlers.RatingAverage(435), rules[0].MinAverage)
+}
+
+func TestUserRewardGrantKeyIsUnique(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	user, err := (&UserRepo{DB: db}).Create(ctx, handlers.User{Email: "ada@example.com", Password: "hash"})
+	require.NoError(t, err)
+	reward, err := (&RewardRepo{DB: db}).Create(ctx, handlers.Reward{Type: "high", Points: amount(t, "1"), AmountRedeemable: amount(t, "1"), Expiry: 1,
+		CreatedAt: time.Now()})
+	require.NoError(t, err)
+	repo := &UserRewardRepo{DB: db}
+
+	userReward := handlers.UserReward{UserId: user.ID, RewardId: reward.ID, Status: handlers.UserRewardOpen, CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour)}
+	for i := 0; i < 2; i++ {
+		_, err = repo.Create(ctx, userReward)
+		require.NoError(t, err, "user rewards granted by hand have no grant key")
+	}
+	userReward.GrantKey = "rule:high:ada"
+	granted, err := repo.Create(ctx, userReward)
+	require.NoError(t, err)
+	_, err = repo.Create(ctx, userReward)
+	assert.True(t, errors.Is(err, handlers.ErrConflict), "%v", err)
+	found, err := repo.FindByID(ctx, granted.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "rule:high:ada", found.GrantKey)
+}
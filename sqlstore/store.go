@@ -0,0 +1,340 @@
+//Package sqlstore keeps users, rewards, user rewards, wallets and ratings in PostgreSQL or an embedded SQLite
+//database behind the repositories of the handlers package
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Godtide/rating/handlers"
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/context"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	//Postgres is the driver of PostgreSQL databases, the dsn is a connection URL
+	Postgres = "postgres"
+	//SQLite is the driver of embedded SQLite databases, the dsn is a file path
+	SQLite = "sqlite"
+)
+
+//DB is a SQL database, Driver selects the dialect queries are written in
+type DB struct {
+	*sql.DB
+	Driver string
+}
+
+//Open connects to the database of driver at dsn, call Migrate before using the repositories
+func Open(driver, dsn string) (*DB, error) {
+	switch driver {
+	case Postgres:
+	case SQLite:
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		// times are compared as text, write them in one sortable format
+		dsn += sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+	default:
+		return nil, fmt.Errorf("unknown sql driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == SQLite {
+		// sqlite has a single writer, queue writes in the pool rather than fail with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to %s: %v", driver, err)
+	}
+	return &DB{DB: db, Driver: driver}, nil
+}
+
+//rebind rewrites the ? placeholders of query into the $n placeholders of postgres
+func (db *DB) rebind(query string) string {
+	if db.Driver != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+//querier is a *sql.DB or the *sql.Tx of a WithTransaction call
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type txKey struct{}
+
+//conn returns the transaction ctx carries, or the database outside of WithTransaction
+func (db *DB) conn(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return db.DB
+}
+
+//inTx runs fn in a transaction, committing when it returns nil. Inside WithTransaction fn joins
+//the transaction of ctx, which is committed by WithTransaction
+func (db *DB) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(tx)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//WithTransaction runs fn in a transaction, repository calls made with the ctx passed to fn take part in it
+func (db *DB) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return db.inTx(ctx, func(tx *sql.Tx) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+//sqlError maps driver errors to the repository errors
+func sqlError(err error) error {
+	var (
+		pqErr   *pq.Error
+		liteErr *sqlite.Error
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return handlers.ErrNotFound
+	case errors.As(err, &pqErr) && pqErr.Code == "23505",
+		errors.As(err, &liteErr) && (liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE ||
+			liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY):
+		return fmt.Errorf("%w: %v", handlers.ErrConflict, err)
+	}
+	return err
+}
+
+//objectID scans a CHAR(24) column holding a hex ObjectID, NULL scans as the zero ObjectID
+type objectID struct {
+	id *primitive.ObjectID
+}
+
+func (o objectID) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*o.id = primitive.NilObjectID
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into an ObjectID", src)
+	}
+	id, err := primitive.ObjectIDFromHex(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	*o.id = id
+	return nil
+}
+
+//nullID stores the zero ObjectID as NULL
+func nullID(id primitive.ObjectID) interface{} {
+	if id.IsZero() {
+		return nil
+	}
+	return id.Hex()
+}
+
+//nullString stores the empty string as NULL, for unique columns only some rows set
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+//nullTime stores the zero time as NULL, every time is stored in UTC
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+//comparisons are the SQL comparisons of the Filter operators
+var comparisons = map[handlers.Operator]string{
+	handlers.OpEq:  "=",
+	handlers.OpGt:  ">",
+	handlers.OpGte: ">=",
+	handlers.OpLt:  "<",
+	handlers.OpLte: "<=",
+}
+
+//decimalColumns hold token amounts. SQLite keeps them as text next to a sort key column, see
+//handlers.TokenAmount.SortKey, which they are compared and ordered by
+var decimalColumns = map[string]string{"points": "points_key", "amount_redeemable": "amount_redeemable_key"}
+
+//compared returns the column col is compared and ordered by
+func (db *DB) compared(col string) string {
+	if key, ok := decimalColumns[col]; ok && db.Driver == SQLite {
+		return key
+	}
+	return col
+}
+
+//comparedValue returns the argument value is compared with col as, the sort key of amounts on SQLite
+func (db *DB) comparedValue(col string, value interface{}) interface{} {
+	if amount, ok := value.(handlers.TokenAmount); ok && db.Driver == SQLite && decimalColumns[col] != "" {
+		return amount.SortKey()
+	}
+	return sqlValue(value)
+}
+
+//amountKeys returns the sort key columns of the amounts by column and their values on SQLite, none otherwise
+func (db *DB) amountKeys(amounts ...columnAmount) ([]string, []interface{}) {
+	if db.Driver != SQLite {
+		return nil, nil
+	}
+	var (
+		cols []string
+		args []interface{}
+	)
+	for _, a := range amounts {
+		cols = append(cols, decimalColumns[a.col])
+		args = append(args, a.amount.SortKey())
+	}
+	return cols, args
+}
+
+//columnAmount is the amount stored in a decimal column
+type columnAmount struct {
+	col    string
+	amount handlers.TokenAmount
+}
+
+//where turns filter into a WHERE clause over columns, which maps the json field names filters
+//may select on to their column
+func (db *DB) where(filter handlers.Filter, columns map[string]string) (string, []interface{}, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	for _, cond := range filter {
+		col, ok := columns[cond.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unknown field %s", handlers.ErrInvalidFilter, cond.Field)
+		}
+		if cond.Op == handlers.OpExists {
+			set, ok := cond.Value.(bool)
+			if !ok {
+				return "", nil, fmt.Errorf("%w: %s[exists] needs a bool", handlers.ErrInvalidFilter, cond.Field)
+			}
+			if set {
+				conds = append(conds, col+" IS NOT NULL")
+			} else {
+				conds = append(conds, col+" IS NULL")
+			}
+			continue
+		}
+		if cond.Op == handlers.OpIn {
+			values, ok := cond.Value.([]interface{})
+			if !ok || len(values) == 0 {
+				return "", nil, fmt.Errorf("%w: %s[in] needs a list", handlers.ErrInvalidFilter, cond.Field)
+			}
+			conds = append(conds, db.compared(col)+" IN (?"+strings.Repeat(", ?", len(values)-1)+")")
+			for _, value := range values {
+				args = append(args, db.comparedValue(col, value))
+			}
+			continue
+		}
+		comparison, ok := comparisons[cond.Op]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unknown operator %s", handlers.ErrInvalidFilter, cond.Op)
+		}
+		conds = append(conds, db.compared(col)+" "+comparison+" ?")
+		args = append(args, db.comparedValue(col, cond.Value))
+	}
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+//list turns filter and page into the WHERE, ORDER BY and LIMIT clauses of a listing over columns,
+//which maps the json field names filters and pages may use to their column
+func (db *DB) list(filter handlers.Filter, page handlers.Page, columns map[string]string) (string, []interface{}, error) {
+	cond, args, err := db.where(filter, columns)
+	if err != nil {
+		return "", nil, err
+	}
+	col, ok := columns[page.SortField()]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: cannot sort on %s", handlers.ErrInvalidFilter, page.Sort)
+	}
+	comparison, dir := ">", ""
+	if page.Desc {
+		comparison, dir = "<", " DESC"
+	}
+	expr := db.compared(col)
+	order := " ORDER BY " + expr + dir
+	if col != "id" {
+		order += ", id" + dir
+	}
+	if page.After != nil {
+		past := "id " + comparison + " ?"
+		pastArgs := []interface{}{page.After.ID.Hex()}
+		if col != "id" {
+			past = "(" + expr + " " + comparison + " ? OR (" + expr + " = ? AND id " + comparison + " ?))"
+			value := db.comparedValue(col, page.After.Value)
+			pastArgs = []interface{}{value, value, page.After.ID.Hex()}
+		}
+		if cond == "" {
+			cond = " WHERE " + past
+		} else {
+			cond += " AND " + past
+		}
+		args = append(args, pastArgs...)
+	}
+	if page.Limit > 0 {
+		order += " LIMIT " + strconv.Itoa(page.Limit)
+	}
+	return cond + order, args, nil
+}
+
+//sqlValue converts a Condition value into the form its column is stored in
+func sqlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case time.Time:
+		return v.UTC()
+	case handlers.TokenAmount:
+		return v.String()
+	}
+	return value
+}